@@ -321,6 +321,12 @@ func cmdCreate(c *cli.Context) {
 		log.Warn("You will want to check the provider to make sure the machine and associated resources were properly removed.")
 		log.Fatal("Error creating machine")
 	}
+
+	if drivers.IsDryRun(host.Driver) {
+		log.Infof("Dry run of %q succeeded, nothing was created.", name)
+		return
+	}
+
 	if err := store.SetActive(host); err != nil {
 		log.Fatalf("error setting active host: %v", err)
 	}
@@ -1,16 +1,25 @@
 package amazonec2
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -19,52 +28,247 @@ import (
 	"github.com/docker/machine/drivers/amazonec2/amz"
 	"github.com/docker/machine/ssh"
 	"github.com/docker/machine/state"
+	"github.com/docker/machine/utils"
 )
 
 const (
-	driverName               = "amazonec2"
-	defaultRegion            = "us-east-1"
-	defaultInstanceType      = "t2.micro"
-	defaultRootSize          = 16
-	ipRange                  = "0.0.0.0/0"
-	dockerConfigDir          = "/etc/docker"
-	machineSecurityGroupName = "docker-machine"
+	driverName                        = "amazonec2"
+	defaultRegion                     = "us-east-1"
+	defaultInstanceType               = "t2.micro"
+	defaultRootSize                   = 16
+	defaultRootVolumeType             = "gp2"
+	defaultRootDeviceName             = "/dev/sda1"
+	defaultPlacementStrategy          = "cluster"
+	defaultSSHTimeout                 = 120
+	defaultPublicIPAttempts           = 60
+	defaultSecurityGroupDeleteTimeout = 300
+	ipRange                           = "0.0.0.0/0"
+	ipv6Range                         = "::/0"
+	dockerConfigDir                   = "/etc/docker"
+	dockerDataDir                     = "/var/lib/docker"
+	machineSecurityGroupName          = "docker-machine"
+	defaultAMIOwner                   = "099720109477" // Canonical
+	defaultAMINamePattern             = "ubuntu/images/hvm-ssd/ubuntu-trusty-14.04-amd64-server-*"
+	ubuntuReleaseAMINamePattern       = "ubuntu/images/hvm-ssd*/ubuntu-%s-*-amd64-server-*"
+	defaultAMIArchitecture            = "x86_64"
+	defaultInstallDockerMethod        = "script"
+	defaultTenancy                    = "default"
+	defaultRunInstanceRetries         = 3
+	defaultCloudInitTimeout           = 600
+	defaultTagsEnvVar                 = "MACHINE_AWS_DEFAULT_TAGS"
+	maxTags                           = 50
+	defaultSSHKeyFilename             = "id_rsa"
+	defaultSSHUser                    = "ubuntu"
+	defaultSSHPort                    = 22
+	defaultDockerPort                 = 2376
+	defaultCreateTimeout              = 600
+	instancePollInterval              = 1 * time.Second
+	sshPollInterval                   = 2 * time.Second
+	maxUserDataSize                   = 16 * 1024
+	defaultSpotInterruptionBehavior   = "terminate"
+	dockerInstallScriptURL            = "https://get.docker.com"
+	defaultCredentialProfile          = "default"
 )
 
 var (
-	dockerPort = 2376
-	swarmPort  = 3376
+	swarmPort = 3376
+
+	securityGroupDeletePollInterval = 5 * time.Second
+
+	// DescribeInstances can briefly return an empty set while an instance
+	// is stopping or starting, so an empty result is retried with a
+	// growing backoff before it is taken at face value.
+	instanceLookupRetries = 3
+	instanceLookupBackoff = 500 * time.Millisecond
+
+	runInstanceRetryInterval = 2 * time.Second
+
+	ipAddressPollInterval = 5 * time.Second
+
+	volumeModificationPollInterval = 5 * time.Second
+
+	// an open spot request is cancelled when it is not fulfilled in time,
+	// e.g. because the bid stays below the spot price
+	spotRequestPollInterval = 5 * time.Second
+	spotRequestTimeout      = 10 * time.Minute
+
+	// the daemon restarts after TLS is configured, give it time to listen
+	dockerEndpointTimeout = 30 * time.Second
+
+	// throttled requests are retried the same way by every machine in the
+	// process, as configured by the first driver
+	throttleRetriesOnce sync.Once
 )
 
 type Driver struct {
-	Id                 string
-	AccessKey          string
-	SecretKey          string
-	SessionToken       string
-	Region             string
-	AMI                string
-	SSHKeyID           int
-	KeyName            string
+	Id                         string
+	AccessKey                  string
+	SecretKey                  string
+	SessionToken               string
+	CredentialProfile          string
+	Region                     string
+	Partition                  string
+	Endpoint                   string
+	AMI                        string
+	AMIName                    string
+	UbuntuRelease              string
+	AMIOwners                  []string
+	SSHKeyID                   int
+	KeyName                    string
+	InstanceId                 string
+	InstanceType               string
+	SkipInstanceTypeCheck      bool
+	IPAddress                  string
+	PrivateIPAddress           string
+	MachineName                string
+	SecurityGroupId            string
+	SecurityGroupName          string
+	SecurityGroupNames         []string
+	SecurityGroupIds           []string
+	ReservationId              string
+	RootSize                   int64
+	RootVolumeType             string
+	RootIops                   int64
+	RootThroughput             int64
+	RootDeviceName             string
+	AdditionalVolumes          []AdditionalVolume
+	DockerDataPath             string
+	EncryptEbsVolume           bool
+	EbsOptimized               bool
+	Monitoring                 bool
+	Hibernate                  bool
+	KmsKeyId                   string
+	RunInstanceRetries         int
+	ClientToken                string
+	RequestSpotInstance        bool
+	SpotPrice                  string
+	SpotInterruptionBehavior   string
+	SpotInstanceRequestId      string
+	IamInstanceProfile         string
+	UserData                   string
+	SSHUser                    string
+	Hostname                   string
+	SkipHostname               bool
+	SSHPort                    int
+	DockerPort                 int
+	SSHTimeout                 int
+	CreateTimeout              int
+	DisableSSHMultiplexing     bool
+	SSHKeyFilename             string
+	SharedKeyPairName          string
+	ExistingKey                bool
+	SSHPrivateKeyPath          string
+	WaitCloudInit              bool
+	CloudInitTimeout           int
+	PublicIPAttempts           int
+	StopGracePeriod            int
+	StopFallbackTerminate      bool
+	KeepOnCreateFailure        bool
+	DryRun                     bool
+	ReconcileSecurityGroup     bool
+	SkipSecurityGroupCreation  bool
+	OpenPortCidrs              []string
+	OpenPorts                  []string
+	DeleteSecurityGroup        bool
+	SecurityGroupDeleteTimeout int
+	TimingSummary              bool
+	InstanceStore              bool
+	RejectDeprecatedAMI        bool
+	Tags                       map[string]string
+	UsePrivateAddress          bool
+	PrivateAddressOnly         bool
+	AssignIpv6                 bool
+	DisableSourceDestCheck     bool
+	NetworkInterfaceId         string
+	UseElasticIP               bool
+	ElasticIPAllocationId      string
+	ElasticIPAssociationId     string
+	ElasticIPAllocated         bool
+	ElasticIP                  string
+	InstallDocker              bool
+	InstallDockerMethod        string
+	DockerVersion              string
+	VpcId                      string
+	SubnetId                   string
+	SubnetIds                  []string
+	CreateSubnetCidr           string
+	DeleteSubnet               bool
+	SubnetCreated              bool
+	Zone                       string
+	Zones                      []string
+	ZoneId                     string
+	ActualZone                 string
+	Tenancy                    string
+	HostResourceGroupArn       string
+	HostId                     string
+	HostAffinity               string
+	PlacementGroup             string
+	CreatePlacementGroup       bool
+	PlacementStrategy          string
+	PartitionCount             int
+	PlacementGroupCreated      bool
+	CaCertPath                 string
+	PrivateKeyPath             string
+	SwarmMaster                bool
+	SwarmHost                  string
+	SwarmDiscovery             string
+	storePath                  string
+	keyPath                    string
+	transport                  http.RoundTripper
+	instanceStoreDisks         int
+	securityGroupCreated       bool
+	placementGroupMissing      bool
+	ctx                        context.Context
+	amiRootDeviceType          string
+	subnetZones                map[string]string
+	instanceTypeOfferings      map[string][]string
+	progressHandler            func(ProgressEvent)
+	client                     *amz.EC2
+	clientConfig               clientConfig
+	clientTransport            http.RoundTripper
+	clientRefresh              time.Time
+	clientMu                   sync.Mutex
+}
+
+// BlockDevice describes a volume attached to the instance.
+type BlockDevice struct {
+	DeviceName string
+	VolumeId   string
+	Size       int64
+	VolumeType string
+	Root       bool
+}
+
+// AdditionalVolume describes an EBS data volume attached at create time.
+type AdditionalVolume struct {
+	DeviceName string
+	Size       int64
+	VolumeType string
+}
+
+// SecurityGroupRules holds the permissions currently set on the security
+// group of the machine.
+type SecurityGroupRules struct {
+	Ingress []amz.IpPermission
+	Egress  []amz.IpPermission
+}
+
+// InstanceInfo describes a created machine as EC2 currently reports it.
+type InstanceInfo struct {
 	InstanceId         string
-	InstanceType       string
-	IPAddress          string
-	PrivateIPAddress   string
-	MachineName        string
-	SecurityGroupId    string
-	SecurityGroupName  string
 	ReservationId      string
-	RootSize           int64
-	IamInstanceProfile string
+	InstanceType       string
+	AMI                string
+	State              state.State
+	Region             string
+	Zone               string
 	VpcId              string
 	SubnetId           string
-	Zone               string
-	CaCertPath         string
-	PrivateKeyPath     string
-	SwarmMaster        bool
-	SwarmHost          string
-	SwarmDiscovery     string
-	storePath          string
-	keyPath            string
+	SecurityGroupIds   []string
+	PublicIPAddress    string
+	PrivateIPAddresses []string
+	IPv6Addresses      []string
+	LaunchTime         time.Time
 }
 
 type CreateFlags struct {
@@ -99,6 +303,12 @@ func GetCreateFlags() []cli.Flag {
 			Value:  "",
 			EnvVar: "AWS_SECRET_ACCESS_KEY",
 		},
+		cli.StringFlag{
+			Name:   "amazonec2-credential-profile",
+			Usage:  "Profile of the shared AWS credentials file to read the keys from when none are given",
+			Value:  defaultCredentialProfile,
+			EnvVar: "AWS_PROFILE",
+		},
 		cli.StringFlag{
 			Name:   "amazonec2-session-token",
 			Usage:  "AWS Session Token",
@@ -110,12 +320,88 @@ func GetCreateFlags() []cli.Flag {
 			Usage:  "AWS machine image",
 			EnvVar: "AWS_AMI",
 		},
+		cli.StringFlag{
+			Name:  "amazonec2-ami-name",
+			Usage: "AWS machine image name pattern; the newest match from a trusted owner is used",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-ubuntu-release",
+			Usage: "Ubuntu release codename (e.g. xenial) whose newest image from a trusted owner is used",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-reject-deprecated-ami",
+			Usage: "Fail instead of warning when the machine image is deprecated",
+		},
+		cli.StringSliceFlag{
+			Name:  "amazonec2-ami-owner",
+			Usage: "AWS account ID trusted as the owner of dynamically looked up machine images (repeatable)",
+			Value: &cli.StringSlice{},
+		},
 		cli.StringFlag{
 			Name:   "amazonec2-region",
 			Usage:  "AWS region",
 			Value:  defaultRegion,
 			EnvVar: "AWS_DEFAULT_REGION",
 		},
+		cli.StringFlag{
+			Name:  "amazonec2-partition",
+			Usage: "AWS partition (aws, aws-cn or aws-us-gov), derived from the region if empty",
+		},
+		cli.StringFlag{
+			Name:   "amazonec2-endpoint",
+			Usage:  "Custom EC2 endpoint URL, e.g. a VPC endpoint or a mock EC2 for tests; any region name is accepted with it",
+			Value:  "",
+			EnvVar: "AWS_EC2_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-create-subnet",
+			Usage: "Create a subnet with this CIDR block in the VPC and zone instead of looking one up",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-delete-subnet",
+			Usage: "Delete the subnet created with --amazonec2-create-subnet when the machine is removed",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-zone-id",
+			Usage: "AWS zone ID for instance (i.e. use1-az1), takes precedence over --amazonec2-zone",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-tenancy",
+			Usage: "AWS instance tenancy: default, dedicated or host",
+			Value: defaultTenancy,
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-host-resource-group-arn",
+			Usage: "ARN of the license manager host resource group to launch the instance in",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-host-id",
+			Usage: "ID of the dedicated host to launch the instance on",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-host-affinity",
+			Usage: "Dedicated host affinity: default, or host to return to the same host after a stop",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-placement-group",
+			Usage: "Name of the placement group to launch the instance in",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-create-placement-group",
+			Usage: "Create the placement group with --amazonec2-placement-strategy if it does not exist, and delete it with the last machine in it",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-placement-strategy",
+			Usage: "Strategy of the placement group: cluster, spread or partition; a created group uses cluster by default",
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-partition-count",
+			Usage: "Number of partitions of a placement group with the partition strategy, 1 to 7",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-skip-instance-type-check",
+			Usage: "Do not check that the instance type is offered in the region or zone, e.g. without access to the API",
+		},
 		cli.StringFlag{
 			Name:   "amazonec2-vpc-id",
 			Usage:  "AWS VPC id",
@@ -124,22 +410,49 @@ func GetCreateFlags() []cli.Flag {
 		},
 		cli.StringFlag{
 			Name:   "amazonec2-zone",
-			Usage:  "AWS zone for instance (i.e. a,b,c,d,e)",
+			Usage:  "AWS zone for instance (i.e. a,b,c,d,e); a comma-separated list is tried in order",
 			Value:  "a",
 			EnvVar: "AWS_ZONE",
 		},
 		cli.StringFlag{
 			Name:   "amazonec2-subnet-id",
-			Usage:  "AWS VPC subnet id",
+			Usage:  "AWS VPC subnet id (comma-separated to pick one per machine name and fall back to the others without capacity)",
 			Value:  "",
 			EnvVar: "AWS_SUBNET_ID",
 		},
 		cli.StringFlag{
 			Name:   "amazonec2-security-group",
-			Usage:  "AWS VPC security group",
+			Usage:  "Comma-separated AWS VPC security groups; the first is created if missing, the others must exist",
 			Value:  "docker-machine",
 			EnvVar: "AWS_SECURITY_GROUP",
 		},
+		cli.BoolFlag{
+			Name:  "amazonec2-delete-security-group",
+			Usage: "Delete the security group when the machine is removed",
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-security-group-delete-timeout",
+			Usage: "Seconds to keep retrying the security group delete while it is still in use",
+			Value: defaultSecurityGroupDeleteTimeout,
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-security-group-reconcile",
+			Usage: "Revoke security group rules that docker-machine did not ask for",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-skip-security-group-creation",
+			Usage: "Fail instead of creating the security group when it does not exist, e.g. without the ec2:CreateSecurityGroup permission",
+		},
+		cli.StringSliceFlag{
+			Name:  "amazonec2-open-port",
+			Usage: "Additional port to open in the security group as port/protocol, e.g. 8080 or 53/udp (repeatable)",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			Name:  "amazonec2-open-port-cidr",
+			Usage: "CIDR block the security group opens the SSH, Docker and Swarm ports to (repeatable), 0.0.0.0/0 if not given",
+			Value: &cli.StringSlice{},
+		},
 		cli.StringFlag{
 			Name:   "amazonec2-instance-type",
 			Usage:  "AWS instance type",
@@ -152,9 +465,237 @@ func GetCreateFlags() []cli.Flag {
 			Value:  defaultRootSize,
 			EnvVar: "AWS_ROOT_SIZE",
 		},
+		cli.StringFlag{
+			Name:  "amazonec2-root-device-name",
+			Usage: "Device name of the root volume, e.g. /dev/xvda; read from the AMI when empty",
+		},
 		cli.StringFlag{
 			Name:  "amazonec2-iam-instance-profile",
-			Usage: "AWS IAM Instance Profile",
+			Usage: "AWS IAM instance profile, by name or ARN",
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-public-ip-attempts",
+			Usage: "Number of 5 second polls for a public IP before the create fails or, when no public IP was requested, falls back to the private IP (0 waits until the create timeout)",
+			Value: defaultPublicIPAttempts,
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-stop-grace-period",
+			Usage: "Seconds to wait after stopping Docker before stopping the instance",
+			Value: 0,
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-keep-on-create-failure",
+			Usage: "Keep the instance and the resources created for it when create fails, e.g. for debugging",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-dry-run",
+			Usage: "Check that the machine could be created without creating anything; the create then fails with a dry run message",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-stop-fallback-terminate",
+			Usage: "Terminate the instance on stop when it cannot be stopped, e.g. with an instance store root device",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-use-private-address",
+			Usage: "Use the private IP address of the instance when no public one is assigned within --amazonec2-public-ip-attempts polls",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-private-address-only",
+			Usage: "Launch the instance without a public IP address and connect to its private one",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-network-interface-id",
+			Usage: "Existing network interface to attach as the primary one; its subnet and security groups are used and it is kept on remove",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-disable-source-dest-check",
+			Usage: "Disable the source/destination check of the instance so it can act as a NAT instance or router",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-assign-ipv6",
+			Usage: "Assign an IPv6 address to the instance and open its ports to ::/0 as well; the subnet must have an IPv6 CIDR block",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-use-elastic-ip",
+			Usage: "Allocate an Elastic IP address for the instance so its public IP survives a stop",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-elastic-ip-allocation-id",
+			Usage: "Allocation ID of an existing Elastic IP address to associate instead of allocating one",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-user-data",
+			Usage: "Path to a user data file, e.g. a cloud-init script, run by the instance on boot",
+		},
+		cli.StringSliceFlag{
+			Name:  "amazonec2-tags",
+			Usage: "Tags for the instance as key=value or key,value pairs (repeatable), merged over " + defaultTagsEnvVar,
+			Value: &cli.StringSlice{},
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-instance-store",
+			Usage: "Map the instance store volumes of the instance type and use the first one for Docker's data",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-install-docker",
+			Usage: "Install Docker on the instance when the AMI does not provide it",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-install-docker-method",
+			Usage: "How to install Docker: script (get.docker.com) or package (distro packages)",
+			Value: defaultInstallDockerMethod,
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-docker-version",
+			Usage: "Docker version to install; the latest when empty",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-client-token",
+			Usage: "Idempotency token for launching the instance; generated when empty",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-root-volume-type",
+			Usage: "AWS EBS volume type of the root volume: standard, gp2, gp3, io1 or io2",
+			Value: defaultRootVolumeType,
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-root-iops",
+			Usage: "Provisioned IOPS of the root volume, required for io1 and io2",
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-root-throughput",
+			Usage: "Throughput of the root volume in MiB/s, between 125 and 1000, gp3 only",
+		},
+		cli.StringSliceFlag{
+			Name:  "amazonec2-additional-volume",
+			Usage: "Additional EBS volume as device:sizeGB:type, e.g. /dev/sdb:100:gp2 (repeatable)",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-docker-data-path",
+			Usage: "Format the first additional volume and mount it at this path, e.g. /var/lib/docker",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-ebs-optimized",
+			Usage: "Launch an EBS-optimized instance with dedicated EBS bandwidth",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-monitoring",
+			Usage: "Enable CloudWatch detailed monitoring, metrics every minute instead of every five minutes",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-hibernate",
+			Usage: "Launch the instance with hibernation enabled and hibernate it on stop; requires --amazonec2-encrypt-ebs-volume",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-encrypt-ebs-volume",
+			Usage: "Encrypt the root volume, with the default EBS key of the account unless --amazonec2-kms-key-id is given",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-kms-key-id",
+			Usage: "ID or ARN of the KMS key encrypting the root volume",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-request-spot-instance",
+			Usage: "Request a spot instance instead of an on-demand one",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-spot-price",
+			Usage: "Maximum hourly price in USD for the spot instance; the on-demand price when empty",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-spot-interruption-behavior",
+			Usage: "What happens to the spot instance when it is interrupted: terminate, stop or hibernate",
+			Value: defaultSpotInterruptionBehavior,
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-run-instance-retries",
+			Usage: "Number of times launching the instance is retried on transient EC2 errors",
+			Value: defaultRunInstanceRetries,
+		},
+		cli.IntFlag{
+			Name:   "amazonec2-max-concurrent-requests",
+			Usage:  "Maximum number of concurrent AWS API requests shared by all machines in the process",
+			Value:  0,
+			EnvVar: "AWS_MAX_CONCURRENT_REQUESTS",
+		},
+		cli.IntFlag{
+			Name:   "amazonec2-requests-per-second",
+			Usage:  "Maximum number of AWS API requests per second shared by all machines in the process",
+			Value:  0,
+			EnvVar: "AWS_REQUESTS_PER_SECOND",
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-throttle-attempts",
+			Usage: "Number of times a throttled AWS API request is tried, backing off exponentially, before it fails",
+			Value: amz.DefaultThrottleAttempts,
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-timing-summary",
+			Usage: "Log a JSON summary of how long each create phase took",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-hostname",
+			Usage: "Hostname of the instance, e.g. web-01.prod.internal; defaults to the machine name",
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-skip-hostname",
+			Usage: "Leave the hostname of the instance alone, for AMIs that set it with cloud-init",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-ssh-user",
+			Usage: "SSH user of the AMI, e.g. ec2-user for Amazon Linux or centos for CentOS",
+			Value: defaultSSHUser,
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-ssh-port",
+			Usage: "SSH port of the AMI; opened in the security group instead of 22",
+			Value: defaultSSHPort,
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-docker-port",
+			Usage: "Port the Docker daemon listens on; opened in the security group instead of 2376",
+			Value: defaultDockerPort,
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-create-timeout",
+			Usage: "Seconds the whole create may take until the machine is reachable over SSH",
+			Value: defaultCreateTimeout,
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-ssh-timeout",
+			Usage: "Seconds to wait for SSH to accept authentication after boot",
+			Value: defaultSSHTimeout,
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-wait-cloud-init",
+			Usage: "Wait for cloud-init to finish before configuring the instance",
+		},
+		cli.IntFlag{
+			Name:  "amazonec2-cloud-init-timeout",
+			Usage: "Seconds to wait for cloud-init to finish",
+			Value: defaultCloudInitTimeout,
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-shared-keypair-name",
+			Usage: "Name of a key pair shared by all machines using it; created on first use",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-keypair-name",
+			Usage: "Name of an existing key pair to use instead of generating one; requires --amazonec2-ssh-keypath",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-ssh-keypath",
+			Usage: "Path to the private key of the key pair given with --amazonec2-keypair-name",
+		},
+		cli.StringFlag{
+			Name:  "amazonec2-ssh-key-filename",
+			Usage: "File name of the generated SSH key in the machine directory, e.g. id_rsa_docker; the key is always RSA",
+			Value: defaultSSHKeyFilename,
+		},
+		cli.BoolFlag{
+			Name:  "amazonec2-ssh-disable-multiplexing",
+			Usage: "Open a new SSH connection for every command instead of sharing one",
 		},
 	}
 }
@@ -165,412 +706,3427 @@ func NewDriver(machineName string, storePath string, caCert string, privateKey s
 }
 
 func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
-	region, err := validateAwsRegion(flags.String("amazonec2-region"))
-	if err != nil {
-		return err
-	}
+	// a custom endpoint may serve regions the driver does not know about,
+	// e.g. LocalStack
+	d.Endpoint = flags.String("amazonec2-endpoint")
+	region := flags.String("amazonec2-region")
+	if d.Endpoint == "" {
+		if _, err := validateAwsRegion(region); err != nil {
+			return err
+		}
+	} else {
+		u, err := url.Parse(d.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid --amazonec2-endpoint %q, expected an http or https URL", d.Endpoint)
+		}
 
-	image := flags.String("amazonec2-ami")
-	if len(image) == 0 {
-		image = regionDetails[region].AmiId
+		if region == "" {
+			return fmt.Errorf("--amazonec2-endpoint requires --amazonec2-region")
+		}
 	}
 
 	d.AccessKey = flags.String("amazonec2-access-key")
 	d.SecretKey = flags.String("amazonec2-secret-key")
 	d.SessionToken = flags.String("amazonec2-session-token")
+	d.CredentialProfile = flags.String("amazonec2-credential-profile")
 	d.Region = region
-	d.AMI = image
+	d.Partition = flags.String("amazonec2-partition")
+	d.AMI = flags.String("amazonec2-ami")
+	d.AMIName = flags.String("amazonec2-ami-name")
+	d.UbuntuRelease = flags.String("amazonec2-ubuntu-release")
+	d.AMIOwners = flags.StringSlice("amazonec2-ami-owner")
+	d.RejectDeprecatedAMI = flags.Bool("amazonec2-reject-deprecated-ami")
 	d.InstanceType = flags.String("amazonec2-instance-type")
+	d.SkipInstanceTypeCheck = flags.Bool("amazonec2-skip-instance-type-check")
 	d.VpcId = flags.String("amazonec2-vpc-id")
-	d.SubnetId = flags.String("amazonec2-subnet-id")
-	d.SecurityGroupName = flags.String("amazonec2-security-group")
-	zone := flags.String("amazonec2-zone")
-	d.Zone = zone[:]
+	d.SubnetIds = splitList(flags.String("amazonec2-subnet-id"))
+	d.SubnetId = pickSubnet(d.MachineName, d.SubnetIds)
+	d.CreateSubnetCidr = flags.String("amazonec2-create-subnet")
+	d.DeleteSubnet = flags.Bool("amazonec2-delete-subnet")
+	d.SecurityGroupNames = splitList(flags.String("amazonec2-security-group"))
+	if len(d.SecurityGroupNames) == 0 {
+		d.SecurityGroupNames = []string{machineSecurityGroupName}
+	}
+	d.SecurityGroupName = d.SecurityGroupNames[0]
+	d.ReconcileSecurityGroup = flags.Bool("amazonec2-security-group-reconcile")
+	d.SkipSecurityGroupCreation = flags.Bool("amazonec2-skip-security-group-creation")
+	d.DeleteSecurityGroup = flags.Bool("amazonec2-delete-security-group")
+	d.SecurityGroupDeleteTimeout = flags.Int("amazonec2-security-group-delete-timeout")
+	d.TimingSummary = flags.Bool("amazonec2-timing-summary")
+	d.InstanceStore = flags.Bool("amazonec2-instance-store")
+
+	tags, err := parseTags(os.Getenv(defaultTagsEnvVar))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", defaultTagsEnvVar, err)
+	}
+	d.Tags = tags
+
+	for _, value := range flags.StringSlice("amazonec2-tags") {
+		tags, err := parseTags(value)
+		if err != nil {
+			return fmt.Errorf("invalid --amazonec2-tags: %s", err)
+		}
+
+		// explicit tags win over the defaults from the environment
+		for k, v := range tags {
+			d.Tags[k] = v
+		}
+	}
+
+	// the Name tag is always added
+	count := len(d.Tags)
+	if _, ok := d.Tags["Name"]; !ok {
+		count++
+	}
+
+	if count > maxTags {
+		return fmt.Errorf("too many tags, EC2 allows at most %d including the Name tag", maxTags)
+	}
+	d.UsePrivateAddress = flags.Bool("amazonec2-use-private-address")
+	d.PrivateAddressOnly = flags.Bool("amazonec2-private-address-only")
+	d.AssignIpv6 = flags.Bool("amazonec2-assign-ipv6")
+	d.DisableSourceDestCheck = flags.Bool("amazonec2-disable-source-dest-check")
+	d.NetworkInterfaceId = flags.String("amazonec2-network-interface-id")
+	d.ElasticIPAllocationId = flags.String("amazonec2-elastic-ip-allocation-id")
+	d.UseElasticIP = flags.Bool("amazonec2-use-elastic-ip") || d.ElasticIPAllocationId != ""
+	d.InstallDocker = flags.Bool("amazonec2-install-docker")
+	d.InstallDockerMethod = flags.String("amazonec2-install-docker-method")
+	d.DockerVersion = flags.String("amazonec2-docker-version")
+
+	// the limits are shared by every machine in the process, the first
+	// configured driver sets them
+	amz.SetRequestLimits(
+		flags.Int("amazonec2-max-concurrent-requests"),
+		flags.Int("amazonec2-requests-per-second"),
+	)
+	throttleRetriesOnce.Do(func() {
+		amz.SetThrottleRetries(flags.Int("amazonec2-throttle-attempts"), amz.DefaultThrottleBaseDelay)
+	})
+	d.Zones = splitList(flags.String("amazonec2-zone"))
+	if len(d.Zones) > 0 {
+		d.Zone = d.Zones[0]
+	}
+	d.ZoneId = flags.String("amazonec2-zone-id")
 	d.RootSize = int64(flags.Int("amazonec2-root-size"))
+	d.RootVolumeType = flags.String("amazonec2-root-volume-type")
+	d.RootIops = int64(flags.Int("amazonec2-root-iops"))
+	d.RootThroughput = int64(flags.Int("amazonec2-root-throughput"))
+	d.RootDeviceName = flags.String("amazonec2-root-device-name")
+	d.DockerDataPath = flags.String("amazonec2-docker-data-path")
+	d.EncryptEbsVolume = flags.Bool("amazonec2-encrypt-ebs-volume")
+	d.EbsOptimized = flags.Bool("amazonec2-ebs-optimized")
+	d.Monitoring = flags.Bool("amazonec2-monitoring")
+	d.Hibernate = flags.Bool("amazonec2-hibernate")
+	d.KmsKeyId = flags.String("amazonec2-kms-key-id")
 	d.IamInstanceProfile = flags.String("amazonec2-iam-instance-profile")
+
+	if userDataFile := flags.String("amazonec2-user-data"); userDataFile != "" {
+		userData, err := ioutil.ReadFile(userDataFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --amazonec2-user-data: %s", err)
+		}
+
+		d.UserData = base64.StdEncoding.EncodeToString(userData)
+		if len(d.UserData) > maxUserDataSize {
+			return fmt.Errorf("--amazonec2-user-data %s is %d bytes base64 encoded, EC2 allows at most %d", userDataFile, len(d.UserData), maxUserDataSize)
+		}
+	}
+	d.RunInstanceRetries = flags.Int("amazonec2-run-instance-retries")
+	d.ClientToken = flags.String("amazonec2-client-token")
+	d.RequestSpotInstance = flags.Bool("amazonec2-request-spot-instance")
+	d.SpotPrice = flags.String("amazonec2-spot-price")
+	d.SpotInterruptionBehavior = flags.String("amazonec2-spot-interruption-behavior")
+	d.Tenancy = flags.String("amazonec2-tenancy")
+	d.HostResourceGroupArn = flags.String("amazonec2-host-resource-group-arn")
+	d.HostId = flags.String("amazonec2-host-id")
+	d.HostAffinity = flags.String("amazonec2-host-affinity")
+	d.PlacementGroup = flags.String("amazonec2-placement-group")
+	d.CreatePlacementGroup = flags.Bool("amazonec2-create-placement-group")
+	d.PlacementStrategy = flags.String("amazonec2-placement-strategy")
+	d.PartitionCount = flags.Int("amazonec2-partition-count")
+	d.SSHUser = flags.String("amazonec2-ssh-user")
+	d.Hostname = flags.String("amazonec2-hostname")
+	d.SkipHostname = flags.Bool("amazonec2-skip-hostname")
+	d.SSHPort = flags.Int("amazonec2-ssh-port")
+	d.DockerPort = flags.Int("amazonec2-docker-port")
+	d.SSHTimeout = flags.Int("amazonec2-ssh-timeout")
+	d.CreateTimeout = flags.Int("amazonec2-create-timeout")
+	d.DisableSSHMultiplexing = flags.Bool("amazonec2-ssh-disable-multiplexing")
+	d.SSHKeyFilename = flags.String("amazonec2-ssh-key-filename")
+	d.SharedKeyPairName = flags.String("amazonec2-shared-keypair-name")
+	d.KeyName = flags.String("amazonec2-keypair-name")
+	d.SSHPrivateKeyPath = flags.String("amazonec2-ssh-keypath")
+	d.ExistingKey = d.KeyName != ""
+	d.WaitCloudInit = flags.Bool("amazonec2-wait-cloud-init")
+	d.CloudInitTimeout = flags.Int("amazonec2-cloud-init-timeout")
+	d.PublicIPAttempts = flags.Int("amazonec2-public-ip-attempts")
+	d.StopGracePeriod = flags.Int("amazonec2-stop-grace-period")
+	d.StopFallbackTerminate = flags.Bool("amazonec2-stop-fallback-terminate")
+	d.KeepOnCreateFailure = flags.Bool("amazonec2-keep-on-create-failure")
+	d.DryRun = flags.Bool("amazonec2-dry-run")
 	d.SwarmMaster = flags.Bool("swarm-master")
 	d.SwarmHost = flags.String("swarm-host")
 	d.SwarmDiscovery = flags.String("swarm-discovery")
 
-	if d.AccessKey == "" {
-		return fmt.Errorf("amazonec2 driver requires the --amazonec2-access-key option")
+	if d.AccessKey == "" && d.SecretKey == "" {
+		if err := d.loadSharedCredentials(); err != nil {
+			return err
+		}
 	}
 
-	if d.SecretKey == "" {
+	if d.AccessKey == "" && d.SecretKey == "" {
+		// on EC2 the credentials of the instance role are used. They are not
+		// stored as they expire, every client reads them again.
+		if auth := amz.GetAuth("", "", ""); auth.AccessKey == "" {
+			return fmt.Errorf("amazonec2 driver requires the --amazonec2-access-key option")
+		}
+		log.Debug("using the credentials of the instance role")
+	} else if d.AccessKey == "" {
+		return fmt.Errorf("amazonec2 driver requires the --amazonec2-access-key option")
+	} else if d.SecretKey == "" {
 		return fmt.Errorf("amazonec2 driver requires the --amazonec2-secret-key option")
 	}
 
-	if d.SubnetId == "" && d.VpcId == "" {
+	if d.Partition != "" {
+		if err := amz.ValidatePartition(d.Partition); err != nil {
+			return err
+		}
+	}
+
+	if d.NetworkInterfaceId != "" {
+		if err := d.validateNetworkInterfaceFlags(flags); err != nil {
+			return err
+		}
+	} else if d.SubnetId == "" && d.VpcId == "" {
 		return fmt.Errorf("amazonec2 driver requires either the --amazonec2-subnet-id or --amazonec2-vpc-id option")
 	}
 
-	if d.isSwarmMaster() {
-		u, err := url.Parse(d.SwarmHost)
-		if err != nil {
-			return fmt.Errorf("error parsing swarm host: %s", err)
+	if d.CreateSubnetCidr != "" {
+		if d.VpcId == "" || d.SubnetId != "" {
+			return fmt.Errorf("--amazonec2-create-subnet requires --amazonec2-vpc-id and cannot be combined with --amazonec2-subnet-id")
 		}
 
-		parts := strings.Split(u.Host, ":")
-		port, err := strconv.Atoi(parts[1])
-		if err != nil {
+		if _, _, err := net.ParseCIDR(d.CreateSubnetCidr); err != nil {
+			return fmt.Errorf("invalid --amazonec2-create-subnet CIDR block: %s", err)
+		}
+	}
+
+	if d.IamInstanceProfile != "" {
+		if err := validateInstanceProfile(d.IamInstanceProfile); err != nil {
 			return err
 		}
+	}
 
-		swarmPort = port
+	switch d.RootVolumeType {
+	case "io1", "io2":
+		if d.RootIops <= 0 {
+			return fmt.Errorf("--amazonec2-root-volume-type %s requires --amazonec2-root-iops", d.RootVolumeType)
+		}
+	case "gp3":
+		if d.RootIops < 0 {
+			return fmt.Errorf("invalid --amazonec2-root-iops %d", d.RootIops)
+		}
+	case "standard", "gp2":
+		if d.RootIops != 0 {
+			return fmt.Errorf("--amazonec2-root-iops is not supported by the %s volume type", d.RootVolumeType)
+		}
+	default:
+		return fmt.Errorf("invalid --amazonec2-root-volume-type %q, expected standard, gp2, gp3, io1 or io2", d.RootVolumeType)
 	}
 
-	return nil
-}
+	if d.RootThroughput != 0 {
+		if d.RootVolumeType != "gp3" {
+			return fmt.Errorf("--amazonec2-root-throughput is only supported by the gp3 volume type")
+		}
 
-func (d *Driver) DriverName() string {
-	return driverName
-}
+		if d.RootThroughput < 125 || d.RootThroughput > 1000 {
+			return fmt.Errorf("invalid --amazonec2-root-throughput %d, expected between 125 and 1000 MiB/s", d.RootThroughput)
+		}
+	}
 
-func (d *Driver) checkPrereqs() error {
-	// check for existing keypair
-	key, err := d.getClient().GetKeyPair(d.MachineName)
+	openPortCidrs, err := normalizeCIDRs(flags.StringSlice("amazonec2-open-port-cidr"))
 	if err != nil {
-		return err
+		return fmt.Errorf("--amazonec2-open-port-cidr: %s", err)
 	}
+	d.OpenPortCidrs = openPortCidrs
 
-	if key != nil {
-		return fmt.Errorf("There is already a keypair with the name %s.  Please either remove that keypair or use a different machine name.", d.MachineName)
+	d.OpenPorts = []string{}
+	for _, value := range flags.StringSlice("amazonec2-open-port") {
+		port, protocol, err := parseOpenPort(value)
+		if err != nil {
+			return fmt.Errorf("invalid --amazonec2-open-port %q: %s", value, err)
+		}
+		d.OpenPorts = append(d.OpenPorts, fmt.Sprintf("%d/%s", port, protocol))
 	}
 
-	regionZone := d.Region + d.Zone
-	if d.SubnetId == "" {
-		filters := []amz.Filter{
-			{
-				Name:  "availabilityZone",
-				Value: regionZone,
-			},
-			{
-				Name:  "vpc-id",
-				Value: d.VpcId,
-			},
-		}
+	if d.RootDeviceName != "" && !strings.HasPrefix(d.RootDeviceName, "/dev/") {
+		return fmt.Errorf("invalid --amazonec2-root-device-name %q, the device must be a /dev/ name", d.RootDeviceName)
+	}
 
-		subnets, err := d.getClient().GetSubnets(filters)
+	d.AdditionalVolumes = []AdditionalVolume{}
+	devices := []string{d.rootDeviceName()}
+	for _, value := range flags.StringSlice("amazonec2-additional-volume") {
+		volume, err := parseAdditionalVolume(value)
 		if err != nil {
 			return err
 		}
 
-		if len(subnets) == 0 {
-			return fmt.Errorf("unable to find a subnet in the zone: %s", regionZone)
+		if containsString(devices, volume.DeviceName) {
+			return fmt.Errorf("--amazonec2-additional-volume device %s is already in use", volume.DeviceName)
 		}
 
-		d.SubnetId = subnets[0].SubnetId
+		devices = append(devices, volume.DeviceName)
+		d.AdditionalVolumes = append(d.AdditionalVolumes, volume)
+	}
 
-		// try to find default
-		if len(subnets) > 1 {
-			for _, subnet := range subnets {
-				if subnet.DefaultForAz {
-					d.SubnetId = subnet.SubnetId
-					break
-				}
-			}
+	if d.DockerDataPath != "" {
+		if len(d.AdditionalVolumes) == 0 {
+			return fmt.Errorf("--amazonec2-docker-data-path requires an --amazonec2-additional-volume")
 		}
-	}
 
-	return nil
-}
+		if !path.IsAbs(d.DockerDataPath) {
+			return fmt.Errorf("--amazonec2-docker-data-path must be an absolute path")
+		}
 
-func (d *Driver) PreCreateCheck() error {
-	return d.checkPrereqs()
-}
+		if d.InstanceStore {
+			return fmt.Errorf("amazonec2 driver accepts only one of the --amazonec2-docker-data-path or --amazonec2-instance-store options")
+		}
+	}
 
-func (d *Driver) Create() error {
-	if err := d.checkPrereqs(); err != nil {
-		return err
+	if d.PrivateAddressOnly && d.UsePrivateAddress {
+		return fmt.Errorf("amazonec2 driver accepts only one of the --amazonec2-private-address-only or --amazonec2-use-private-address options")
 	}
 
-	log.Infof("Launching instance...")
+	if d.PrivateAddressOnly && d.UseElasticIP {
+		return fmt.Errorf("amazonec2 driver accepts only one of the --amazonec2-private-address-only or --amazonec2-use-elastic-ip options")
+	}
 
-	if err := d.createKeyPair(); err != nil {
-		return fmt.Errorf("unable to create key pair: %s", err)
+	if d.KmsKeyId != "" && !d.EncryptEbsVolume {
+		return fmt.Errorf("--amazonec2-kms-key-id requires --amazonec2-encrypt-ebs-volume")
 	}
 
-	if err := d.configureSecurityGroup(d.SecurityGroupName); err != nil {
-		return err
+	if d.Hibernate {
+		if !d.EncryptEbsVolume {
+			return fmt.Errorf("--amazonec2-hibernate requires an encrypted root volume, see --amazonec2-encrypt-ebs-volume")
+		}
+
+		if d.RequestSpotInstance {
+			return fmt.Errorf("--amazonec2-hibernate does not apply to spot instances, see --amazonec2-spot-interruption-behavior hibernate")
+		}
 	}
 
-	bdm := &amz.BlockDeviceMapping{
-		DeviceName:          "/dev/sda1",
-		VolumeSize:          d.RootSize,
-		DeleteOnTermination: true,
-		VolumeType:          "gp2",
+	if d.AssignIpv6 && d.RequestSpotInstance {
+		return fmt.Errorf("--amazonec2-assign-ipv6 is not supported with --amazonec2-request-spot-instance")
 	}
 
-	log.Debugf("launching instance in subnet %s", d.SubnetId)
-	instance, err := d.getClient().RunInstance(d.AMI, d.InstanceType, d.Zone, 1, 1, d.SecurityGroupId, d.KeyName, d.SubnetId, bdm, d.IamInstanceProfile)
+	if d.Hostname != "" {
+		if d.SkipHostname {
+			return fmt.Errorf("--amazonec2-hostname cannot be combined with --amazonec2-skip-hostname")
+		}
 
-	if err != nil {
-		return fmt.Errorf("Error launching instance: %s", err)
+		if err := validateHostname(d.Hostname); err != nil {
+			return fmt.Errorf("invalid --amazonec2-hostname %q: %s", d.Hostname, err)
+		}
 	}
 
-	d.InstanceId = instance.InstanceId
-	log.Debug("waiting for ip address to become available")
-	for {
-		ip, err := d.GetIP()
+	if d.SSHPort < 1 || d.SSHPort > 65535 {
+		return fmt.Errorf("invalid --amazonec2-ssh-port %d", d.SSHPort)
+	}
+
+	if d.DockerPort < 1 || d.DockerPort > 65535 {
+		return fmt.Errorf("invalid --amazonec2-docker-port %d", d.DockerPort)
+	}
+
+	if d.ExistingKey != (d.SSHPrivateKeyPath != "") {
+		return fmt.Errorf("--amazonec2-keypair-name and --amazonec2-ssh-keypath must be used together")
+	}
+
+	if d.ExistingKey && d.SharedKeyPairName != "" {
+		return fmt.Errorf("amazonec2 driver accepts only one of the --amazonec2-keypair-name or --amazonec2-shared-keypair-name options")
+	}
+
+	if len(d.ClientToken) > 64 {
+		return fmt.Errorf("--amazonec2-client-token must be at most 64 characters")
+	}
+
+	if d.SSHKeyFilename == "" || strings.ContainsAny(d.SSHKeyFilename, "/\\") {
+		return fmt.Errorf("invalid --amazonec2-ssh-key-filename %q, expected a file name", d.SSHKeyFilename)
+	}
+
+	images := 0
+	for _, v := range []string{d.AMI, d.AMIName, d.UbuntuRelease} {
+		if v != "" {
+			images++
+		}
+	}
+
+	if images > 1 {
+		return fmt.Errorf("amazonec2 driver accepts only one of the --amazonec2-ami, --amazonec2-ami-name or --amazonec2-ubuntu-release options")
+	}
+
+	if d.UbuntuRelease != "" && !ubuntuReleasePattern.MatchString(d.UbuntuRelease) {
+		return fmt.Errorf("invalid --amazonec2-ubuntu-release %q, expected a codename such as xenial", d.UbuntuRelease)
+	}
+
+	if d.InstallDockerMethod != "script" && d.InstallDockerMethod != "package" {
+		return fmt.Errorf("invalid --amazonec2-install-docker-method %q, expected script or package", d.InstallDockerMethod)
+	}
+
+	switch d.Tenancy {
+	case "default", "dedicated", "host":
+	default:
+		return fmt.Errorf("invalid --amazonec2-tenancy %q, expected default, dedicated or host", d.Tenancy)
+	}
+
+	if d.HostResourceGroupArn != "" {
+		if d.Tenancy == "dedicated" {
+			return fmt.Errorf("--amazonec2-host-resource-group-arn requires host tenancy, not dedicated")
+		}
+		// a host resource group always places the instance on a dedicated host
+		d.Tenancy = "host"
+	}
+
+	switch d.HostAffinity {
+	case "", "default", "host":
+	default:
+		return fmt.Errorf("invalid --amazonec2-host-affinity %q, expected default or host", d.HostAffinity)
+	}
+
+	if (d.HostId != "" || d.HostAffinity != "") && d.Tenancy != "host" {
+		return fmt.Errorf("--amazonec2-host-id and --amazonec2-host-affinity require --amazonec2-tenancy host")
+	}
+
+	if d.DryRun && d.RequestSpotInstance {
+		return fmt.Errorf("--amazonec2-dry-run cannot check spot instance requests")
+	}
+
+	if d.CreatePlacementGroup && d.PlacementGroup == "" {
+		return fmt.Errorf("--amazonec2-create-placement-group requires --amazonec2-placement-group")
+	}
+
+	switch d.PlacementStrategy {
+	case "", "cluster", "spread", "partition":
+	default:
+		return fmt.Errorf("invalid --amazonec2-placement-strategy %q, expected cluster, spread or partition", d.PlacementStrategy)
+	}
+
+	if d.PlacementStrategy != "" && d.PlacementGroup == "" {
+		return fmt.Errorf("--amazonec2-placement-strategy requires --amazonec2-placement-group")
+	}
+
+	if d.PartitionCount != 0 {
+		if d.PlacementStrategy != "partition" {
+			return fmt.Errorf("--amazonec2-partition-count requires --amazonec2-placement-strategy partition")
+		}
+
+		if d.PartitionCount < 1 || d.PartitionCount > 7 {
+			return fmt.Errorf("invalid --amazonec2-partition-count %d, expected between 1 and 7", d.PartitionCount)
+		}
+	}
+
+	if err := d.validateSpotOptions(); err != nil {
+		return err
+	}
+
+	if len(d.AMIOwners) == 0 {
+		d.AMIOwners = []string{defaultAMIOwner}
+	}
+
+	for _, owner := range d.AMIOwners {
+		if strings.TrimSpace(owner) == "" {
+			return fmt.Errorf("amazonec2 driver requires a non-empty --amazonec2-ami-owner value")
+		}
+	}
+
+	if d.isSwarmMaster() {
+		u, err := url.Parse(d.SwarmHost)
+		if err != nil {
+			return fmt.Errorf("error parsing swarm host: %s", err)
+		}
+
+		parts := strings.Split(u.Host, ":")
+		port, err := strconv.Atoi(parts[1])
 		if err != nil {
 			return err
 		}
-		if ip != "" {
-			d.IPAddress = ip
-			log.Debugf("Got the IP Address, it's %q", d.IPAddress)
-			break
+
+		swarmPort = port
+	}
+
+	return nil
+}
+
+// loadSharedCredentials reads the keys of the credential profile from the
+// shared credentials file, ~/.aws/credentials or the file named by
+// AWS_SHARED_CREDENTIALS_FILE, as the AWS CLI does. A missing file or default
+// profile leaves the keys empty, a missing profile that was asked for is an
+// error.
+func (d *Driver) loadSharedCredentials() error {
+	profile := d.CredentialProfile
+	if profile == "" {
+		profile = defaultCredentialProfile
+	}
+
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		filename = path.Join(utils.GetHomeDir(), ".aws", "credentials")
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) && profile == defaultCredentialProfile {
+			return nil
 		}
-		time.Sleep(5 * time.Second)
+		return fmt.Errorf("unable to read the credential profile %s: %s", profile, err)
 	}
 
-	if len(instance.NetworkInterfaceSet) > 0 {
-		d.PrivateIPAddress = instance.NetworkInterfaceSet[0].PrivateIpAddress
+	values, ok := parseCredentialsProfile(string(data), profile)
+	if !ok {
+		if profile == defaultCredentialProfile {
+			return nil
+		}
+		return fmt.Errorf("credential profile %s not found in %s", profile, filename)
 	}
 
-	d.waitForInstance()
+	if values["aws_access_key_id"] == "" || values["aws_secret_access_key"] == "" {
+		return fmt.Errorf("credential profile %s in %s requires aws_access_key_id and aws_secret_access_key", profile, filename)
+	}
 
-	log.Debugf("created instance ID %s, IP address %s, Private IP address %s",
-		d.InstanceId,
-		d.IPAddress,
-		d.PrivateIPAddress,
-	)
+	log.Debugf("using the credential profile %s from %s", profile, filename)
+	d.AccessKey = values["aws_access_key_id"]
+	d.SecretKey = values["aws_secret_access_key"]
+	d.SessionToken = values["aws_session_token"]
+
+	return nil
+}
+
+func (d *Driver) DriverName() string {
+	return driverName
+}
+
+// IsDryRun reports whether Create only checks the launch, see
+// --amazonec2-dry-run.
+func (d *Driver) IsDryRun() bool {
+	return d.DryRun
+}
+
+// validateNetworkInterfaceFlags rejects the options that conflict with
+// --amazonec2-network-interface-id. The subnet and security groups of the
+// instance are the ones of the interface.
+func (d *Driver) validateNetworkInterfaceFlags(flags drivers.DriverOptions) error {
+	if !strings.HasPrefix(d.NetworkInterfaceId, "eni-") {
+		return fmt.Errorf("invalid --amazonec2-network-interface-id %q, expected an eni- ID", d.NetworkInterfaceId)
+	}
+
+	if len(d.SubnetIds) != 0 || d.CreateSubnetCidr != "" {
+		return fmt.Errorf("--amazonec2-network-interface-id cannot be combined with --amazonec2-subnet-id or --amazonec2-create-subnet, the subnet of the interface is used")
+	}
+
+	if groups := splitList(flags.String("amazonec2-security-group")); len(groups) > 1 || (len(groups) == 1 && groups[0] != machineSecurityGroupName) {
+		return fmt.Errorf("--amazonec2-network-interface-id cannot be combined with --amazonec2-security-group, the security groups of the interface are used")
+	}
+
+	if d.AssignIpv6 {
+		return fmt.Errorf("--amazonec2-network-interface-id cannot be combined with --amazonec2-assign-ipv6, assign the address to the interface instead")
+	}
+
+	if d.RequestSpotInstance {
+		return fmt.Errorf("--amazonec2-network-interface-id is not supported with --amazonec2-request-spot-instance")
+	}
 
-	log.Infof("Waiting for SSH on %s:%d", d.IPAddress, 22)
+	return nil
+}
 
-	if err := ssh.WaitForTCP(fmt.Sprintf("%s:%d", d.IPAddress, 22)); err != nil {
+// loadNetworkInterface checks that the network interface can be attached
+// and takes the VPC, subnet, zone and security groups of the instance from
+// it.
+func (d *Driver) loadNetworkInterface() error {
+	interfaces, err := d.getClient().GetNetworkInterfaces([]amz.Filter{
+		{
+			Name:  "network-interface-id",
+			Value: d.NetworkInterfaceId,
+		},
+	})
+	if err != nil {
 		return err
 	}
 
-	log.Info("Configuring Machine...")
+	if len(interfaces) == 0 {
+		return fmt.Errorf("network interface %s not found in %s", d.NetworkInterfaceId, d.Region)
+	}
 
-	log.Debug("Settings tags for instance")
-	tags := map[string]string{
-		"Name": d.MachineName,
+	eni := interfaces[0]
+	if eni.Status != "available" {
+		return fmt.Errorf("network interface %s is %s, it must be available to be attached", eni.NetworkInterfaceId, eni.Status)
+	}
+
+	if d.VpcId != "" && d.VpcId != eni.VpcId {
+		return fmt.Errorf("network interface %s belongs to the VPC %s, not %s", eni.NetworkInterfaceId, eni.VpcId, d.VpcId)
+	}
+
+	d.VpcId = eni.VpcId
+	d.SubnetId = eni.SubnetId
+	d.Zone = strings.TrimPrefix(eni.AvailabilityZone, d.Region)
+	d.Zones = []string{d.Zone}
+
+	d.SecurityGroupIds = []string{}
+	for _, group := range eni.GroupSet {
+		d.SecurityGroupIds = append(d.SecurityGroupIds, group.GroupId)
 	}
 
-	if err = d.getClient().CreateTags(d.InstanceId, tags); err != nil {
+	log.Debugf("using network interface %s in subnet %s (%s)", eni.NetworkInterfaceId, d.SubnetId, eni.AvailabilityZone)
+
+	return nil
+}
+
+func (d *Driver) checkPrereqs() error {
+	if d.ExistingKey {
+		if err := d.checkExistingKeyPair(); err != nil {
+			return err
+		}
+	} else if d.SharedKeyPairName != "" {
+		if err := d.checkSharedKeyPair(); err != nil {
+			return err
+		}
+	} else if err := d.checkKeyPairAvailable(); err != nil {
 		return err
 	}
 
-	log.Debugf("Setting hostname: %s", d.MachineName)
-	cmd, err := d.GetSSHCommand(fmt.Sprintf(
-		"echo \"127.0.0.1 %s\" | sudo tee -a /etc/hosts && sudo hostname %s && echo \"%s\" | sudo tee /etc/hostname",
-		d.MachineName,
-		d.MachineName,
-		d.MachineName,
-	))
+	if err := d.resolveAMI(); err != nil {
+		return err
+	}
+
+	if d.NetworkInterfaceId != "" {
+		if err := d.loadNetworkInterface(); err != nil {
+			return err
+		}
+	}
+
+	if d.RequestSpotInstance && d.SpotInterruptionBehavior != "terminate" && d.amiRootDeviceType != "" && d.amiRootDeviceType != "ebs" {
+		return fmt.Errorf("--amazonec2-spot-interruption-behavior %s requires an EBS-backed image, %s has a %s root device", d.SpotInterruptionBehavior, d.AMI, d.amiRootDeviceType)
+	}
+
+	if err := d.validateSubnets(); err != nil {
+		return err
+	}
+
+	if err := d.validateZones(); err != nil {
+		return err
+	}
+
+	if err := d.checkInstanceStore(); err != nil {
+		return err
+	}
+
+	if err := d.checkHibernation(); err != nil {
+		return err
+	}
+
+	if d.SubnetId == "" && d.CreateSubnetCidr == "" {
+		if err := d.findSubnet(); err != nil {
+			return err
+		}
+	}
+
+	if err := d.checkInstanceTypeOffered(); err != nil {
+		return err
+	}
+
+	// the placement group is only created by Create, the prerequisites also
+	// run from PreCreateCheck
+	if err := d.checkPlacementGroup(); err != nil {
+		return err
+	}
 
+	// the subnet itself is only created by Create, the prerequisites also
+	// run from PreCreateCheck
+	if d.CreateSubnetCidr != "" && !d.SubnetCreated {
+		if err := d.checkSubnetCidr(); err != nil {
+			return err
+		}
+
+		if d.DryRun {
+			log.Infof("Would create subnet %s in %s", d.CreateSubnetCidr, d.Region+d.Zone)
+		}
+	}
+
+	return nil
+}
+
+// checkSubnetCidr makes sure the subnet to create lies within the VPC.
+func (d *Driver) checkSubnetCidr() error {
+	vpc, err := d.getClient().GetVpc(d.VpcId)
 	if err != nil {
 		return err
 	}
-	if err := cmd.Run(); err != nil {
+
+	if vpc == nil {
+		return fmt.Errorf("VPC %s not found", d.VpcId)
+	}
+
+	within, err := cidrContains(vpc.CidrBlock, d.CreateSubnetCidr)
+	if err != nil {
 		return err
 	}
 
+	if !within {
+		return fmt.Errorf("subnet CIDR block %s is not within the range %s of the VPC %s", d.CreateSubnetCidr, vpc.CidrBlock, d.VpcId)
+	}
+
 	return nil
 }
 
-func (d *Driver) GetURL() (string, error) {
-	if d.IPAddress == "" {
-		return "", nil
+// createSubnet creates and tags a subnet for the machine in the VPC and zone.
+func (d *Driver) createSubnet() error {
+	log.Infof("Creating subnet %s in %s...", d.CreateSubnetCidr, d.Region+d.Zone)
+
+	subnet, err := d.getClient().CreateSubnet(d.VpcId, d.CreateSubnetCidr, d.Region+d.Zone)
+	if err != nil {
+		return err
 	}
-	return fmt.Sprintf("tcp://%s:%d", d.IPAddress, dockerPort), nil
+
+	d.SubnetId = subnet.SubnetId
+	d.SubnetCreated = true
+
+	return d.getClient().CreateTags(d.SubnetId, map[string]string{
+		"Name": d.MachineName,
+	})
 }
 
-func (d *Driver) GetIP() (string, error) {
-	inst, err := d.getInstance()
+// validateZones makes sure every requested zone exists in the region. A zone
+// ID is resolved to the zone name of the account first.
+func (d *Driver) validateZones() error {
+	zones, err := d.getClient().GetAvailabilityZones()
+	if err != nil {
+		return err
+	}
+
+	if d.ZoneId != "" {
+		for _, z := range zones {
+			if z.ZoneId == d.ZoneId {
+				log.Debugf("zone ID %s is %s in this account", d.ZoneId, z.ZoneName)
+				d.Zone = strings.TrimPrefix(z.ZoneName, d.Region)
+				d.Zones = []string{d.Zone}
+				return nil
+			}
+		}
+
+		return fmt.Errorf("zone ID %s does not exist in the region %s", d.ZoneId, d.Region)
+	}
+
+	names := []string{}
+	for _, z := range zones {
+		names = append(names, z.ZoneName)
+	}
+
+	for _, zone := range d.zones() {
+		if !containsString(names, d.Region+zone) {
+			return fmt.Errorf("zone %s does not exist in the region %s", zone, d.Region)
+		}
+	}
+
+	return nil
+}
+
+// placement returns the placement parameters of the instance.
+func (d *Driver) placement() amz.Placement {
+	p := amz.Placement{
+		Zone:                 d.Zone,
+		HostResourceGroupArn: d.HostResourceGroupArn,
+		HostId:               d.HostId,
+		Affinity:             d.HostAffinity,
+		GroupName:            d.PlacementGroup,
+	}
+
+	if d.Tenancy != defaultTenancy {
+		p.Tenancy = d.Tenancy
+	}
+
+	return p
+}
+
+// zones returns the requested zones in order of preference.
+func (d *Driver) zones() []string {
+	if len(d.Zones) == 0 {
+		return []string{d.Zone}
+	}
+
+	return d.Zones
+}
+
+// findSubnet picks a subnet of the VPC in the first requested zone that has
+// one. When none has, any subnet of the VPC is used. The zone follows the
+// chosen subnet.
+func (d *Driver) findSubnet() error {
+	zones := d.zones()
+	regionZone := d.Region + zones[0]
+
+	var subnets []amz.Subnet
+	for _, zone := range zones {
+		found, err := d.getSubnets(d.Region + zone)
+		if err != nil {
+			return err
+		}
+
+		if len(found) > 0 {
+			subnets = found
+			break
+		}
+
+		log.Debugf("no subnet found in the zone %s", d.Region+zone)
+	}
+
+	if len(subnets) == 0 {
+		log.Debugf("looking in all zones of %s", d.VpcId)
+
+		found, err := d.getSubnets("")
+		if err != nil {
+			return err
+		}
+		subnets = found
+	}
+
+	if len(subnets) == 0 {
+		return fmt.Errorf("unable to find a subnet in the VPC: %s", d.VpcId)
+	}
+
+	subnet := subnets[0]
+
+	// try to find default
+	for _, s := range subnets {
+		if s.DefaultForAz {
+			subnet = s
+			break
+		}
+	}
+
+	d.SubnetId = subnet.SubnetId
+	d.Zone = strings.TrimPrefix(subnet.AvailabilityZone, d.Region)
+
+	if subnet.AvailabilityZone != regionZone {
+		log.Infof("No subnet found in %s, using subnet %s in %s", regionZone, subnet.SubnetId, subnet.AvailabilityZone)
+	}
+
+	return nil
+}
+
+// getSubnets returns the subnets of the VPC, limited to the zone if given.
+func (d *Driver) getSubnets(regionZone string) ([]amz.Subnet, error) {
+	filters := []amz.Filter{
+		{
+			Name:  "vpc-id",
+			Value: d.VpcId,
+		},
+	}
+
+	if regionZone != "" {
+		filters = append(filters, amz.Filter{
+			Name:  "availabilityZone",
+			Value: regionZone,
+		})
+	}
+
+	return d.getClient().GetSubnets(filters)
+}
+
+// validateSubnets makes sure every subnet given in --amazonec2-subnet-id
+// exists and belongs to the requested VPC, if any. The zone of each subnet
+// is recorded so the instance is placed in the zone of the subnet it is
+// launched in.
+func (d *Driver) validateSubnets() error {
+	if len(d.SubnetIds) == 0 {
+		return nil
+	}
+
+	filters := []amz.Filter{}
+	if d.VpcId != "" {
+		filters = append(filters, amz.Filter{
+			Name:  "vpc-id",
+			Value: d.VpcId,
+		})
+	}
+
+	subnets, err := d.getClient().GetSubnets(filters)
+	if err != nil {
+		return err
+	}
+
+	zones := map[string]string{}
+	for _, subnet := range subnets {
+		zones[subnet.SubnetId] = strings.TrimPrefix(subnet.AvailabilityZone, d.Region)
+	}
+
+	resolved := []string{}
+	for _, id := range d.SubnetIds {
+		if _, ok := zones[id]; ok {
+			resolved = append(resolved, id)
+			continue
+		}
+
+		if d.VpcId != "" {
+			return fmt.Errorf("subnet %s does not belong to the VPC %s", id, d.VpcId)
+		}
+
+		return fmt.Errorf("subnet %s not found in %s", id, d.Region)
+	}
+
+	if !containsString(resolved, d.SubnetId) {
+		d.SubnetId = pickSubnet(d.MachineName, resolved)
+	}
+
+	d.SubnetIds = resolved
+	d.subnetZones = zones
+
+	return nil
+}
+
+// checkPlacementGroup makes sure the placement group exists, or may be
+// created when --amazonec2-create-placement-group is set. An existing group
+// must use the placement strategy.
+func (d *Driver) checkPlacementGroup() error {
+	d.placementGroupMissing = false
+	if d.PlacementGroup == "" || d.PlacementGroupCreated {
+		return nil
+	}
+
+	group, err := d.getClient().GetPlacementGroup(d.PlacementGroup)
+	if err != nil {
+		return err
+	}
+
+	if group != nil {
+		if d.PlacementStrategy != "" && group.Strategy != d.PlacementStrategy {
+			return fmt.Errorf("placement group %s uses the %s strategy, not %s", group.GroupName, group.Strategy, d.PlacementStrategy)
+		}
+
+		if d.PartitionCount != 0 && group.PartitionCount != d.PartitionCount {
+			return fmt.Errorf("placement group %s has %d partitions, not %d", group.GroupName, group.PartitionCount, d.PartitionCount)
+		}
+
+		log.Debugf("using placement group %s with the %s strategy", group.GroupName, group.Strategy)
+		return nil
+	}
+
+	if !d.CreatePlacementGroup {
+		return fmt.Errorf("placement group %s not found, see --amazonec2-create-placement-group to create it", d.PlacementGroup)
+	}
+	d.placementGroupMissing = true
+
+	if d.DryRun {
+		log.Infof("Would create placement group %s with the %s strategy", d.PlacementGroup, d.placementStrategy())
+	}
+
+	return nil
+}
+
+// createPlacementGroup creates the placement group that checkPlacementGroup
+// found missing, with the placement strategy.
+func (d *Driver) createPlacementGroup() error {
+	if !d.placementGroupMissing {
+		return nil
+	}
+
+	strategy := d.placementStrategy()
+
+	log.Infof("Creating placement group %s with the %s strategy...", d.PlacementGroup, strategy)
+	if err := d.getClient().CreatePlacementGroup(d.PlacementGroup, strategy, d.PartitionCount); err != nil {
+		return err
+	}
+	d.PlacementGroupCreated = true
+	d.placementGroupMissing = false
+
+	return nil
+}
+
+func (d *Driver) placementStrategy() string {
+	if d.PlacementStrategy == "" {
+		return defaultPlacementStrategy
+	}
+
+	return d.PlacementStrategy
+}
+
+// checkInstanceTypeOffered makes sure the instance type is offered in the
+// zone of the subnet, or anywhere in the region when several subnets are
+// tried, so a mistyped instance type fails before anything is created. The
+// offerings of a location are only looked up once.
+func (d *Driver) checkInstanceTypeOffered() error {
+	if d.SkipInstanceTypeCheck {
+		return nil
+	}
+
+	locationType, location := "availability-zone", d.Region+d.Zone
+	if len(d.SubnetIds) > 1 {
+		locationType, location = "region", d.Region
+	}
+
+	if d.instanceTypeOfferings == nil {
+		d.instanceTypeOfferings = map[string][]string{}
+	}
+
+	offered, ok := d.instanceTypeOfferings[location]
+	if !ok {
+		var err error
+		offered, err = d.getClient().GetInstanceTypeOfferings(locationType, location)
+		if err != nil {
+			return err
+		}
+		d.instanceTypeOfferings[location] = offered
+	}
+
+	if !containsString(offered, d.InstanceType) {
+		return fmt.Errorf("instance type %s is not offered in %s, see --amazonec2-skip-instance-type-check to skip this check", d.InstanceType, location)
+	}
+
+	return nil
+}
+
+// checkHibernation makes sure the instance type and image support
+// hibernation when it was requested.
+func (d *Driver) checkHibernation() error {
+	if !d.Hibernate {
+		return nil
+	}
+
+	if d.amiRootDeviceType != "" && d.amiRootDeviceType != "ebs" {
+		return fmt.Errorf("--amazonec2-hibernate requires an EBS-backed image, %s has a %s root device", d.AMI, d.amiRootDeviceType)
+	}
+
+	info, err := d.getClient().GetInstanceType(d.InstanceType)
+	if err != nil {
+		return err
+	}
+
+	if info == nil || !info.HibernationSupported {
+		return fmt.Errorf("instance type %s does not support hibernation", d.InstanceType)
+	}
+
+	return nil
+}
+
+// checkInstanceStore makes sure the instance type comes with instance store
+// volumes when they were requested.
+func (d *Driver) checkInstanceStore() error {
+	if !d.InstanceStore {
+		return nil
+	}
+
+	info, err := d.getClient().GetInstanceType(d.InstanceType)
+	if err != nil {
+		return err
+	}
+
+	if info == nil || !info.InstanceStorageSupported || info.InstanceStoreDisks() == 0 {
+		return fmt.Errorf("instance type %s has no instance store volumes", d.InstanceType)
+	}
+
+	d.instanceStoreDisks = info.InstanceStoreDisks()
+
+	for i := 0; i < d.instanceStoreDisks; i++ {
+		for _, volume := range d.AdditionalVolumes {
+			if volume.DeviceName == instanceStoreDevice(i) {
+				return fmt.Errorf("--amazonec2-additional-volume device %s is used by instance store volume %d", volume.DeviceName, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveAMI looks up the newest image matching the name pattern (Ubuntu
+// by default) published by one of the trusted owners when no AMI was given
+// explicitly. Images from owners that are not in the allow-list are never
+// selected.
+func (d *Driver) resolveAMI() error {
+	if d.AMI != "" {
+		filters := []amz.Filter{
+			{
+				Name:  "image-id",
+				Value: d.AMI,
+			},
+		}
+
+		images, err := d.getClient().GetImages(nil, filters)
+		if err != nil {
+			return err
+		}
+
+		if len(images) == 0 {
+			return fmt.Errorf("image %s not found in %s", d.AMI, d.Region)
+		}
+
+		d.amiRootDeviceType = images[0].RootDeviceType
+		d.useImageRootDeviceName(&images[0])
+		return d.checkDeprecation(&images[0])
+	}
+
+	pattern := d.AMIName
+	if d.UbuntuRelease != "" {
+		pattern = fmt.Sprintf(ubuntuReleaseAMINamePattern, d.UbuntuRelease)
+	} else if pattern == "" {
+		pattern = defaultAMINamePattern
+	}
+
+	filters := []amz.Filter{
+		{
+			Name:  "name",
+			Value: pattern,
+		},
+		{
+			Name:  "state",
+			Value: "available",
+		},
+	}
+
+	// the Ubuntu patterns are amd64 images, a custom pattern may be another
+	// architecture
+	if d.AMIName == "" {
+		filters = append(filters, amz.Filter{
+			Name:  "architecture",
+			Value: defaultAMIArchitecture,
+		})
+	}
+
+	images, err := d.getClient().GetImages(d.AMIOwners, filters)
+	if err != nil {
+		return err
+	}
+
+	image := newestTrustedImage(images, d.AMIOwners)
+	if image == nil && d.AMIName != "" {
+		return fmt.Errorf("unable to find an image named %q from owners %v", d.AMIName, d.AMIOwners)
+	}
+
+	// the default images are Canonical's, they must not stand in for an
+	// owner the user restricted the images to
+	if image == nil && !d.defaultAMIOwners() {
+		return fmt.Errorf("no image found from owners %v, see --amazonec2-ami", d.AMIOwners)
+	}
+
+	if image == nil && d.UbuntuRelease != "" {
+		log.Warnf("No %s image found from owners %v, using the default image for %s", d.UbuntuRelease, d.AMIOwners, d.Region)
+	}
+
+	if image == nil {
+		details, ok := regionDetails[d.Region]
+		if !ok {
+			return fmt.Errorf("no image found from owners %v and no default image for the region %s, see --amazonec2-ami", d.AMIOwners, d.Region)
+		}
+
+		log.Debugf("no image found from owners %v, using the default for %s", d.AMIOwners, d.Region)
+		d.AMI = details.AmiId
+		return nil
+	}
+
+	log.Debugf("using image %s (%s) owned by %s", image.ImageId, image.Name, image.ImageOwnerId)
+	d.AMI = image.ImageId
+	d.amiRootDeviceType = image.RootDeviceType
+	d.useImageRootDeviceName(image)
+	return d.checkDeprecation(image)
+}
+
+// defaultAMIOwners reports whether images are only looked up from Canonical,
+// the owner of the default images.
+func (d *Driver) defaultAMIOwners() bool {
+	return len(d.AMIOwners) == 1 && d.AMIOwners[0] == defaultAMIOwner
+}
+
+// useImageRootDeviceName maps the root volume to the device the image boots
+// from, unless --amazonec2-root-device-name was given. EC2 ignores a root
+// mapping on any other device, and with it the root size and type.
+func (d *Driver) useImageRootDeviceName(image *amz.Image) {
+	if d.RootDeviceName != "" || image.RootDeviceName == "" {
+		return
+	}
+
+	log.Debugf("using root device %s of image %s", image.RootDeviceName, image.ImageId)
+	d.RootDeviceName = image.RootDeviceName
+}
+
+// rootDeviceName returns the device of the root volume. Machines created
+// before it was read from the image use /dev/sda1.
+func (d *Driver) rootDeviceName() string {
+	if d.RootDeviceName == "" {
+		return defaultRootDeviceName
+	}
+
+	return d.RootDeviceName
+}
+
+// checkDeprecation warns about a deprecated image, or fails with
+// --amazonec2-reject-deprecated-ami.
+func (d *Driver) checkDeprecation(image *amz.Image) error {
+	if image.DeprecationTime == "" {
+		return nil
+	}
+
+	deprecated, err := time.Parse(time.RFC3339, image.DeprecationTime)
+	if err != nil || deprecated.After(time.Now()) {
+		return nil
+	}
+
+	if d.RejectDeprecatedAMI {
+		return fmt.Errorf("image %s (%s) is deprecated since %s", image.ImageId, image.Name, image.DeprecationTime)
+	}
+
+	log.Warnf("Image %s (%s) is deprecated since %s and may be removed soon", image.ImageId, image.Name, image.DeprecationTime)
+	return nil
+}
+
+func (d *Driver) PreCreateCheck() error {
+	return d.checkPrereqs()
+}
+
+func (d *Driver) Create() (err error) {
+	tl := newTimeline()
+	if d.TimingSummary {
+		defer func() {
+			log.Infof("create timeline: %s", tl.summary())
+		}()
+	}
+
+	if err := d.checkPrereqs(); err != nil {
+		return err
+	}
+	tl.mark("prerequisites")
+
+	if d.DryRun {
+		return d.dryRun()
+	}
+
+	// the create timeout bounds the whole create, an interrupt stops the
+	// waits so that the failed create is cleaned up. A second interrupt
+	// kills the process as usual.
+	ctx, cancel := context.WithTimeout(context.Background(), d.createTimeout())
+	defer cancel()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+
+	go func() {
+		select {
+		case <-interrupted:
+			signal.Stop(interrupted)
+			log.Warn("Interrupted, cancelling the create...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	d.ctx = ctx
+	defer func() { d.ctx = nil }()
+
+	if !d.KeepOnCreateFailure {
+		defer func() {
+			if err != nil {
+				// the cleanup waits must not be cut short by the
+				// cancelled create
+				d.ctx = nil
+				d.cleanupFailedCreate()
+			}
+		}()
+	}
+
+	log.Infof("Launching instance...")
+
+	if d.CreateSubnetCidr != "" && !d.SubnetCreated {
+		if err := d.createSubnet(); err != nil {
+			return fmt.Errorf("unable to create subnet: %s", err)
+		}
+	}
+
+	if err := d.createPlacementGroup(); err != nil {
+		return fmt.Errorf("unable to create placement group: %s", err)
+	}
+
+	if err := d.createKeyPair(); err != nil {
+		return fmt.Errorf("unable to create key pair: %s", err)
+	}
+	tl.mark("key pair")
+	d.emitProgress(KeyPairCreated, d.KeyName)
+
+	// the security groups of an existing interface are left as they are
+	if d.NetworkInterfaceId == "" {
+		if err := d.configureSecurityGroup(d.SecurityGroupName); err != nil {
+			return err
+		}
+
+		if err := d.resolveSecurityGroups(); err != nil {
+			return err
+		}
+		tl.mark("security group")
+		d.emitProgress(SecurityGroupReady, d.SecurityGroupId)
+	}
+
+	return d.launch(tl)
+}
+
+// dryRun checks the launch without creating anything. The prerequisites
+// are resolved already, RunInstances is sent with DryRun set and EC2
+// answering DryRunOperation means the launch would have succeeded. The
+// create then succeeds, IsDryRun keeps the machine from being provisioned
+// or saved.
+func (d *Driver) dryRun() error {
+	if d.NetworkInterfaceId != "" {
+		return d.dryRunInstance(nil)
+	}
+
+	groups, err := d.getClient().GetSecurityGroups()
+	if err != nil {
+		return err
+	}
+
+	d.SecurityGroupId = ""
+	for _, group := range groups {
+		if group.GroupName == d.SecurityGroupName && group.VpcId == d.VpcId {
+			d.SecurityGroupId = group.GroupId
+			break
+		}
+	}
+
+	if d.SecurityGroupId == "" {
+		if d.SkipSecurityGroupCreation {
+			return fmt.Errorf("security group %s not found in %s and its creation is disabled by --amazonec2-skip-security-group-creation", d.SecurityGroupName, d.VpcId)
+		}
+		log.Infof("Would create security group %s in %s", d.SecurityGroupName, d.VpcId)
+	}
+
+	if err := d.resolveSecurityGroups(); err != nil {
+		return err
+	}
+
+	groupIds := []string{}
+	for _, id := range d.SecurityGroupIds {
+		if id != "" {
+			groupIds = append(groupIds, id)
+		}
+	}
+
+	return d.dryRunInstance(groupIds)
+}
+
+// dryRunInstance sends RunInstances with DryRun set.
+func (d *Driver) dryRunInstance(groupIds []string) error {
+	// a key pair that is created with the machine does not exist yet
+	keyName := ""
+	if d.ExistingKey {
+		keyName = d.KeyName
+	} else {
+		log.Infof("Would create key pair %s", d.KeyName)
+	}
+
+	// a copy, the shared client must not make every launch a dry run
+	client := *d.getClient()
+	client.DryRun = true
+
+	opts := d.runInstanceOptions(groupIds, d.blockDeviceMappings(), "")
+	opts.KeyName = keyName
+
+	_, err := client.RunInstance(opts)
+	if amz.ErrorCode(err) != amz.ErrorDryRunOperation {
+		if err == nil {
+			return fmt.Errorf("dry run launched an instance, EC2 ignored the DryRun parameter")
+		}
+		return fmt.Errorf("dry run failed: %s", err)
+	}
+
+	log.Infof("Would launch a %s instance of %s in subnet %s (%s)", d.InstanceType, d.AMI, d.SubnetId, d.Region+d.Zone)
+
+	return nil
+}
+
+// launch starts the instance with the key pair and security group already in
+// place and configures it once it is reachable over SSH.
+func (d *Driver) launch(tl *timeline) error {
+	bdms := d.blockDeviceMappings()
+
+	log.Debugf("launching instance in subnet %s", d.SubnetId)
+	var instance amz.EC2Instance
+	var err error
+	if d.RequestSpotInstance {
+		instance, err = d.requestSpotInstance(bdms)
+	} else {
+		instance, err = d.runInstance(bdms)
+	}
+
+	if err != nil {
+		if code := amz.ErrorCode(err); code == amz.ErrorInstanceLimit || code == amz.ErrorVcpuLimit {
+			return d.instanceLimitError(err)
+		}
+		return fmt.Errorf("Error launching instance: %s", err)
+	}
+	tl.mark("run instance")
+
+	d.InstanceId = instance.InstanceId
+	d.ReservationId = instance.ReservationId
+	d.emitProgress(InstanceLaunched, d.InstanceId)
+
+	if err := d.waitForIP(); err != nil {
+		return err
+	}
+	tl.mark("ip address")
+
+	if len(instance.NetworkInterfaceSet) > 0 {
+		d.PrivateIPAddress = instance.NetworkInterfaceSet[0].PrivateIpAddress
+	}
+
+	if err := d.waitForInstance(); err != nil {
+		return err
+	}
+	tl.mark("instance running")
+
+	if d.DisableSourceDestCheck {
+		if err := d.disableSourceDestCheck(); err != nil {
+			return err
+		}
+	}
+
+	if d.UseElasticIP {
+		if err := d.assignElasticIP(); err != nil {
+			return err
+		}
+		tl.mark("elastic ip")
+	}
+	d.emitProgress(IPAssigned, d.IPAddress)
+
+	d.ActualZone = ""
+	zone, err := d.GetActualZone()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("created instance ID %s in %s, IP address %s, Private IP address %s",
+		d.InstanceId,
+		zone,
+		d.IPAddress,
+		d.PrivateIPAddress,
+	)
+
+	log.Infof("Waiting for SSH on %s:%d", d.IPAddress, d.sshPort())
+
+	if err := d.waitForTCP(fmt.Sprintf("%s:%d", d.IPAddress, d.sshPort())); err != nil {
+		return err
+	}
+
+	if err := d.waitForSSH(); err != nil {
+		return err
+	}
+	tl.mark("ssh")
+	d.emitProgress(SSHReady, fmt.Sprintf("%s:%d", d.IPAddress, d.sshPort()))
+
+	if d.WaitCloudInit {
+		if err := d.waitForCloudInit(); err != nil {
+			return err
+		}
+		tl.mark("cloud-init")
+	}
+
+	log.Info("Configuring Machine...")
+
+	tags := d.machineTags()
+
+	// on-demand instances and their volumes are tagged at launch, spot
+	// requests cannot pass the tags on
+	if d.RequestSpotInstance {
+		log.Debug("Settings tags for instance")
+		if err := d.getClient().CreateTags(d.InstanceId, tags); err != nil {
+			return err
+		}
+
+		if err := d.tagVolumes(tags); err != nil {
+			return err
+		}
+	}
+
+	for _, iface := range instance.NetworkInterfaceSet {
+		log.Debugf("Setting tags for network interface %s", iface.NetworkInterfaceId)
+		if err := d.getClient().CreateTags(iface.NetworkInterfaceId, tags); err != nil {
+			return err
+		}
+	}
+
+	tl.mark("tags")
+
+	if !d.SkipHostname {
+		if err := d.setHostname(); err != nil {
+			return err
+		}
+		tl.mark("hostname")
+	}
+
+	if d.InstanceStore {
+		if err := d.mountInstanceStore(); err != nil {
+			return err
+		}
+		tl.mark("instance store")
+	}
+
+	if d.DockerDataPath != "" {
+		if err := d.mountDataVolume(); err != nil {
+			return err
+		}
+		tl.mark("data volume")
+	}
+
+	if d.InstallDocker {
+		if err := d.installDocker(); err != nil {
+			return err
+		}
+		tl.mark("install docker")
+	}
+
+	return nil
+}
+
+// blockDeviceMappings returns the root, additional and instance store
+// volumes of the instance.
+func (d *Driver) blockDeviceMappings() []amz.BlockDeviceMapping {
+	// machines created before the type was configurable use gp2
+	volumeType := d.RootVolumeType
+	if volumeType == "" {
+		volumeType = defaultRootVolumeType
+	}
+
+	bdms := []amz.BlockDeviceMapping{
+		{
+			DeviceName:          d.rootDeviceName(),
+			VolumeSize:          d.RootSize,
+			DeleteOnTermination: true,
+			VolumeType:          volumeType,
+			Iops:                d.RootIops,
+			Throughput:          d.RootThroughput,
+			Encrypted:           d.EncryptEbsVolume,
+			KmsKeyId:            d.KmsKeyId,
+		},
+	}
+
+	for _, volume := range d.AdditionalVolumes {
+		bdms = append(bdms, amz.BlockDeviceMapping{
+			DeviceName:          volume.DeviceName,
+			VolumeSize:          volume.Size,
+			DeleteOnTermination: true,
+			VolumeType:          volume.VolumeType,
+			Encrypted:           d.EncryptEbsVolume,
+			KmsKeyId:            d.KmsKeyId,
+		})
+	}
+
+	for i := 0; i < d.instanceStoreDisks; i++ {
+		bdms = append(bdms, amz.BlockDeviceMapping{
+			DeviceName:  instanceStoreDevice(i),
+			VirtualName: fmt.Sprintf("ephemeral%d", i),
+		})
+	}
+
+	return bdms
+}
+
+// runInstance launches the instance and retries transient server-side
+// errors. All attempts share one client token, so EC2 launches a single
+// instance even when a failed attempt did go through. The token is the one
+// given with --amazonec2-client-token or a generated one. When a subnet has
+// no capacity for the instance type, the next subnet given with
+// --amazonec2-subnet-id is tried, and the one the instance was launched in
+// is kept.
+func (d *Driver) runInstance(bdms []amz.BlockDeviceMapping) (amz.EC2Instance, error) {
+	token, err := d.launchToken()
+	if err != nil {
+		return amz.EC2Instance{}, err
+	}
+
+	subnets := d.subnetOrder()
+	for i, subnet := range subnets {
+		d.SubnetId = subnet
+		if zone, ok := d.subnetZones[subnet]; ok && zone != "" {
+			d.Zone = zone
+		}
+
+		// a launch that failed for lack of capacity did not start an
+		// instance, the next subnet gets its own token. It is derived from
+		// the token so a repeated create stays idempotent, and hashed so it
+		// stays within the 64 characters EC2 allows.
+		subnetToken := token
+		if i > 0 {
+			subnetToken = fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s-%d", token, i))))
+		}
+
+		instance, err := d.runInstanceInSubnet(bdms, subnetToken)
+		if err == nil || amz.ErrorCode(err) != amz.ErrorInsufficientCapacity || i == len(subnets)-1 {
+			return instance, err
+		}
+
+		log.Warnf("Insufficient capacity for %s in subnet %s, trying subnet %s...", d.InstanceType, subnet, subnets[i+1])
+	}
+
+	return amz.EC2Instance{}, fmt.Errorf("no subnet to launch the instance in")
+}
+
+// runInstanceOptions returns the launch specification of a single instance
+// of the machine in the current subnet.
+func (d *Driver) runInstanceOptions(securityGroups []string, bdms []amz.BlockDeviceMapping, clientToken string) amz.RunInstanceOptions {
+	return amz.RunInstanceOptions{
+		AmiId:               d.AMI,
+		InstanceType:        d.InstanceType,
+		Placement:           d.placement(),
+		MinCount:            1,
+		MaxCount:            1,
+		SecurityGroups:      securityGroups,
+		KeyName:             d.KeyName,
+		SubnetId:            d.SubnetId,
+		NetworkInterfaceId:  d.NetworkInterfaceId,
+		AssociatePublicIp:   !d.PrivateAddressOnly,
+		AssignIpv6:          d.AssignIpv6,
+		BlockDeviceMappings: bdms,
+		EbsOptimized:        d.EbsOptimized,
+		Hibernate:           d.Hibernate,
+		Monitoring:          d.Monitoring,
+		IamInstanceProfile:  d.IamInstanceProfile,
+		UserData:            d.UserData,
+		ClientToken:         clientToken,
+		Tags:                d.machineTags(),
+	}
+}
+
+// runInstanceInSubnet launches the instance in the current subnet, retrying
+// transient server-side errors with the same client token.
+func (d *Driver) runInstanceInSubnet(bdms []amz.BlockDeviceMapping, token string) (amz.EC2Instance, error) {
+	for attempt := 1; ; attempt++ {
+		instance, err := d.getClient().RunInstance(d.runInstanceOptions(d.securityGroupIds(), bdms, token))
+		if err == nil {
+			return instance, nil
+		}
+
+		code := amz.ErrorCode(err)
+		if attempt > d.RunInstanceRetries || (code != amz.ErrorInternalError && code != amz.ErrorUnavailable) {
+			return instance, err
+		}
+
+		log.Warnf("Launching the instance failed with %s, retrying (%d/%d)...", code, attempt, d.RunInstanceRetries)
+		if err := d.sleep("the launch retry", runInstanceRetryInterval*time.Duration(attempt)); err != nil {
+			return instance, err
+		}
+	}
+}
+
+// subnetOrder returns the subnets to try launching the instance in, starting
+// with the one picked for the machine and wrapping around the given list.
+func (d *Driver) subnetOrder() []string {
+	for i, id := range d.SubnetIds {
+		if id == d.SubnetId {
+			return append(append([]string{}, d.SubnetIds[i:]...), d.SubnetIds[:i]...)
+		}
+	}
+
+	return []string{d.SubnetId}
+}
+
+// launchToken returns the client token given with --amazonec2-client-token,
+// or a generated one.
+func (d *Driver) launchToken() (string, error) {
+	if d.ClientToken != "" {
+		return d.ClientToken, nil
+	}
+
+	return newClientToken()
+}
+
+// validateSpotOptions checks the spot options, which only apply together
+// with --amazonec2-request-spot-instance.
+func (d *Driver) validateSpotOptions() error {
+	switch d.SpotInterruptionBehavior {
+	case "terminate", "stop", "hibernate":
+	default:
+		return fmt.Errorf("invalid --amazonec2-spot-interruption-behavior %q, expected terminate, stop or hibernate", d.SpotInterruptionBehavior)
+	}
+
+	if !d.RequestSpotInstance {
+		if d.SpotPrice != "" || d.SpotInterruptionBehavior != defaultSpotInterruptionBehavior {
+			return fmt.Errorf("--amazonec2-spot-price and --amazonec2-spot-interruption-behavior require --amazonec2-request-spot-instance")
+		}
+		return nil
+	}
+
+	if d.SpotPrice != "" {
+		if price, err := strconv.ParseFloat(d.SpotPrice, 64); err != nil || price <= 0 {
+			return fmt.Errorf("invalid --amazonec2-spot-price %q, expected a price in USD such as 0.05", d.SpotPrice)
+		}
+	}
+
+	if d.Tenancy == "host" {
+		return fmt.Errorf("spot instances cannot be launched with host tenancy")
+	}
+
+	return nil
+}
+
+// requestSpotInstance requests a spot instance and waits until the request
+// is fulfilled. A request that fails, is cancelled or is not fulfilled in
+// time is reported as an error, the latter is cancelled first. Spot requests
+// are only made in the subnet picked for the machine, a lack of capacity
+// leaves them open instead of failing, so there is nothing to fall back on.
+func (d *Driver) requestSpotInstance(bdms []amz.BlockDeviceMapping) (amz.EC2Instance, error) {
+	token, err := d.launchToken()
+	if err != nil {
+		return amz.EC2Instance{}, err
+	}
+
+	log.Infof("Requesting spot instance...")
+
+	request, err := d.getClient().RequestSpotInstances(d.runInstanceOptions(d.securityGroupIds(), bdms, token), d.SpotPrice, d.SpotInterruptionBehavior)
+	if err != nil {
+		return amz.EC2Instance{}, err
+	}
+
+	d.SpotInstanceRequestId = request.SpotInstanceRequestId
+	log.Debugf("created spot instance request %s", d.SpotInstanceRequestId)
+
+	deadline := time.Now().Add(spotRequestTimeout)
+	for {
+		if request.InstanceId != "" {
+			log.Debugf("spot instance request %s fulfilled by %s", d.SpotInstanceRequestId, request.InstanceId)
+			d.InstanceId = request.InstanceId
+
+			instance, err := d.getInstance()
+			if err != nil {
+				return amz.EC2Instance{}, err
+			}
+			return *instance, nil
+		}
+
+		switch request.State {
+		case "cancelled", "failed", "closed":
+			return amz.EC2Instance{}, fmt.Errorf("spot instance request %s is %s: %s", d.SpotInstanceRequestId, request.State, spotRequestReason(request))
+		}
+
+		if time.Now().After(deadline) {
+			if err := d.cancelSpotRequest(); err != nil {
+				log.Warn(err)
+			}
+			return amz.EC2Instance{}, fmt.Errorf("spot instance request %s was not fulfilled within %s: %s", d.SpotInstanceRequestId, spotRequestTimeout, spotRequestReason(request))
+		}
+
+		log.Debugf("waiting for spot instance request %s (%s)", d.SpotInstanceRequestId, request.Status.Code)
+		if err := d.sleep("the spot instance request", spotRequestPollInterval); err != nil {
+			return amz.EC2Instance{}, err
+		}
+
+		request, err = d.getClient().GetSpotInstanceRequest(d.SpotInstanceRequestId)
+		if err != nil {
+			return amz.EC2Instance{}, err
+		}
+
+		if request == nil {
+			return amz.EC2Instance{}, fmt.Errorf("spot instance request %s not found", d.SpotInstanceRequestId)
+		}
+	}
+}
+
+// spotRequestReason describes why a spot request is not fulfilled.
+func spotRequestReason(request *amz.SpotInstanceRequest) string {
+	if request.Fault.Message != "" {
+		return request.Fault.Message
+	}
+
+	if request.Status.Message != "" {
+		return request.Status.Message
+	}
+
+	return request.Status.Code
+}
+
+// cancelSpotRequest cancels the spot request of the machine so that a
+// persistent request does not launch a replacement instance.
+func (d *Driver) cancelSpotRequest() error {
+	log.Debugf("cancelling spot instance request %s", d.SpotInstanceRequestId)
+
+	if err := d.getClient().CancelSpotInstanceRequest(d.SpotInstanceRequestId); err != nil {
+		return fmt.Errorf("unable to cancel spot instance request %s: %s", d.SpotInstanceRequestId, err)
+	}
+
+	return nil
+}
+
+// instanceLimitError explains that the account has hit its instance or vCPU
+// limit in the region, with the number of running instances if available.
+func (d *Driver) instanceLimitError(err error) error {
+	running := ""
+
+	filters := []amz.Filter{
+		{
+			Name:  "instance-state-name",
+			Value: "running",
+		},
+	}
+
+	if instances, listErr := d.getClient().GetInstances(filters); listErr == nil {
+		running = fmt.Sprintf(" (%d instances running)", len(instances))
+	}
+
+	return fmt.Errorf("Error launching instance: the account has reached its instance or vCPU limit in %s%s. "+
+		"Remove unused machines or request a higher limit in the Service Quotas console (https://console.aws.amazon.com/servicequotas/): %s",
+		d.Region, running, err)
+}
+
+// Recreate launches a new instance with the saved configuration when the
+// instance was terminated outside of docker-machine, e.g. in the console.
+// The key pair and security group of the machine are reused. The group is
+// looked up by its saved ID and created again if it was deleted too.
+func (d *Driver) Recreate() error {
+	gone, err := d.instanceGone()
+	if err != nil {
+		return err
+	}
+
+	if !gone {
+		return fmt.Errorf("instance %s still exists, remove it before recreating", d.InstanceId)
+	}
+
+	log.Infof("Instance %s is gone, launching a replacement...", d.InstanceId)
+
+	d.InstanceId = ""
+	d.IPAddress = ""
+	d.PrivateIPAddress = ""
+
+	if err := d.checkInstanceStore(); err != nil {
+		return err
+	}
+
+	if d.NetworkInterfaceId == "" {
+		if err := d.configureSecurityGroup(d.SecurityGroupName); err != nil {
+			return err
+		}
+
+		if err := d.resolveSecurityGroups(); err != nil {
+			return err
+		}
+	}
+
+	return d.launch(newTimeline())
+}
+
+// instanceGone reports whether the instance no longer exists or has been
+// terminated.
+func (d *Driver) instanceGone() (bool, error) {
+	if d.InstanceId == "" {
+		return true, nil
+	}
+
+	inst, err := d.getInstance()
+	if err != nil {
+		if amz.ErrorCode(err) == amz.ErrorInstanceNotFound {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return inst.InstanceId == "" || inst.InstanceState.Name == "terminated", nil
+}
+
+func (d *Driver) GetURL() (string, error) {
+	if d.IPAddress == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("tcp://%s:%d", d.IPAddress, d.dockerPort()), nil
+}
+
+// VerifyDockerEndpoint checks that the daemon accepts TLS connections with
+// the machine certificates on the URL returned by GetURL. A wrong security
+// group or daemon configuration is reported here instead of on the first
+// docker command.
+func (d *Driver) VerifyDockerEndpoint() error {
+	caCert, err := ioutil.ReadFile(path.Join(d.storePath, "ca.pem"))
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("unable to parse the CA certificate of %s", d.MachineName)
+	}
+
+	cert, err := tls.LoadX509KeyPair(path.Join(d.storePath, "cert.pem"), path.Join(d.storePath, "key.pem"))
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+		ServerName:   d.IPAddress,
+	}
+
+	addr := fmt.Sprintf("%s:%d", d.IPAddress, d.dockerPort())
+	log.Debugf("verifying the Docker endpoint %s", addr)
+
+	deadline := time.Now().Add(dockerEndpointTimeout)
+	for {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Docker is not reachable with TLS on %s, check the security group and the daemon configuration: %s", addr, err)
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (d *Driver) GetIP() (string, error) {
+	inst, err := d.getInstance()
+	if err != nil {
+		return "", err
+	}
+
+	if d.PrivateAddressOnly {
+		return inst.PrivateIpAddress, nil
+	}
+
+	if inst.IpAddress != "" {
+		return inst.IpAddress, nil
+	}
+
+	if d.UsePrivateAddress || !d.publicIPRequested() {
+		return inst.PrivateIpAddress, nil
+	}
+
+	return "", nil
+}
+
+// publicIPRequested reports whether the instance is launched with a public
+// IP address. An existing network interface brings its own addresses.
+func (d *Driver) publicIPRequested() bool {
+	return !d.PrivateAddressOnly && d.NetworkInterfaceId == ""
+}
+
+// GetIPv6 returns the IPv6 address of the primary network interface of the
+// instance, or an empty string if it has none.
+func (d *Driver) GetIPv6() (string, error) {
+	inst, err := d.getInstance()
+	if err != nil {
+		return "", err
+	}
+
+	for _, iface := range inst.NetworkInterfaceSet {
+		if iface.Attachment.DeviceIndex != "0" {
+			continue
+		}
+
+		for _, addr := range iface.Ipv6AddressesSet {
+			if addr.Ipv6Address != "" {
+				return addr.Ipv6Address, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// GetState reports the state of the instance. An instance that was
+// terminated or no longer exists, e.g. after Remove, has no state. Instance
+// details are not cached, every call issues a fresh DescribeInstances
+// request, so the result reflects changes made outside of docker-machine
+// right away.
+func (d *Driver) GetState() (state.State, error) {
+	inst, err := d.getInstance()
+	if err != nil {
+		if amz.ErrorCode(err) == amz.ErrorInstanceNotFound {
+			return state.None, nil
+		}
+		return state.Error, err
+	}
+
+	return instanceState(inst.InstanceState.Name), nil
+}
+
+// instanceState maps an EC2 instance state name to the machine state.
+func instanceState(name string) state.State {
+	switch name {
+	case "pending":
+		return state.Starting
+	case "running":
+		return state.Running
+	case "stopping":
+		return state.Stopping
+	case "shutting-down":
+		return state.Stopping
+	case "stopped":
+		return state.Stopped
+	case "terminated", "":
+		return state.None
+	default:
+		return state.Error
+	}
+}
+
+// GetInstanceInfo returns the identity, network configuration and state of
+// the instance from a single DescribeInstances call, so the values are
+// consistent with each other and never stale.
+func (d *Driver) GetInstanceInfo() (*InstanceInfo, error) {
+	inst, err := d.getInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &InstanceInfo{
+		InstanceId:         inst.InstanceId,
+		ReservationId:      d.ReservationId,
+		InstanceType:       inst.InstanceType,
+		AMI:                inst.ImageId,
+		State:              instanceState(inst.InstanceState.Name),
+		Region:             d.Region,
+		Zone:               inst.Placement.AvailabilityZone,
+		VpcId:              inst.VpcId,
+		SubnetId:           inst.SubnetId,
+		SecurityGroupIds:   []string{},
+		PublicIPAddress:    inst.IpAddress,
+		PrivateIPAddresses: []string{},
+		IPv6Addresses:      []string{},
+	}
+
+	if info.ReservationId == "" {
+		info.ReservationId = inst.ReservationId
+	}
+
+	for _, group := range inst.GroupSet {
+		if !containsString(info.SecurityGroupIds, group.GroupId) {
+			info.SecurityGroupIds = append(info.SecurityGroupIds, group.GroupId)
+		}
+	}
+
+	for _, iface := range inst.NetworkInterfaceSet {
+		for _, group := range iface.GroupSet {
+			if !containsString(info.SecurityGroupIds, group.GroupId) {
+				info.SecurityGroupIds = append(info.SecurityGroupIds, group.GroupId)
+			}
+		}
+
+		for _, addr := range iface.PrivateIpAddressesSet {
+			if !containsString(info.PrivateIPAddresses, addr.PrivateIpAddress) {
+				info.PrivateIPAddresses = append(info.PrivateIPAddresses, addr.PrivateIpAddress)
+			}
+		}
+
+		for _, addr := range iface.Ipv6AddressesSet {
+			info.IPv6Addresses = append(info.IPv6Addresses, addr.Ipv6Address)
+		}
+	}
+
+	// the primary private address comes first, and is the only one reported
+	// for instances without network interface details
+	if inst.PrivateIpAddress != "" && !containsString(info.PrivateIPAddresses, inst.PrivateIpAddress) {
+		info.PrivateIPAddresses = append([]string{inst.PrivateIpAddress}, info.PrivateIPAddresses...)
+	}
+
+	if inst.LaunchTime != "" {
+		launched, err := time.Parse(time.RFC3339, inst.LaunchTime)
+		if err != nil {
+			return nil, err
+		}
+		info.LaunchTime = launched
+	}
+
+	return info, nil
+}
+
+// GetActualZone returns the availability zone the instance was placed in,
+// e.g. us-east-1b. It can differ from --amazonec2-zone when the subnet was
+// given explicitly. The zone never changes, so it is looked up only once.
+func (d *Driver) GetActualZone() (string, error) {
+	if d.ActualZone != "" {
+		return d.ActualZone, nil
+	}
+
+	inst, err := d.getInstance()
+	if err != nil {
+		return "", err
+	}
+
+	d.ActualZone = inst.Placement.AvailabilityZone
+	return d.ActualZone, nil
+}
+
+// GetReservationId returns the ID of the reservation the instance was
+// launched in.
+func (d *Driver) GetReservationId() string {
+	return d.ReservationId
+}
+
+// GetLaunchTime returns the time the instance was last launched.
+func (d *Driver) GetLaunchTime() (time.Time, error) {
+	inst, err := d.getInstance()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if inst.LaunchTime == "" {
+		return time.Time{}, fmt.Errorf("no launch time reported for instance %s", d.InstanceId)
+	}
+
+	return time.Parse(time.RFC3339, inst.LaunchTime)
+}
+
+// GetUptime returns how long the instance has been running since its last
+// launch.
+func (d *Driver) GetUptime() (time.Duration, error) {
+	launched, err := d.GetLaunchTime()
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(launched), nil
+}
+
+// GetVolumeModificationState returns the state of the latest modification of
+// the volume, e.g. modifying, optimizing or completed, and its progress in
+// percent. The state is empty if the volume was never modified.
+func (d *Driver) GetVolumeModificationState(volumeId string) (string, int, error) {
+	mod, err := d.getClient().GetVolumeModification(volumeId)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if mod == nil {
+		return "", 0, nil
+	}
+
+	return mod.ModificationState, mod.Progress, nil
+}
+
+// WaitForVolumeModification waits for the latest modification of the volume
+// until its new size can be used, which is once it is optimizing, or with
+// completed set until it is completed. A volume that was never modified has
+// nothing to wait for.
+func (d *Driver) WaitForVolumeModification(volumeId string, completed bool) error {
+	return d.waitForVolumeModification(volumeId, 0, completed)
+}
+
+// waitForVolumeModification polls the latest modification of the volume like
+// WaitForVolumeModification. A targetSize is given right after ModifyVolume:
+// until a modification to that size is listed, the one just requested is
+// still pending, even when no or an older modification is reported.
+func (d *Driver) waitForVolumeModification(volumeId string, targetSize int64, completed bool) error {
+	return d.waitFor("the modification of volume "+volumeId, volumeModificationPollInterval, func() (bool, error) {
+		mod, err := d.getClient().GetVolumeModification(volumeId)
+		if err != nil {
+			return false, err
+		}
+
+		if targetSize > 0 && (mod == nil || mod.TargetSize != targetSize) {
+			log.Infof("Waiting for the modification of volume %s to be listed...", volumeId)
+			return false, nil
+		}
+
+		if mod == nil {
+			return true, nil
+		}
+
+		st, progress := mod.ModificationState, mod.Progress
+		switch st {
+		case "completed":
+			return true, nil
+		case "optimizing":
+			if !completed {
+				return true, nil
+			}
+		case "failed":
+			return false, fmt.Errorf("modification of volume %s failed", volumeId)
+		}
+
+		log.Infof("Volume %s is %s (%d%%)...", volumeId, st, progress)
+		return false, nil
+	})
+}
+
+// GetSubnetId returns the subnet of the instance. For machines the driver
+// did not create, the subnet is read from the instance on first use.
+func (d *Driver) GetSubnetId() (string, error) {
+	if d.SubnetId == "" {
+		if err := d.loadNetworkConfig(); err != nil {
+			return "", err
+		}
+	}
+
+	return d.SubnetId, nil
+}
+
+// GetSecurityGroupId returns the security group of the instance. For
+// machines the driver did not create, the first group of the primary network
+// interface is read from the instance on first use.
+func (d *Driver) GetSecurityGroupId() (string, error) {
+	if d.SecurityGroupId == "" {
+		if err := d.loadNetworkConfig(); err != nil {
+			return "", err
+		}
+	}
+
+	return d.SecurityGroupId, nil
+}
+
+// loadNetworkConfig fills the empty network fields of the driver from the
+// instance.
+func (d *Driver) loadNetworkConfig() error {
+	inst, err := d.getInstance()
+	if err != nil {
+		return err
+	}
+
+	if d.SubnetId == "" {
+		d.SubnetId = inst.SubnetId
+	}
+
+	if d.VpcId == "" {
+		d.VpcId = inst.VpcId
+	}
+
+	for _, iface := range inst.NetworkInterfaceSet {
+		if iface.Attachment.DeviceIndex != "0" || len(iface.GroupSet) == 0 {
+			continue
+		}
+
+		if d.SecurityGroupId == "" {
+			d.SecurityGroupId = iface.GroupSet[0].GroupId
+			d.SecurityGroupName = iface.GroupSet[0].GroupName
+		}
+	}
+
+	return nil
+}
+
+// GetSecurityGroupRules returns the ingress and egress permissions currently
+// set on the security group of the machine.
+func (d *Driver) GetSecurityGroupRules() (*SecurityGroupRules, error) {
+	if d.SecurityGroupId == "" {
+		return nil, fmt.Errorf("machine %s has no security group", d.MachineName)
+	}
+
+	group, err := d.getClient().GetSecurityGroupById(d.SecurityGroupId)
+	if err != nil {
+		return nil, err
+	}
+
+	if group == nil {
+		return nil, fmt.Errorf("security group %s not found", d.SecurityGroupId)
+	}
+
+	return &SecurityGroupRules{
+		Ingress: group.IpPermissions,
+		Egress:  group.IpPermissionsEgress,
+	}, nil
+}
+
+// ResizeRootVolume grows the root volume of the instance to newSizeGB and
+// then the root partition and filesystem, without restarting the instance.
+// The filesystem is grown as soon as the volume is optimizing, or with
+// waitCompleted set once the modification is completed. EBS volumes cannot
+// shrink. RootSize is updated on the driver only, the caller has to save
+// the host to keep it.
+func (d *Driver) ResizeRootVolume(newSizeGB int64, waitCompleted bool) error {
+	devices, err := d.GetBlockDeviceMappings()
+	if err != nil {
+		return err
+	}
+
+	var root *BlockDevice
+	for i := range devices {
+		if devices[i].Root {
+			root = &devices[i]
+			break
+		}
+	}
+
+	if root == nil {
+		return fmt.Errorf("no EBS root volume found for instance %s", d.InstanceId)
+	}
+
+	if newSizeGB < root.Size {
+		return fmt.Errorf("cannot shrink the root volume %s from %dGB to %dGB", root.VolumeId, root.Size, newSizeGB)
+	}
+
+	if newSizeGB == root.Size {
+		log.Infof("Root volume %s is already %dGB", root.VolumeId, newSizeGB)
+		return nil
+	}
+
+	log.Infof("Resizing root volume %s from %dGB to %dGB...", root.VolumeId, root.Size, newSizeGB)
+
+	if err := d.getClient().ModifyVolume(root.VolumeId, newSizeGB); err != nil {
+		return err
+	}
+
+	if err := d.waitForVolumeModification(root.VolumeId, newSizeGB, waitCompleted); err != nil {
+		return err
+	}
+
+	d.RootSize = newSizeGB
+
+	cmd, err := d.GetSSHCommand(growRootFilesystemCommand)
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("volume %s was resized but growing the root filesystem failed: %s", root.VolumeId, err)
+	}
+
+	return nil
+}
+
+// GetBlockDeviceMappings returns the EBS volumes currently attached to the
+// instance, including the root volume.
+func (d *Driver) GetBlockDeviceMappings() ([]BlockDevice, error) {
+	inst, err := d.getInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	volumeIds := []string{}
+	for _, m := range inst.BlockDeviceMapping {
+		if m.Ebs.VolumeId != "" {
+			volumeIds = append(volumeIds, m.Ebs.VolumeId)
+		}
+	}
+
+	if len(volumeIds) == 0 {
+		return []BlockDevice{}, nil
+	}
+
+	volumes, err := d.getClient().GetVolumes(volumeIds)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []BlockDevice{}
+	for _, m := range inst.BlockDeviceMapping {
+		if m.Ebs.VolumeId == "" {
+			continue
+		}
+
+		device := BlockDevice{
+			DeviceName: m.DeviceName,
+			VolumeId:   m.Ebs.VolumeId,
+			Root:       m.DeviceName == inst.RootDeviceName,
+		}
+
+		for _, v := range volumes {
+			if v.VolumeId == m.Ebs.VolumeId {
+				device.Size = v.Size
+				device.VolumeType = v.VolumeType
+				break
+			}
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// SetTags updates the tags of the instance. With replace set, tags that are
+// not in the given map are removed, otherwise they are merged with the
+// existing tags and values of existing keys are overwritten.
+func (d *Driver) SetTags(tags map[string]string, replace bool) error {
+	if replace {
+		inst, err := d.getInstance()
+		if err != nil {
+			return err
+		}
+
+		stale := []string{}
+		for _, tag := range inst.TagSet {
+			if _, ok := tags[tag.Key]; !ok && !strings.HasPrefix(tag.Key, "aws:") {
+				stale = append(stale, tag.Key)
+			}
+		}
+
+		if len(stale) > 0 {
+			log.Debugf("removing tags %v from %s", stale, d.InstanceId)
+			if err := d.getClient().DeleteTags(d.InstanceId, stale); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	log.Debugf("setting tags on %s: %v", d.InstanceId, tags)
+	return d.getClient().CreateTags(d.InstanceId, tags)
+}
+
+// disableSourceDestCheck lets the instance forward traffic that is neither
+// from nor to its own addresses, as NAT instances and routers do.
+func (d *Driver) disableSourceDestCheck() error {
+	log.Debugf("disabling the source/dest check of %s", d.InstanceId)
+
+	if err := d.getClient().ModifyInstanceAttribute(d.InstanceId, "SourceDestCheck", "false"); err != nil {
+		return fmt.Errorf("Error disabling the source/dest check of %s: %s", d.InstanceId, err)
+	}
+
+	return nil
+}
+
+// SetMetadataOptions changes the instance metadata service options of a
+// running instance, e.g. to require IMDSv2 tokens. A hopLimit of 0 leaves
+// the current limit unchanged.
+func (d *Driver) SetMetadataOptions(httpTokens string, hopLimit int) error {
+	if httpTokens != "" && httpTokens != "optional" && httpTokens != "required" {
+		return fmt.Errorf("invalid metadata http tokens %q: must be optional or required", httpTokens)
+	}
+
+	if hopLimit < 0 || hopLimit > 64 {
+		return fmt.Errorf("invalid metadata hop limit %d: must be between 1 and 64", hopLimit)
+	}
+
+	log.Debugf("setting metadata options on %s: tokens=%s hop limit=%d", d.InstanceId, httpTokens, hopLimit)
+
+	return d.getClient().ModifyInstanceMetadataOptions(d.InstanceId, httpTokens, hopLimit)
+}
+
+func (d *Driver) Start() error {
+	if err := d.getClient().StartInstance(d.InstanceId); err != nil {
+		return err
+	}
+
+	if err := d.waitForInstance(); err != nil {
+		return err
+	}
+
+	if d.UseElasticIP {
+		if err := d.assignElasticIP(); err != nil {
+			return err
+		}
+	}
+
+	if err := d.updateDriver(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Stop stops the instance and waits until it is stopped, so that a
+// following Start does not race against an instance that is still stopping.
+func (d *Driver) Stop() error {
+	terminated, err := d.stop()
+	if err != nil || terminated {
+		return err
+	}
+
+	return d.waitForStopped()
+}
+
+// StopNoWait stops the instance like Stop but returns as soon as EC2 has
+// accepted the request.
+func (d *Driver) StopNoWait() error {
+	_, err := d.stop()
+	return err
+}
+
+// stop requests the instance to stop and reports whether it was terminated
+// instead, see --amazonec2-stop-fallback-terminate.
+func (d *Driver) stop() (bool, error) {
+	if d.StopGracePeriod > 0 {
+		if err := d.StopDocker(); err != nil {
+			return false, err
+		}
+
+		log.Debugf("waiting %d seconds for containers to drain", d.StopGracePeriod)
+		time.Sleep(time.Duration(d.StopGracePeriod) * time.Second)
+	}
+
+	var err error
+	if d.Hibernate {
+		// a hibernated instance reports stopping and stopped like any
+		// other, Start resumes it
+		err = d.getClient().HibernateInstance(d.InstanceId)
+	} else {
+		err = d.getClient().StopInstance(d.InstanceId, false)
+	}
+
+	if err != nil && d.StopFallbackTerminate && amz.ErrorCode(err) == amz.ErrorUnsupportedOperation {
+		// instances with an instance store root device cannot be stopped
+		log.Warnf("Instance %s cannot be stopped, terminating it instead: %s", d.InstanceId, err)
+		return true, d.terminate()
+	}
+
+	return false, err
+}
+
+func (d *Driver) Remove() error {
+	if d.SpotInstanceRequestId != "" {
+		if err := d.cancelSpotRequest(); err != nil {
+			return err
+		}
+	}
+
+	if err := d.terminate(); err != nil {
+		return fmt.Errorf("unable to terminate instance: %s", err)
+	}
+
+	if d.ElasticIPAllocated {
+		if err := d.releaseElasticIP(); err != nil {
+			return err
+		}
+	}
+
+	if err := d.releaseKeyPair(); err != nil {
+		return err
+	}
+
+	if d.DeleteSecurityGroup && d.SecurityGroupId != "" {
+		if err := d.deleteSecurityGroup(); err != nil {
+			return fmt.Errorf("unable to remove security group: %s", err)
+		}
+	}
+
+	if d.DeleteSubnet && d.SubnetCreated {
+		if err := d.deleteSubnet(); err != nil {
+			return fmt.Errorf("unable to remove subnet: %s", err)
+		}
+	}
+
+	if d.PlacementGroupCreated {
+		if err := d.deletePlacementGroup(); err != nil {
+			return fmt.Errorf("unable to remove placement group: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// releaseKeyPair deletes the key pair of the machine, unless it was given
+// with --amazonec2-keypair-name or other machines still use the shared one.
+func (d *Driver) releaseKeyPair() error {
+	if d.ExistingKey {
+		log.Debugf("keeping existing key pair: %s", d.KeyName)
+		return nil
+	}
+
+	if d.SharedKeyPairName != "" {
+		inUse, err := d.sharedKeyPairInUse()
+		if err != nil {
+			return fmt.Errorf("unable to check the users of key pair %s: %s", d.KeyName, err)
+		}
+
+		if inUse {
+			log.Infof("Keeping the shared key pair %s, other machines still use it", d.KeyName)
+			return nil
+		}
+	}
+
+	if err := d.deleteKeyPair(); err != nil {
+		return fmt.Errorf("unable to remove key pair: %s", err)
+	}
+
+	return nil
+}
+
+// cleanupFailedCreate removes what a failed Create() left behind: the
+// instance and the key pair, security group and subnet created for it.
+// Failures are only logged so the original error is reported.
+func (d *Driver) cleanupFailedCreate() {
+	log.Infof("Cleaning up after the failed create, use --amazonec2-keep-on-create-failure to keep the resources...")
+
+	if d.SpotInstanceRequestId != "" {
+		if err := d.cancelSpotRequest(); err != nil {
+			log.Warn(err)
+		}
+	}
+
+	if d.InstanceId != "" {
+		if err := d.terminate(); err != nil {
+			log.Warnf("Unable to terminate instance %s: %s", d.InstanceId, err)
+		}
+	}
+
+	if d.ElasticIPAllocated {
+		if err := d.releaseElasticIP(); err != nil {
+			log.Warn(err)
+		}
+	}
+
+	if d.KeyName != "" {
+		if err := d.releaseKeyPair(); err != nil {
+			log.Warn(err)
+		}
+	}
+
+	if d.securityGroupCreated {
+		if err := d.deleteSecurityGroup(); err != nil {
+			log.Warnf("Unable to remove security group %s: %s", d.SecurityGroupId, err)
+		}
+	}
+
+	if d.SubnetCreated {
+		if err := d.deleteSubnet(); err != nil {
+			log.Warnf("Unable to remove subnet %s: %s", d.SubnetId, err)
+		}
+	}
+
+	if d.PlacementGroupCreated {
+		if err := d.deletePlacementGroup(); err != nil {
+			log.Warnf("Unable to remove placement group %s: %s", d.PlacementGroup, err)
+		}
+	}
+}
+
+// assignElasticIP associates the Elastic IP address with the instance,
+// allocating one first unless an allocation ID was given. An address that
+// is still associated with the instance is left as is.
+func (d *Driver) assignElasticIP() error {
+	if d.ElasticIPAllocationId == "" {
+		log.Infof("Allocating Elastic IP address...")
+
+		address, err := d.getClient().AllocateAddress()
+		if err != nil {
+			return err
+		}
+
+		d.ElasticIPAllocationId = address.AllocationId
+		d.ElasticIPAllocated = true
+	}
+
+	address, err := d.getClient().GetAddress(d.ElasticIPAllocationId)
+	if err != nil {
+		return err
+	}
+
+	if address == nil {
+		return fmt.Errorf("Elastic IP address %s not found", d.ElasticIPAllocationId)
+	}
+
+	if address.InstanceId != d.InstanceId {
+		log.Debugf("associating Elastic IP address %s with %s", address.PublicIp, d.InstanceId)
+
+		associationId, err := d.getClient().AssociateAddress(d.ElasticIPAllocationId, d.InstanceId)
+		if err != nil {
+			return err
+		}
+		address.AssociationId = associationId
+	}
+
+	d.ElasticIPAssociationId = address.AssociationId
+	d.ElasticIP = address.PublicIp
+	d.IPAddress = address.PublicIp
+	return nil
+}
+
+// releaseElasticIP releases the Elastic IP address the driver allocated.
+func (d *Driver) releaseElasticIP() error {
+	log.Debugf("releasing Elastic IP address %s", d.ElasticIPAllocationId)
+
+	// the address stays associated until the instance is terminated
+	if d.ElasticIPAssociationId != "" {
+		err := d.getClient().DisassociateAddress(d.ElasticIPAssociationId)
+		if err != nil && amz.ErrorCode(err) != amz.ErrorAssociationNotFound {
+			return fmt.Errorf("unable to disassociate Elastic IP address: %s", err)
+		}
+	}
+
+	if err := d.getClient().ReleaseAddress(d.ElasticIPAllocationId); err != nil {
+		return fmt.Errorf("unable to release Elastic IP address: %s", err)
+	}
+
+	return nil
+}
+
+func (d *Driver) deleteSubnet() error {
+	log.Debugf("deleting subnet %s", d.SubnetId)
+
+	return retryWhileInUse(d.SecurityGroupDeleteTimeout, func() error {
+		return d.getClient().DeleteSubnet(d.SubnetId)
+	})
+}
+
+// deletePlacementGroup deletes the placement group created for the machine
+// once no other instance is left in it. A group can only be deleted when it
+// is empty, so the terminated instance is waited for.
+func (d *Driver) deletePlacementGroup() error {
+	filters := []amz.Filter{
+		{
+			Name:  "placement-group-name",
+			Value: d.PlacementGroup,
+		},
+	}
+
+	instances, err := d.getClient().GetInstances(filters)
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range instances {
+		if inst.InstanceId == d.InstanceId {
+			continue
+		}
+
+		switch inst.InstanceState.Name {
+		case "shutting-down", "terminated":
+		default:
+			log.Infof("Keeping placement group %s, other instances still use it", d.PlacementGroup)
+			return nil
+		}
+	}
+
+	log.Debugf("deleting placement group %s", d.PlacementGroup)
+
+	return retryWhileInUse(d.SecurityGroupDeleteTimeout, func() error {
+		return d.getClient().DeletePlacementGroup(d.PlacementGroup)
+	})
+}
+
+func (d *Driver) Restart() error {
+	if err := d.getClient().RestartInstance(d.InstanceId); err != nil {
+		return fmt.Errorf("unable to restart instance: %s", err)
+	}
+	return nil
+}
+
+// RebootAndWait reboots the instance and waits, within the create timeout,
+// until sshd went down and then until the instance is running and sshd
+// answers again. EC2 reports the instance as running throughout a reboot,
+// only sshd going away shows that the reboot actually started.
+func (d *Driver) RebootAndWait() error {
+	if err := d.Restart(); err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf("%s:%d", d.IPAddress, d.sshPort())
+	if err := d.waitFor("the instance to go down", sshPollInterval, func() (bool, error) {
+		return !sshAnswers(addr), nil
+	}); err != nil {
+		return err
+	}
+
+	return d.waitFor("the instance to reboot", instancePollInterval, func() (bool, error) {
+		st, err := d.GetState()
+		if err != nil {
+			return false, err
+		}
+
+		return st == state.Running && sshAnswers(addr), nil
+	})
+}
+
+func (d *Driver) Kill() error {
+	if err := d.getClient().StopInstance(d.InstanceId, true); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *Driver) StartDocker() error {
+	log.Debug("Starting Docker...")
+
+	cmd, err := d.GetSSHCommand("sudo service docker start")
+	if err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *Driver) StopDocker() error {
+	log.Debug("Stopping Docker...")
+
+	cmd, err := d.GetSSHCommand("sudo service docker stop")
+	if err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *Driver) GetDockerConfigDir() string {
+	return dockerConfigDir
+}
+
+func (d *Driver) Upgrade() error {
+	log.Debugf("Upgrading Docker")
+
+	cmd, err := d.GetSSHCommand(upgradeDockerCommand)
+	if err != nil {
+		return err
+	}
+
+	return cmd.Run()
+}
+
+func (d *Driver) GetSSHCommand(args ...string) (*exec.Cmd, error) {
+	var options []string
+	if !d.DisableSSHMultiplexing {
+		// %C is a hash of the host, port and user, which keeps the socket
+		// path short and unique per machine
+		options = ssh.MultiplexOptions(path.Join(os.TempDir(), "docker-machine-ssh-%C"))
+	}
+
+	return ssh.GetSSHCommandWithOptions(d.IPAddress, d.sshPort(), d.sshUser(), d.sshKeyPath(), options, args...), nil
+}
+
+func (d *Driver) sshUser() string {
+	// machines created before the user was configurable use ubuntu
+	if d.SSHUser == "" {
+		return defaultSSHUser
+	}
+
+	return d.SSHUser
+}
+
+func (d *Driver) sshPort() int {
+	// machines created before the port was configurable use 22
+	if d.SSHPort == 0 {
+		return defaultSSHPort
+	}
+
+	return d.SSHPort
+}
+
+func (d *Driver) dockerPort() int {
+	// machines created before the port was configurable use 2376
+	if d.DockerPort == 0 {
+		return defaultDockerPort
+	}
+
+	return d.DockerPort
+}
+
+// GetSSHKeyPath returns the path of the PEM encoded private key used to
+// SSH into the instance, e.g. for converting it to PuTTY's format.
+func (d *Driver) GetSSHKeyPath() string {
+	return d.sshKeyPath()
+}
+
+// clientConfig is the configuration the EC2 client is built from, next to
+// the transport. The client is rebuilt when it changes.
+type clientConfig struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+	partition    string
+	endpoint     string
+}
+
+// getClient returns the EC2 client of the driver. It is built once and
+// shared by all calls, including concurrent ones, until the region,
+// credentials, endpoint or transport change or the instance role
+// credentials it was built with are due to be refreshed.
+func (d *Driver) getClient() *amz.EC2 {
+	config := clientConfig{
+		accessKey:    d.AccessKey,
+		secretKey:    d.SecretKey,
+		sessionToken: d.SessionToken,
+		region:       d.Region,
+		partition:    d.Partition,
+		endpoint:     d.Endpoint,
+	}
+
+	d.clientMu.Lock()
+	defer d.clientMu.Unlock()
+
+	if d.client != nil && d.clientConfig == config && sameTransport(d.clientTransport, d.transport) &&
+		(d.clientRefresh.IsZero() || time.Now().Before(d.clientRefresh)) {
+		return d.client
+	}
+
+	auth, refresh := amz.GetAuthWithRefresh(config.accessKey, config.secretKey, config.sessionToken)
+	client := amz.NewEC2(auth, config.region, config.partition)
+	if config.endpoint != "" {
+		client.Endpoint = config.endpoint
+	}
+	client.Transport = d.transport
+
+	d.client = client
+	d.clientConfig = config
+	d.clientTransport = d.transport
+	d.clientRefresh = refresh
+
+	return client
+}
+
+func (d *Driver) sshKeyPath() string {
+	// machines created before the file name was configurable use id_rsa
+	if d.SSHKeyFilename == "" {
+		return path.Join(d.storePath, defaultSSHKeyFilename)
+	}
+
+	return path.Join(d.storePath, d.SSHKeyFilename)
+}
+
+func (d *Driver) updateDriver() error {
+	// the Elastic IP address does not change, unlike the ephemeral one
+	if d.ElasticIP != "" {
+		d.IPAddress = d.ElasticIP
+		return nil
+	}
+
+	return d.waitFor("the IP address", instancePollInterval, func() (bool, error) {
+		inst, err := d.getInstance()
+		if err != nil {
+			return false, err
+		}
+
+		ip := inst.IpAddress
+		if d.PrivateAddressOnly {
+			ip = inst.PrivateIpAddress
+		}
+
+		if ip == "" {
+			return false, nil
+		}
+
+		d.InstanceId = inst.InstanceId
+		d.IPAddress = ip
+		return true, nil
+	})
+}
+
+func (d *Driver) publicSSHKeyPath() string {
+	return d.sshKeyPath() + ".pub"
+}
+
+func (d *Driver) getInstance() (*amz.EC2Instance, error) {
+	for attempt := 0; ; attempt++ {
+		instance, err := d.getClient().GetInstance(d.InstanceId)
+		if err != nil {
+			return nil, err
+		}
+
+		if instance.InstanceId != "" || attempt == instanceLookupRetries {
+			return &instance, nil
+		}
+
+		log.Debugf("instance %s missing from DescribeInstances, retrying", d.InstanceId)
+		time.Sleep(instanceLookupBackoff * time.Duration(attempt+1))
+	}
+}
+
+func (d *Driver) waitForInstance() error {
+	return d.waitFor("the instance to run", instancePollInterval, func() (bool, error) {
+		st, err := d.GetState()
+		if err != nil {
+			return false, err
+		}
+
+		return st == state.Running, nil
+	})
+}
+
+// waitForStopped waits until the instance is stopped, within the create
+// timeout.
+func (d *Driver) waitForStopped() error {
+	return d.waitFor("the instance to stop", instancePollInterval, func() (bool, error) {
+		st, err := d.GetState()
+		if err != nil {
+			return false, err
+		}
+
+		return st == state.Stopped, nil
+	})
+}
+
+// waitFor calls check every interval until it reports done, fails, the
+// create timeout elapses or the create is cancelled. During a create the
+// timeout bounds the whole create, otherwise each wait.
+func (d *Driver) waitFor(what string, interval time.Duration, check func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(d.context(), d.createTimeout())
+	defer cancel()
+
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return d.waitError(ctx.Err(), what)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// sleep waits for interval like time.Sleep, but returns early with an error
+// when the create times out or is cancelled.
+func (d *Driver) sleep(what string, interval time.Duration) error {
+	ctx := d.context()
+
+	select {
+	case <-ctx.Done():
+		return d.waitError(ctx.Err(), what)
+	case <-time.After(interval):
+		return nil
+	}
+}
+
+func (d *Driver) waitError(err error, what string) error {
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s waiting for %s of %s", d.createTimeout(), what, d.InstanceId)
+	}
+
+	return fmt.Errorf("cancelled while waiting for %s of %s", what, d.InstanceId)
+}
+
+// runCommand runs cmd and kills it when the create times out or is
+// cancelled, a hanging SSH session would block the create otherwise.
+func (d *Driver) runCommand(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	ctx := d.context()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		return d.waitError(ctx.Err(), "the command")
+	}
+}
+
+// waitForTCP waits until addr accepts a connection and sends data, like
+// ssh.WaitForTCP, but gives up when the create times out or is cancelled.
+func (d *Driver) waitForTCP(addr string) error {
+	return d.waitFor(addr, sshPollInterval, func() (bool, error) {
+		conn, err := net.DialTimeout("tcp", addr, sshPollInterval)
+		if err != nil {
+			return false, nil
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(sshPollInterval))
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			return false, nil
+		}
+
+		return true, nil
+	})
+}
+
+func (d *Driver) createTimeout() time.Duration {
+	// machines created before the timeout was configurable use the default
+	if d.CreateTimeout <= 0 {
+		return defaultCreateTimeout * time.Second
+	}
+
+	return time.Duration(d.CreateTimeout) * time.Second
+}
+
+// context returns the context of the running create, which is cancelled on
+// an interrupt.
+func (d *Driver) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+
+	return d.ctx
+}
+
+// waitForIP polls for the public IP of the new instance. An instance that
+// was not asked for a public IP, or with --amazonec2-use-private-address,
+// falls back to its private IP after PublicIPAttempts polls. Otherwise the
+// missing public IP is an error.
+func (d *Driver) waitForIP() error {
+	log.Debug("waiting for ip address to become available")
+
+	attempt := 0
+	return d.waitFor("an IP address", ipAddressPollInterval, func() (bool, error) {
+		attempt++
+
+		inst, err := d.getInstance()
+		if err != nil {
+			return false, err
+		}
+
+		if d.PrivateAddressOnly {
+			if inst.PrivateIpAddress == "" {
+				return false, nil
+			}
+
+			d.IPAddress = inst.PrivateIpAddress
+			log.Debugf("Got the private IP Address, it's %q", d.IPAddress)
+			return true, nil
+		}
+
+		if inst.IpAddress != "" {
+			d.IPAddress = inst.IpAddress
+			log.Debugf("Got the IP Address, it's %q", d.IPAddress)
+			return true, nil
+		}
+
+		if d.PublicIPAttempts == 0 || attempt < d.PublicIPAttempts || inst.PrivateIpAddress == "" {
+			return false, nil
+		}
+
+		if d.publicIPRequested() && !d.UsePrivateAddress {
+			return false, fmt.Errorf("no public IP address was assigned to %s after %d attempts, see --amazonec2-use-private-address to use the private one", d.InstanceId, attempt)
+		}
+
+		log.Warnf("no public IP address was assigned to %s after %d attempts, using the private IP address %s",
+			d.InstanceId,
+			attempt,
+			inst.PrivateIpAddress,
+		)
+		d.IPAddress = inst.PrivateIpAddress
+		return true, nil
+	})
+}
+
+// waitForSSH retries a trivial command until sshd accepts our key. A
+// listening port does not mean sshd is ready to authenticate yet.
+func (d *Driver) waitForSSH() error {
+	log.Debugf("waiting for SSH authentication on %s", d.IPAddress)
+
+	deadline := time.Now().Add(time.Duration(d.SSHTimeout) * time.Second)
+	for {
+		cmd, err := d.GetSSHCommand("true")
+		if err != nil {
+			return err
+		}
+
+		err = d.runCommand(cmd)
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %d seconds waiting for SSH on %s: %s", d.SSHTimeout, d.IPAddress, err)
+		}
+
+		log.Debugf("SSH not ready yet: %s", err)
+		if err := d.sleep("SSH", sshPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// machineTags returns the tags of the resources of the machine: the user
+// tags and the machine name.
+func (d *Driver) machineTags() map[string]string {
+	tags := map[string]string{}
+	for k, v := range d.Tags {
+		tags[k] = v
+	}
+	tags["Name"] = d.MachineName
+	return tags
+}
+
+// tagVolumes tags the root and additional EBS volumes of a spot instance.
+// The volumes are only known once the instance runs.
+func (d *Driver) tagVolumes(tags map[string]string) error {
+	inst, err := d.getInstance()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range inst.BlockDeviceMapping {
+		if m.Ebs.VolumeId == "" {
+			continue
+		}
+
+		log.Debugf("Setting tags for volume %s (%s)", m.Ebs.VolumeId, m.DeviceName)
+		if err := d.getClient().CreateTags(m.Ebs.VolumeId, tags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setHostname sets the hostname of the instance, --amazonec2-hostname or
+// the machine name, and makes it resolve locally. A fully qualified name
+// resolves by its short name too.
+func (d *Driver) setHostname() error {
+	hostname := d.Hostname
+	if hostname == "" {
+		hostname = d.MachineName
+	}
+
+	names := hostname
+	if short := strings.SplitN(hostname, ".", 2)[0]; short != hostname {
+		names += " " + short
+	}
+
+	log.Debugf("Setting hostname: %s", hostname)
+	cmd, err := d.GetSSHCommand(fmt.Sprintf(
+		"echo \"127.0.0.1 %s\" | sudo tee -a /etc/hosts && sudo hostname %s && echo \"%s\" | sudo tee /etc/hostname",
+		names,
+		hostname,
+		hostname,
+	))
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return inst.IpAddress, nil
+	return cmd.Run()
 }
 
-func (d *Driver) GetState() (state.State, error) {
-	inst, err := d.getInstance()
+// mountInstanceStore formats the first instance store volume and mounts it
+// where Docker keeps its data. NVMe instance store volumes show up under
+// their own name, older instance types expose the mapped xvdb device.
+func (d *Driver) mountInstanceStore() error {
+	log.Debugf("mounting instance store volume at %s", dockerDataDir)
+
+	cmd, err := d.GetSSHCommand(fmt.Sprintf(
+		"dev=$(ls /dev/disk/by-id/nvme-Amazon_EC2_NVMe_Instance_Storage_* 2>/dev/null | head -n 1); "+
+			"[ -z \"$dev\" ] && dev=/dev/xvdb; "+
+			"sudo umount $dev 2>/dev/null; "+
+			"sudo mkfs.ext4 -F $dev && sudo mkdir -p %s && sudo mount $dev %s && "+
+			"echo \"$dev %s ext4 defaults,nofail 0 2\" | sudo tee -a /etc/fstab",
+		dockerDataDir,
+		dockerDataDir,
+		dockerDataDir,
+	))
 	if err != nil {
-		return state.Error, err
-	}
-	switch inst.InstanceState.Name {
-	case "pending":
-		return state.Starting, nil
-	case "running":
-		return state.Running, nil
-	case "stopping":
-		return state.Stopping, nil
-	case "shutting-down":
-		return state.Stopping, nil
-	case "stopped":
-		return state.Stopped, nil
-	default:
-		return state.Error, nil
+		return err
 	}
-	return state.None, nil
+
+	return cmd.Run()
 }
 
-func (d *Driver) Start() error {
-	if err := d.getClient().StartInstance(d.InstanceId); err != nil {
+// mountDataVolume formats the first additional volume, unless it already
+// has a file system, and mounts it at the Docker data path. Nitro instances
+// expose EBS volumes as NVMe devices named after the volume ID.
+func (d *Driver) mountDataVolume() error {
+	volume := d.AdditionalVolumes[0]
+
+	devices, err := d.GetBlockDeviceMappings()
+	if err != nil {
 		return err
 	}
 
-	if err := d.waitForInstance(); err != nil {
-		return err
+	volumeId := ""
+	for _, device := range devices {
+		if device.DeviceName == volume.DeviceName {
+			volumeId = device.VolumeId
+		}
 	}
 
-	if err := d.updateDriver(); err != nil {
-		return err
+	if volumeId == "" {
+		return fmt.Errorf("volume %s is not attached to instance %s", volume.DeviceName, d.InstanceId)
 	}
-	return nil
-}
 
-func (d *Driver) Stop() error {
-	if err := d.getClient().StopInstance(d.InstanceId, false); err != nil {
+	log.Debugf("mounting volume %s (%s) at %s", volumeId, volume.DeviceName, d.DockerDataPath)
+
+	cmd, err := d.GetSSHCommand(fmt.Sprintf(
+		"dev=/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_%s; "+
+			"[ -e $dev ] || dev=%s; "+
+			"[ -e $dev ] || dev=%s; "+
+			"sudo blkid $dev >/dev/null || sudo mkfs.ext4 $dev; "+
+			"sudo mkdir -p %s && sudo mount $dev %s && "+
+			"echo \"$dev %s ext4 defaults,nofail 0 2\" | sudo tee -a /etc/fstab",
+		strings.Replace(volumeId, "-", "", 1),
+		strings.Replace(volume.DeviceName, "/dev/sd", "/dev/xvd", 1),
+		volume.DeviceName,
+		d.DockerDataPath,
+		d.DockerDataPath,
+		d.DockerDataPath,
+	))
+	if err != nil {
 		return err
 	}
-	return nil
+
+	return cmd.Run()
 }
 
-func (d *Driver) Remove() error {
+// waitForCloudInit blocks until cloud-init has finished, so that late
+// cloud-init modules don't overwrite the configuration made by the driver.
+func (d *Driver) waitForCloudInit() error {
+	log.Infof("Waiting for cloud-init to finish...")
 
-	if err := d.terminate(); err != nil {
-		return fmt.Errorf("unable to terminate instance: %s", err)
+	cmd, err := d.GetSSHCommand(fmt.Sprintf("timeout %d cloud-init status --wait", d.CloudInitTimeout))
+	if err != nil {
+		return err
 	}
 
-	// remove keypair
-	if err := d.deleteKeyPair(); err != nil {
-		return fmt.Errorf("unable to remove key pair: %s", err)
+	if err := d.runCommand(cmd); err != nil {
+		return fmt.Errorf("cloud-init did not finish successfully within %d seconds: %s", d.CloudInitTimeout, err)
 	}
 
 	return nil
 }
 
-func (d *Driver) Restart() error {
-	if err := d.getClient().RestartInstance(d.InstanceId); err != nil {
-		return fmt.Errorf("unable to restart instance: %s", err)
-	}
-	return nil
-}
+// installDocker installs Docker over SSH unless the docker binary is already
+// present on the instance.
+func (d *Driver) installDocker() error {
+	log.Infof("Installing Docker (%s)...", d.InstallDockerMethod)
 
-func (d *Driver) Kill() error {
-	if err := d.getClient().StopInstance(d.InstanceId, true); err != nil {
+	cmd, err := d.GetSSHCommand(fmt.Sprintf(
+		"command -v docker >/dev/null 2>&1 || { %s; }",
+		installDockerCommand(d.InstallDockerMethod, d.DockerVersion),
+	))
+	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (d *Driver) StartDocker() error {
-	log.Debug("Starting Docker...")
+	return d.runCommand(cmd)
+}
 
-	cmd, err := d.GetSSHCommand("sudo service docker start")
+// checkKeyPairAvailable makes sure there is no key pair named after the
+// machine yet.
+func (d *Driver) checkKeyPairAvailable() error {
+	key, err := d.getClient().GetKeyPair(d.MachineName)
 	if err != nil {
 		return err
 	}
-	if err := cmd.Run(); err != nil {
-		return err
+
+	if key != nil {
+		return fmt.Errorf("There is already a keypair with the name %s.  Please either remove that keypair or use a different machine name.", d.MachineName)
 	}
 
 	return nil
 }
 
-func (d *Driver) StopDocker() error {
-	log.Debug("Stopping Docker...")
-
-	cmd, err := d.GetSSHCommand("sudo service docker stop")
+// checkExistingKeyPair makes sure the key pair given with
+// --amazonec2-keypair-name exists and its private key is readable.
+func (d *Driver) checkExistingKeyPair() error {
+	key, err := d.getClient().GetKeyPair(d.KeyName)
 	if err != nil {
 		return err
 	}
-	if err := cmd.Run(); err != nil {
-		return err
+
+	if key == nil {
+		return fmt.Errorf("key pair %s does not exist in %s", d.KeyName, d.Region)
+	}
+
+	if _, err := os.Stat(d.SSHPrivateKeyPath); err != nil {
+		return fmt.Errorf("unable to read the private key of key pair %s: %s", d.KeyName, err)
 	}
 
 	return nil
 }
 
-func (d *Driver) GetDockerConfigDir() string {
-	return dockerConfigDir
+// sharedKeyPath returns where the private key of the shared key pair is
+// kept for all machines.
+func (d *Driver) sharedKeyPath() string {
+	return path.Join(utils.GetMachineRoot(), "keys", d.SharedKeyPairName)
 }
 
-func (d *Driver) Upgrade() error {
-	log.Debugf("Upgrading Docker")
-
-	cmd, err := d.GetSSHCommand("sudo apt-get update && sudo apt-get install --upgrade lxc-docker")
+// checkSharedKeyPair makes sure an existing shared key pair can be used,
+// which needs its private key.
+func (d *Driver) checkSharedKeyPair() error {
+	key, err := d.getClient().GetKeyPair(d.SharedKeyPairName)
 	if err != nil {
 		return err
-
 	}
-	if err := cmd.Run(); err != nil {
-		return err
 
+	if key == nil {
+		return nil
 	}
 
-	return cmd.Run()
-}
-
-func (d *Driver) GetSSHCommand(args ...string) (*exec.Cmd, error) {
-	return ssh.GetSSHCommand(d.IPAddress, 22, "ubuntu", d.sshKeyPath(), args...), nil
-}
+	if _, err := os.Stat(d.sharedKeyPath()); err != nil {
+		return fmt.Errorf("the shared key pair %s exists but its private key is not at %s", d.SharedKeyPairName, d.sharedKeyPath())
+	}
 
-func (d *Driver) getClient() *amz.EC2 {
-	auth := amz.GetAuth(d.AccessKey, d.SecretKey, d.SessionToken)
-	return amz.NewEC2(auth, d.Region)
+	return nil
 }
 
-func (d *Driver) sshKeyPath() string {
-	return path.Join(d.storePath, "id_rsa")
-}
+// useSharedKeyPair imports the shared key pair on first use and copies its
+// keys into the machine directory.
+func (d *Driver) useSharedKeyPair() error {
+	keyPath := d.sharedKeyPath()
 
-func (d *Driver) updateDriver() error {
-	inst, err := d.getInstance()
+	key, err := d.getClient().GetKeyPair(d.SharedKeyPairName)
 	if err != nil {
 		return err
 	}
-	// wait for ipaddress
-	for {
-		i, err := d.getInstance()
+
+	if key == nil {
+		if err := os.MkdirAll(path.Dir(keyPath), 0700); err != nil {
+			return err
+		}
+
+		if err := ssh.GenerateSSHKey(keyPath); err != nil {
+			return err
+		}
+
+		publicKey, err := ioutil.ReadFile(keyPath + ".pub")
 		if err != nil {
 			return err
 		}
-		if i.IpAddress == "" {
-			time.Sleep(1 * time.Second)
-			continue
+
+		log.Debugf("creating shared key pair: %s", d.SharedKeyPairName)
+
+		// another machine may have imported it in the meantime
+		err = d.getClient().ImportKeyPair(d.SharedKeyPairName, string(publicKey))
+		if err != nil && amz.ErrorCode(err) != amz.ErrorDuplicateKeyPair {
+			return err
 		}
+	}
 
-		d.InstanceId = inst.InstanceId
-		d.IPAddress = inst.IpAddress
-		break
+	if err := utils.CopyFile(keyPath, d.sshKeyPath()); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(d.sshKeyPath(), 0600); err != nil {
+		return err
+	}
+
+	if err := utils.CopyFile(keyPath+".pub", d.publicSSHKeyPath()); err != nil {
+		return err
 	}
+
+	d.KeyName = d.SharedKeyPairName
 	return nil
 }
 
-func (d *Driver) publicSSHKeyPath() string {
-	return d.sshKeyPath() + ".pub"
-}
+// sharedKeyPairInUse reports whether instances other than this machine's
+// still use the shared key pair.
+func (d *Driver) sharedKeyPairInUse() (bool, error) {
+	filters := []amz.Filter{
+		{
+			Name:  "key-name",
+			Value: d.KeyName,
+		},
+	}
 
-func (d *Driver) getInstance() (*amz.EC2Instance, error) {
-	instance, err := d.getClient().GetInstance(d.InstanceId)
+	instances, err := d.getClient().GetInstances(filters)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return &instance, nil
-}
-
-func (d *Driver) waitForInstance() error {
-	for {
-		st, err := d.GetState()
-		if err != nil {
-			return err
+	for _, inst := range instances {
+		if inst.InstanceId == d.InstanceId {
+			continue
 		}
-		if st == state.Running {
-			break
+
+		switch inst.InstanceState.Name {
+		case "shutting-down", "terminated":
+		default:
+			return true, nil
 		}
-		time.Sleep(1 * time.Second)
 	}
 
-	return nil
+	return false, nil
 }
 
 func (d *Driver) createKeyPair() error {
+	if d.ExistingKey {
+		log.Debugf("using existing key pair: %s", d.KeyName)
+
+		if err := utils.CopyFile(d.SSHPrivateKeyPath, d.sshKeyPath()); err != nil {
+			return err
+		}
+
+		return os.Chmod(d.sshKeyPath(), 0600)
+	}
+
+	if d.SharedKeyPairName != "" {
+		return d.useSharedKeyPair()
+	}
 
 	if err := ssh.GenerateSSHKey(d.sshKeyPath()); err != nil {
 		return err
@@ -613,19 +4169,15 @@ func (d *Driver) isSwarmMaster() bool {
 func (d *Driver) configureSecurityGroup(groupName string) error {
 	log.Debugf("configuring security group in %s", d.VpcId)
 
-	var securityGroup *amz.SecurityGroup
+	created := false
 
-	groups, err := d.getClient().GetSecurityGroups()
+	securityGroup, err := d.findSecurityGroup(groupName)
 	if err != nil {
 		return err
 	}
 
-	for _, grp := range groups {
-		if grp.GroupName == groupName {
-			log.Debugf("found existing security group (%s) in %s", groupName, d.VpcId)
-			securityGroup = &grp
-			break
-		}
+	if securityGroup == nil && d.SkipSecurityGroupCreation {
+		return fmt.Errorf("security group %s not found in %s and its creation is disabled by --amazonec2-skip-security-group-creation", groupName, d.VpcId)
 	}
 
 	// if not found, create
@@ -636,22 +4188,46 @@ func (d *Driver) configureSecurityGroup(groupName string) error {
 			return err
 		}
 		securityGroup = group
+		created = true
+		d.securityGroupCreated = true
 		// wait until created (dat eventual consistency)
 		log.Debugf("waiting for group (%s) to become available", group.GroupId)
 		for {
-			_, err := d.getClient().GetSecurityGroupById(group.GroupId)
-			if err == nil {
+			found, err := d.getClient().GetSecurityGroupById(group.GroupId)
+			if err == nil && found != nil {
 				break
 			}
-			log.Debug(err)
+			if err != nil {
+				log.Debug(err)
+			}
 			time.Sleep(1 * time.Second)
 		}
+
+		// tag the group before the launch that uses it, groups the machine
+		// did not create may be shared with other machines
+		log.Debugf("Setting tags for security group %s", group.GroupId)
+		if err := d.getClient().CreateTags(group.GroupId, d.machineTags()); err != nil {
+			return err
+		}
 	}
 
 	d.SecurityGroupId = securityGroup.GroupId
 
 	perms := d.configureSecurityGroupPermissions(securityGroup)
 
+	// only reconcile groups we own or were explicitly told to manage, shared
+	// groups may carry rules other machines depend on
+	if created || d.ReconcileSecurityGroup {
+		revoke, authorize := d.reconcileSecurityGroupPermissions(securityGroup)
+		if len(revoke) != 0 {
+			log.Debugf("revoking permissions from group %s: %v", securityGroup.GroupName, revoke)
+			if err := d.getClient().RevokeSecurityGroup(d.SecurityGroupId, revoke); err != nil {
+				return err
+			}
+		}
+		perms = authorize
+	}
+
 	if len(perms) != 0 {
 		log.Debugf("authorizing group %s with permissions: %v", securityGroup.GroupName, perms)
 		if err := d.getClient().AuthorizeSecurityGroup(d.SecurityGroupId, perms); err != nil {
@@ -663,63 +4239,241 @@ func (d *Driver) configureSecurityGroup(groupName string) error {
 	return nil
 }
 
+// findSecurityGroup returns the security group named groupName, or nil if
+// it does not exist. The ID saved with the machine is checked first, so the
+// groups of the account are only listed when it is unset or stale.
+func (d *Driver) findSecurityGroup(groupName string) (*amz.SecurityGroup, error) {
+	if d.SecurityGroupId != "" {
+		group, err := d.getClient().GetSecurityGroupById(d.SecurityGroupId)
+		if err != nil {
+			return nil, err
+		}
+
+		if group != nil && group.GroupName == groupName {
+			log.Debugf("found security group %s (%s)", groupName, group.GroupId)
+			return group, nil
+		}
+
+		log.Debugf("security group %s no longer exists as %s, looking it up by name", d.SecurityGroupId, groupName)
+	}
+
+	groups, err := d.getClient().GetSecurityGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range groups {
+		if groups[i].GroupName == groupName {
+			log.Debugf("found existing security group (%s) in %s", groupName, d.VpcId)
+			return &groups[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// resolveSecurityGroups looks up the IDs of the security groups attached in
+// addition to the one docker-machine manages. They must already exist in
+// the VPC.
+func (d *Driver) resolveSecurityGroups() error {
+	d.SecurityGroupIds = []string{d.SecurityGroupId}
+
+	if len(d.SecurityGroupNames) < 2 {
+		return nil
+	}
+
+	groups, err := d.getClient().GetSecurityGroups()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range d.SecurityGroupNames[1:] {
+		groupId := ""
+		for _, group := range groups {
+			if group.GroupName == name && group.VpcId == d.VpcId {
+				groupId = group.GroupId
+				break
+			}
+		}
+
+		if groupId == "" {
+			return fmt.Errorf("security group %s does not exist in %s, only the first --amazonec2-security-group is created", name, d.VpcId)
+		}
+
+		log.Debugf("attaching security group %s (%s)", name, groupId)
+		d.SecurityGroupIds = append(d.SecurityGroupIds, groupId)
+	}
+
+	return nil
+}
+
+// securityGroupIds returns the security groups of the instance. Machines
+// created before several groups were supported only have the managed one.
+func (d *Driver) securityGroupIds() []string {
+	if len(d.SecurityGroupIds) == 0 {
+		return []string{d.SecurityGroupId}
+	}
+
+	return d.SecurityGroupIds
+}
+
 func (d *Driver) configureSecurityGroupPermissions(group *amz.SecurityGroup) []amz.IpPermission {
-	hasSshPort := false
-	hasDockerPort := false
-	hasSwarmPort := false
+	ports := []string{
+		fmt.Sprintf("%d/tcp", d.sshPort()),
+		fmt.Sprintf("%d/tcp", d.dockerPort()),
+	}
+
+	if d.SwarmMaster {
+		ports = append(ports, fmt.Sprintf("%d/tcp", swarmPort))
+	}
+
+	ports = append(ports, d.OpenPorts...)
+
+	// ports the group already opens are skipped, whatever they are open to
+	opened := map[string]bool{}
 	for _, p := range group.IpPermissions {
-		switch p.FromPort {
-		case 22:
-			hasSshPort = true
-		case dockerPort:
-			hasDockerPort = true
-		case swarmPort:
-			hasSwarmPort = true
-		}
+		opened[fmt.Sprintf("%d/%s", p.FromPort, p.IpProtocol)] = true
 	}
 
 	perms := []amz.IpPermission{}
+	cidrs := d.openPortCidrs()
 
-	if !hasSshPort {
-		perms = append(perms, amz.IpPermission{
-			IpProtocol: "tcp",
-			FromPort:   22,
-			ToPort:     22,
-			IpRange:    ipRange,
-		})
+	for _, value := range ports {
+		if opened[value] {
+			continue
+		}
+		opened[value] = true
+
+		port, protocol, err := parseOpenPort(value)
+		if err != nil {
+			log.Warnf("Skipping port %s: %s", value, err)
+			continue
+		}
+
+		// one permission per CIDR block so each can be revoked on its own
+		for _, cidr := range cidrs {
+			perms = append(perms, amz.IpPermission{
+				IpProtocol: protocol,
+				FromPort:   port,
+				ToPort:     port,
+				IpRange:    cidr,
+			})
+		}
 	}
 
-	if !hasDockerPort {
-		perms = append(perms, amz.IpPermission{
-			IpProtocol: "tcp",
-			FromPort:   dockerPort,
-			ToPort:     dockerPort,
-			IpRange:    ipRange,
-		})
+	log.Debugf("configuring security group authorization for %s", strings.Join(cidrs, ", "))
+
+	return perms
+}
+
+// openPortCidrs returns the CIDR blocks the ports of the machine are opened
+// to. Machines created before the blocks were configurable use 0.0.0.0/0,
+// and ::/0 too when the instance has an IPv6 address.
+func (d *Driver) openPortCidrs() []string {
+	if len(d.OpenPortCidrs) == 0 {
+		if d.AssignIpv6 {
+			return []string{ipRange, ipv6Range}
+		}
+		return []string{ipRange}
 	}
 
-	if !hasSwarmPort && d.SwarmMaster {
-		perms = append(perms, amz.IpPermission{
-			IpProtocol: "tcp",
-			FromPort:   swarmPort,
-			ToPort:     swarmPort,
-			IpRange:    ipRange,
-		})
+	return d.OpenPortCidrs
+}
+
+// reconcileSecurityGroupPermissions compares the ingress rules of the group
+// with the rules docker-machine needs and returns the rules to revoke and the
+// rules to authorize so that the group matches exactly.
+func (d *Driver) reconcileSecurityGroupPermissions(group *amz.SecurityGroup) ([]amz.IpPermission, []amz.IpPermission) {
+	desired := d.configureSecurityGroupPermissions(&amz.SecurityGroup{})
+	matched := make([]bool, len(desired))
+
+	revoke := []amz.IpPermission{}
+	for _, p := range splitPermissions(group.IpPermissions) {
+		keep := false
+		for i, q := range desired {
+			if !matched[i] && samePermission(p, q) {
+				matched[i] = true
+				keep = true
+				break
+			}
+		}
+
+		if !keep {
+			revoke = append(revoke, p)
+		}
 	}
 
-	log.Debugf("configuring security group authorization for %s", ipRange)
+	authorize := []amz.IpPermission{}
+	for i, q := range desired {
+		if !matched[i] {
+			authorize = append(authorize, q)
+		}
+	}
 
-	return perms
+	return revoke, authorize
 }
 
+// deleteSecurityGroup deletes the security group, retrying while the network
+// interface of the terminated instance is still being released.
 func (d *Driver) deleteSecurityGroup() error {
 	log.Debugf("deleting security group %s", d.SecurityGroupId)
 
-	if err := d.getClient().DeleteSecurityGroup(d.SecurityGroupId); err != nil {
-		return err
+	err := retryWhileInUse(d.SecurityGroupDeleteTimeout, func() error {
+		return d.getClient().DeleteSecurityGroup(d.SecurityGroupId)
+	})
+	if amz.ErrorCode(err) == amz.ErrorDependencyViolation {
+		return d.securityGroupDependencyError(err)
 	}
 
-	return nil
+	return err
+}
+
+// retryWhileInUse retries a delete for up to timeout seconds while it fails
+// because the resource is still in use, e.g. by the network interface of an
+// instance that is shutting down.
+func retryWhileInUse(timeout int, del func() error) error {
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		err := del()
+		code := amz.ErrorCode(err)
+		if err == nil || (code != amz.ErrorDependencyViolation && code != amz.ErrorPlacementGroupInUse) {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+
+		log.Debugf("resource is still in use, retrying: %s", err)
+		time.Sleep(securityGroupDeletePollInterval)
+	}
+}
+
+// securityGroupDependencyError lists the network interfaces that still use
+// the security group so the user knows what is blocking the delete.
+func (d *Driver) securityGroupDependencyError(err error) error {
+	filters := []amz.Filter{
+		{
+			Name:  "group-id",
+			Value: d.SecurityGroupId,
+		},
+	}
+
+	interfaces, listErr := d.getClient().GetNetworkInterfaces(filters)
+	if listErr != nil || len(interfaces) == 0 {
+		return fmt.Errorf("security group %s is still in use after %d seconds: %s", d.SecurityGroupId, d.SecurityGroupDeleteTimeout, err)
+	}
+
+	users := []string{}
+	for _, iface := range interfaces {
+		user := iface.NetworkInterfaceId
+		if iface.Attachment.InstanceId != "" {
+			user += fmt.Sprintf(" (instance %s)", iface.Attachment.InstanceId)
+		}
+		users = append(users, user)
+	}
+
+	return fmt.Errorf("security group %s is still in use after %d seconds by: %s", d.SecurityGroupId, d.SecurityGroupDeleteTimeout, strings.Join(users, ", "))
 }
 
 func (d *Driver) deleteKeyPair() error {
@@ -1,11 +1,20 @@
 package amazonec2
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/docker/machine/drivers/amazonec2/amz"
+	"github.com/docker/machine/state"
 )
 
 const (
@@ -43,6 +52,10 @@ func (d DriverOptionsMock) Bool(key string) bool {
 	return d.Data[key].(bool)
 }
 
+func (d DriverOptionsMock) StringSlice(key string) []string {
+	return d.Data[key].([]string)
+}
+
 func cleanup() error {
 	return os.RemoveAll(testStoreDir)
 }
@@ -59,24 +72,101 @@ func getTestStorePath() (string, error) {
 func getDefaultTestDriverFlags() *DriverOptionsMock {
 	return &DriverOptionsMock{
 		Data: map[string]interface{}{
-			"name":                           "test",
-			"url":                            "unix:///var/run/docker.sock",
-			"swarm":                          false,
-			"swarm-host":                     "",
-			"swarm-master":                   false,
-			"swarm-discovery":                "",
-			"amazonec2-ami":                  "ami-12345",
-			"amazonec2-access-key":           "abcdefg",
-			"amazonec2-secret-key":           "12345",
-			"amazonec2-session-token":        "",
-			"amazonec2-instance-type":        "t1.micro",
-			"amazonec2-vpc-id":               "vpc-12345",
-			"amazonec2-subnet-id":            "subnet-12345",
-			"amazonec2-security-group":       "docker-machine-test",
-			"amazonec2-region":               "us-east-1",
-			"amazonec2-zone":                 "e",
-			"amazonec2-root-size":            10,
-			"amazonec2-iam-instance-profile": "",
+			"name":                                    "test",
+			"url":                                     "unix:///var/run/docker.sock",
+			"swarm":                                   false,
+			"swarm-host":                              "",
+			"swarm-master":                            false,
+			"swarm-discovery":                         "",
+			"amazonec2-ami":                           "ami-12345",
+			"amazonec2-ami-name":                      "",
+			"amazonec2-ami-owner":                     []string{},
+			"amazonec2-access-key":                    "abcdefg",
+			"amazonec2-secret-key":                    "12345",
+			"amazonec2-session-token":                 "",
+			"amazonec2-instance-type":                 "t1.micro",
+			"amazonec2-vpc-id":                        "vpc-12345",
+			"amazonec2-subnet-id":                     "subnet-12345",
+			"amazonec2-security-group":                "docker-machine-test",
+			"amazonec2-security-group-reconcile":      false,
+			"amazonec2-region":                        "us-east-1",
+			"amazonec2-zone":                          "e",
+			"amazonec2-root-size":                     10,
+			"amazonec2-iam-instance-profile":          "",
+			"amazonec2-partition-count":               0,
+			"amazonec2-placement-strategy":            "",
+			"amazonec2-skip-hostname":                 false,
+			"amazonec2-hostname":                      "",
+			"amazonec2-network-interface-id":          "",
+			"amazonec2-monitoring":                    false,
+			"amazonec2-root-device-name":              "",
+			"amazonec2-root-throughput":               0,
+			"amazonec2-disable-source-dest-check":     false,
+			"amazonec2-assign-ipv6":                   false,
+			"amazonec2-skip-security-group-creation":  false,
+			"amazonec2-endpoint":                      "",
+			"amazonec2-dry-run":                       false,
+			"amazonec2-hibernate":                     false,
+			"amazonec2-open-port":                     []string{},
+			"amazonec2-open-port-cidr":                []string{},
+			"amazonec2-docker-port":                   2376,
+			"amazonec2-create-placement-group":        false,
+			"amazonec2-placement-group":               "",
+			"amazonec2-skip-instance-type-check":      false,
+			"amazonec2-credential-profile":            "default",
+			"amazonec2-ubuntu-release":                "",
+			"amazonec2-create-timeout":                600,
+			"amazonec2-throttle-attempts":             5,
+			"amazonec2-ebs-optimized":                 false,
+			"amazonec2-user-data":                     "",
+			"amazonec2-private-address-only":          false,
+			"amazonec2-elastic-ip-allocation-id":      "",
+			"amazonec2-use-elastic-ip":                false,
+			"amazonec2-docker-data-path":              "",
+			"amazonec2-additional-volume":             []string{},
+			"amazonec2-root-iops":                     0,
+			"amazonec2-root-volume-type":              "gp2",
+			"amazonec2-kms-key-id":                    "",
+			"amazonec2-encrypt-ebs-volume":            false,
+			"amazonec2-ssh-port":                      22,
+			"amazonec2-ssh-user":                      "ubuntu",
+			"amazonec2-ssh-keypath":                   "",
+			"amazonec2-keypair-name":                  "",
+			"amazonec2-spot-price":                    "",
+			"amazonec2-request-spot-instance":         false,
+			"amazonec2-keep-on-create-failure":        false,
+			"amazonec2-zone-id":                       "",
+			"amazonec2-shared-keypair-name":           "",
+			"amazonec2-stop-fallback-terminate":       false,
+			"amazonec2-reject-deprecated-ami":         false,
+			"amazonec2-client-token":                  "",
+			"amazonec2-host-affinity":                 "",
+			"amazonec2-host-id":                       "",
+			"amazonec2-ssh-key-filename":              "id_rsa",
+			"amazonec2-tags":                          []string{},
+			"amazonec2-cloud-init-timeout":            600,
+			"amazonec2-wait-cloud-init":               false,
+			"amazonec2-ssh-disable-multiplexing":      false,
+			"amazonec2-delete-subnet":                 false,
+			"amazonec2-create-subnet":                 "",
+			"amazonec2-run-instance-retries":          3,
+			"amazonec2-spot-interruption-behavior":    "terminate",
+			"amazonec2-host-resource-group-arn":       "",
+			"amazonec2-tenancy":                       "default",
+			"amazonec2-use-private-address":           false,
+			"amazonec2-docker-version":                "",
+			"amazonec2-install-docker-method":         "script",
+			"amazonec2-install-docker":                false,
+			"amazonec2-partition":                     "",
+			"amazonec2-security-group-delete-timeout": 300,
+			"amazonec2-delete-security-group":         false,
+			"amazonec2-instance-store":                false,
+			"amazonec2-requests-per-second":           0,
+			"amazonec2-max-concurrent-requests":       0,
+			"amazonec2-timing-summary":                false,
+			"amazonec2-ssh-timeout":                   120,
+			"amazonec2-public-ip-attempts":            60,
+			"amazonec2-stop-grace-period":             0,
 		},
 	}
 }
@@ -227,3 +317,3529 @@ func TestValidateAwsRegionInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestNewestTrustedImage(t *testing.T) {
+	images := []amz.Image{
+		{ImageId: "ami-old", ImageOwnerId: "099720109477", CreationDate: "2015-01-01T00:00:00.000Z"},
+		{ImageId: "ami-new", ImageOwnerId: "099720109477", CreationDate: "2015-03-01T00:00:00.000Z"},
+		{ImageId: "ami-untrusted", ImageOwnerId: "123456789012", CreationDate: "2015-04-01T00:00:00.000Z"},
+	}
+
+	image := newestTrustedImage(images, []string{"099720109477"})
+	if image == nil {
+		t.Fatal("expected an image to be selected")
+	}
+
+	if image.ImageId != "ami-new" {
+		t.Fatalf("expected ami-new; received %s", image.ImageId)
+	}
+}
+
+func TestNewestTrustedImageUntrustedOwner(t *testing.T) {
+	images := []amz.Image{
+		{ImageId: "ami-untrusted", ImageOwnerId: "123456789012", CreationDate: "2015-04-01T00:00:00.000Z"},
+	}
+
+	if image := newestTrustedImage(images, []string{"099720109477"}); image != nil {
+		t.Fatalf("expected no image to be selected; received %s", image.ImageId)
+	}
+}
+
+func TestSetConfigFromFlagsDefaultAMIOwner(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if len(d.AMIOwners) != 1 || d.AMIOwners[0] != defaultAMIOwner {
+		t.Fatalf("expected default owner %s; received %v", defaultAMIOwner, d.AMIOwners)
+	}
+}
+
+func TestPickSubnetDeterministic(t *testing.T) {
+	subnets := []string{"subnet-1", "subnet-2", "subnet-3"}
+
+	first := pickSubnet("node-1", subnets)
+	if !containsString(subnets, first) {
+		t.Fatalf("expected one of %v; received %s", subnets, first)
+	}
+
+	for i := 0; i < 10; i++ {
+		if s := pickSubnet("node-1", subnets); s != first {
+			t.Fatalf("expected %s on every call; received %s", first, s)
+		}
+	}
+}
+
+func TestSetConfigFromFlagsSubnetList(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-subnet-id"] = "subnet-1, subnet-2"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.SubnetIds) != 2 {
+		t.Fatalf("expected 2 subnets; received %v", d.SubnetIds)
+	}
+
+	if !containsString(d.SubnetIds, d.SubnetId) {
+		t.Fatalf("expected the chosen subnet to be one of %v; received %s", d.SubnetIds, d.SubnetId)
+	}
+}
+
+func TestSetMetadataOptionsInvalid(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if err := d.SetMetadataOptions("always", 1); err == nil {
+		t.Fatal("expected an error for invalid http tokens")
+	}
+
+	if err := d.SetMetadataOptions("required", 65); err == nil {
+		t.Fatal("expected an error for invalid hop limit")
+	}
+}
+
+func TestSetConfigFromFlagsAMIAndAMIName(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-ami-name"] = "ubuntu/images/hvm-ssd/ubuntu-*-amd64-server-*"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error when both an AMI and an AMI name are given")
+	}
+}
+
+func TestSetConfigFromFlagsSpotInterruptionBehavior(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-spot-interruption-behavior"] = "pause"
+	err = d.SetConfigFromFlags(flags)
+	if err == nil || !strings.Contains(err.Error(), "terminate, stop or hibernate") {
+		t.Fatalf("expected an error listing the allowed behaviors; received %v", err)
+	}
+}
+
+func TestReconcileSecurityGroupPermissions(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	group := securityGroup
+
+	group.IpPermissions = []amz.IpPermission{
+		{
+			IpProtocol: "tcp",
+			FromPort:   testSshPort,
+			ToPort:     testSshPort,
+			IpRanges:   []string{"0.0.0.0/0"},
+		},
+		{
+			IpProtocol: "tcp",
+			FromPort:   testDockerPort,
+			ToPort:     testDockerPort,
+			IpRanges:   []string{"10.0.0.0/8"},
+		},
+		{
+			IpProtocol: "tcp",
+			FromPort:   8080,
+			ToPort:     8080,
+			IpRanges:   []string{"0.0.0.0/0"},
+		},
+	}
+
+	revoke, authorize := d.reconcileSecurityGroupPermissions(&group)
+	if len(revoke) != 2 {
+		t.Fatalf("expected 2 permissions to revoke; received %d", len(revoke))
+	}
+
+	if len(authorize) != 1 {
+		t.Fatalf("expected 1 permission to authorize; received %d", len(authorize))
+	}
+
+	if authorize[0].FromPort != testDockerPort {
+		t.Fatalf("expected permission on port %d; received port %d", testDockerPort, authorize[0].FromPort)
+	}
+}
+
+func TestReconcileSecurityGroupPermissionsDualStack(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.AssignIpv6 = true
+
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSecurityGroups": {{http.StatusOK, `<DescribeSecurityGroupsResponse>
+  <securityGroupInfo>
+    <item>
+      <groupId>sg-12345</groupId>
+      <groupName>docker-machine</groupName>
+      <vpcId>vpc-12345</vpcId>
+      <ipPermissions>
+        <item>
+          <ipProtocol>tcp</ipProtocol><fromPort>22</fromPort><toPort>22</toPort>
+          <ipRanges><item><cidrIp>0.0.0.0/0</cidrIp></item></ipRanges>
+          <ipv6Ranges><item><cidrIpv6>::/0</cidrIpv6></item></ipv6Ranges>
+        </item>
+        <item>
+          <ipProtocol>tcp</ipProtocol><fromPort>2376</fromPort><toPort>2376</toPort>
+          <ipRanges><item><cidrIp>0.0.0.0/0</cidrIp></item></ipRanges>
+          <ipv6Ranges><item><cidrIpv6>::/0</cidrIpv6></item></ipv6Ranges>
+        </item>
+        <item>
+          <ipProtocol>tcp</ipProtocol><fromPort>8080</fromPort><toPort>8080</toPort>
+          <ipv6Ranges><item><cidrIpv6>::/0</cidrIpv6></item></ipv6Ranges>
+        </item>
+      </ipPermissions>
+    </item>
+  </securityGroupInfo>
+</DescribeSecurityGroupsResponse>`}},
+	}}
+	d.transport = ec2
+
+	groups, err := d.getClient().GetSecurityGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoke, authorize := d.reconcileSecurityGroupPermissions(&groups[0])
+	if len(authorize) != 0 {
+		t.Fatalf("expected the dual-stack rules to be kept; received %v to authorize", authorize)
+	}
+
+	if len(revoke) != 1 || revoke[0].FromPort != 8080 || revoke[0].IpRange != "::/0" {
+		t.Fatalf("expected only the IPv6 rule on port 8080 to be revoked; received %v", revoke)
+	}
+}
+
+func TestInstanceGone(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+
+	cases := []struct {
+		Response fakeResponse
+		Gone     bool
+	}{
+		{fakeResponse{http.StatusOK, describeInstancesResponse("i-12345", "running")}, false},
+		{fakeResponse{http.StatusOK, describeInstancesResponse("i-12345", "terminated")}, true},
+		{fakeResponse{http.StatusBadRequest, errorResponse("InvalidInstanceID.NotFound", "The instance ID 'i-12345' does not exist")}, true},
+	}
+
+	for _, c := range cases {
+		d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+			"DescribeInstances": {c.Response},
+		}}
+
+		gone, err := d.instanceGone()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if gone != c.Gone {
+			t.Fatalf("expected gone to be %t; received %t", c.Gone, gone)
+		}
+	}
+}
+
+func TestDeleteSecurityGroupDependencyViolation(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	securityGroupDeletePollInterval = time.Millisecond
+	d.SecurityGroupId = "sg-12345"
+
+	inUse := fakeResponse{http.StatusBadRequest, errorResponse("DependencyViolation", "resource sg-12345 has a dependent object")}
+	fake := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DeleteSecurityGroup": {
+			inUse,
+			inUse,
+			{http.StatusOK, "<DeleteSecurityGroupResponse><return>true</return></DeleteSecurityGroupResponse>"},
+		},
+	}}
+	d.transport = fake
+
+	if err := d.deleteSecurityGroup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(fake.requests("DeleteSecurityGroup")); n != 3 {
+		t.Fatalf("expected 3 delete attempts; received %d", n)
+	}
+}
+
+func TestDeleteSecurityGroupTimeout(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	securityGroupDeletePollInterval = time.Millisecond
+	d.SecurityGroupId = "sg-12345"
+	d.SecurityGroupDeleteTimeout = 0
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DeleteSecurityGroup": {
+			{http.StatusBadRequest, errorResponse("DependencyViolation", "resource sg-12345 has a dependent object")},
+		},
+		"DescribeNetworkInterfaces": {
+			{http.StatusOK, `<DescribeNetworkInterfacesResponse>
+  <networkInterfaceSet>
+    <item>
+      <networkInterfaceId>eni-12345</networkInterfaceId>
+      <attachment>
+        <instanceId>i-12345</instanceId>
+      </attachment>
+    </item>
+  </networkInterfaceSet>
+</DescribeNetworkInterfacesResponse>`},
+		},
+	}}
+
+	err = d.deleteSecurityGroup()
+	if err == nil {
+		t.Fatal("expected an error when the security group stays in use")
+	}
+
+	if !strings.Contains(err.Error(), "eni-12345 (instance i-12345)") {
+		t.Fatalf("expected the lingering network interface in the error; received %s", err)
+	}
+}
+
+func TestSetTagsReplace(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	fake := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {
+			{http.StatusOK, `<DescribeInstancesResponse>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-12345</instanceId>
+          <tagSet>
+            <item><key>Name</key><value>test-host</value></item>
+            <item><key>Team</key><value>web</value></item>
+            <item><key>aws:cloudformation:stack-name</key><value>stack</value></item>
+          </tagSet>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`},
+		},
+		"DeleteTags": {{http.StatusOK, "<DeleteTagsResponse><return>true</return></DeleteTagsResponse>"}},
+		"CreateTags": {{http.StatusOK, "<CreateTagsResponse><return>true</return></CreateTagsResponse>"}},
+	}}
+	d.transport = fake
+
+	if err := d.SetTags(map[string]string{"Name": "test-host", "CostCenter": "42"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	deletes := fake.requests("DeleteTags")
+	if len(deletes) != 1 {
+		t.Fatalf("expected 1 DeleteTags request; received %d", len(deletes))
+	}
+
+	q := deletes[0].URL.Query()
+	if q.Get("Tag.1.Key") != "Team" || q.Get("Tag.2.Key") != "" {
+		t.Fatalf("expected only the Team tag to be deleted; received %v", q)
+	}
+
+	if len(fake.requests("CreateTags")) != 1 {
+		t.Fatal("expected the tags to be created")
+	}
+}
+
+func TestFindSubnetOutsideZone(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.SubnetId = ""
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSubnets": {
+			{http.StatusOK, "<DescribeSubnetsResponse><subnetSet></subnetSet></DescribeSubnetsResponse>"},
+			{http.StatusOK, `<DescribeSubnetsResponse>
+  <subnetSet>
+    <item>
+      <subnetId>subnet-b</subnetId>
+      <vpcId>vpc-12345</vpcId>
+      <availabilityZone>us-east-1b</availabilityZone>
+    </item>
+  </subnetSet>
+</DescribeSubnetsResponse>`},
+		},
+	}}
+
+	if err := d.findSubnet(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.SubnetId != "subnet-b" {
+		t.Fatalf("expected subnet-b; received %s", d.SubnetId)
+	}
+
+	if d.Zone != "b" {
+		t.Fatalf("expected the zone to follow the subnet; received %s", d.Zone)
+	}
+}
+
+func TestGetStateRetriesEmptyResult(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer func(backoff time.Duration) { instanceLookupBackoff = backoff }(instanceLookupBackoff)
+	instanceLookupBackoff = time.Millisecond
+
+	d.InstanceId = "i-12345"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {
+			{http.StatusOK, "<DescribeInstancesResponse><reservationSet></reservationSet></DescribeInstancesResponse>"},
+			{http.StatusOK, describeInstancesResponse("i-12345", "stopping")},
+		},
+	}}
+	d.transport = ec2
+
+	st, err := d.GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st != state.Stopping {
+		t.Fatalf("expected %s; received %s", state.Stopping, st)
+	}
+
+	if n := len(ec2.requests("DescribeInstances")); n != 2 {
+		t.Fatalf("expected 2 DescribeInstances calls; received %d", n)
+	}
+}
+
+func TestValidateZones(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.Region = "us-east-1"
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeAvailabilityZones": {{http.StatusOK, `<DescribeAvailabilityZonesResponse>
+  <availabilityZoneInfo>
+    <item><zoneName>us-east-1a</zoneName></item>
+    <item><zoneName>us-east-1b</zoneName></item>
+  </availabilityZoneInfo>
+</DescribeAvailabilityZonesResponse>`}},
+	}}
+
+	d.Zones = []string{"a", "b"}
+	if err := d.validateZones(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Zones = []string{"a", "f"}
+	if err := d.validateZones(); err == nil {
+		t.Fatal("expected an error for a zone outside the region")
+	}
+}
+
+func TestGetSecurityGroupRules(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.SecurityGroupId = "sg-12345"
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSecurityGroups": {{http.StatusOK, `<DescribeSecurityGroupsResponse>
+  <securityGroupInfo>
+    <item>
+      <groupId>sg-12345</groupId>
+      <ipPermissions>
+        <item>
+          <ipProtocol>tcp</ipProtocol>
+          <fromPort>22</fromPort>
+          <toPort>22</toPort>
+          <ipRanges><item><cidrIp>0.0.0.0/0</cidrIp></item></ipRanges>
+        </item>
+      </ipPermissions>
+      <ipPermissionsEgress>
+        <item>
+          <ipProtocol>-1</ipProtocol>
+          <ipRanges><item><cidrIp>0.0.0.0/0</cidrIp></item></ipRanges>
+        </item>
+      </ipPermissionsEgress>
+    </item>
+  </securityGroupInfo>
+</DescribeSecurityGroupsResponse>`}},
+	}}
+
+	rules, err := d.GetSecurityGroupRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules.Ingress) != 1 || rules.Ingress[0].FromPort != 22 {
+		t.Fatalf("expected the ssh ingress rule; received %v", rules.Ingress)
+	}
+
+	if len(rules.Egress) != 1 || rules.Egress[0].IpProtocol != "-1" {
+		t.Fatalf("expected the allow-all egress rule; received %v", rules.Egress)
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+
+	response := func(public string) string {
+		return `<DescribeInstancesResponse>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-12345</instanceId>
+          <ipAddress>` + public + `</ipAddress>
+          <privateIpAddress>10.0.0.5</privateIpAddress>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`
+	}
+
+	cases := []struct {
+		Public            string
+		UsePrivateAddress bool
+		Expected          string
+	}{
+		{"54.0.0.1", false, "54.0.0.1"},
+		{"54.0.0.1", true, "54.0.0.1"},
+		{"", false, ""},
+		{"", true, "10.0.0.5"},
+	}
+
+	for _, c := range cases {
+		d.UsePrivateAddress = c.UsePrivateAddress
+		d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+			"DescribeInstances": {{http.StatusOK, response(c.Public)}},
+		}}
+
+		ip, err := d.GetIP()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ip != c.Expected {
+			t.Fatalf("expected %q with public %q and private mode %t; received %q", c.Expected, c.Public, c.UsePrivateAddress, ip)
+		}
+	}
+}
+
+func TestSetConfigFromFlagsHostResourceGroupArn(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-host-resource-group-arn"] = "arn:aws:resource-groups:us-east-1:123456789012:group/hosts"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Tenancy != "host" {
+		t.Fatalf("expected host tenancy; received %s", d.Tenancy)
+	}
+
+	flags.Data["amazonec2-tenancy"] = "dedicated"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error combining a host resource group with dedicated tenancy")
+	}
+}
+
+func TestRunInstanceRetriesInternalError(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer func(interval time.Duration) { runInstanceRetryInterval = interval }(runInstanceRetryInterval)
+	runInstanceRetryInterval = time.Millisecond
+
+	d.RunInstanceRetries = 3
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"RunInstances": {
+			{http.StatusInternalServerError, errorResponse("InternalError", "An internal error has occurred")},
+			{http.StatusOK, `<RunInstancesResponse>
+  <instancesSet>
+    <item>
+      <instanceId>i-12345</instanceId>
+    </item>
+  </instancesSet>
+</RunInstancesResponse>`},
+		},
+	}}
+	d.transport = ec2
+
+	instance, err := d.runInstance(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instance.InstanceId != "i-12345" {
+		t.Fatalf("expected i-12345; received %s", instance.InstanceId)
+	}
+
+	reqs := ec2.requests("RunInstances")
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 RunInstances calls; received %d", len(reqs))
+	}
+
+	first, second := reqs[0].URL.Query().Get("ClientToken"), reqs[1].URL.Query().Get("ClientToken")
+	if first == "" || first != second {
+		t.Fatalf("expected both attempts to share a client token; received %q and %q", first, second)
+	}
+}
+
+func TestRunInstanceParameterErrorNotRetried(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.RunInstanceRetries = 3
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"RunInstances": {{http.StatusBadRequest, errorResponse("InvalidParameterValue", "Invalid value for InstanceType")}},
+	}}
+	d.transport = ec2
+
+	if _, err := d.runInstance(nil); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if n := len(ec2.requests("RunInstances")); n != 1 {
+		t.Fatalf("expected a single RunInstances call; received %d", n)
+	}
+}
+
+func TestGetLaunchTime(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, `<DescribeInstancesResponse>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-12345</instanceId>
+          <launchTime>2015-04-01T10:30:00.000Z</launchTime>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`}},
+	}}
+
+	launched, err := d.GetLaunchTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := time.Date(2015, 4, 1, 10, 30, 0, 0, time.UTC)
+	if !launched.Equal(expected) {
+		t.Fatalf("expected %s; received %s", expected, launched)
+	}
+}
+
+func TestCidrContains(t *testing.T) {
+	cases := []struct {
+		Inner  string
+		Within bool
+	}{
+		{"10.0.1.0/24", true},
+		{"10.0.0.0/16", true},
+		{"10.1.0.0/24", false},
+		{"10.0.0.0/8", false},
+	}
+
+	for _, c := range cases {
+		within, err := cidrContains("10.0.0.0/16", c.Inner)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if within != c.Within {
+			t.Fatalf("expected %s within 10.0.0.0/16 to be %t", c.Inner, c.Within)
+		}
+	}
+}
+
+func TestSetConfigFromFlagsDefaultTags(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer os.Setenv(defaultTagsEnvVar, os.Getenv(defaultTagsEnvVar))
+	os.Setenv(defaultTagsEnvVar, "team=infra,env=prod")
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-tags"] = []string{"env=dev,owner=alice"}
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"team": "infra", "env": "dev", "owner": "alice"}
+	if len(d.Tags) != len(expected) {
+		t.Fatalf("expected %v; received %v", expected, d.Tags)
+	}
+
+	for k, v := range expected {
+		if d.Tags[k] != v {
+			t.Fatalf("expected %s=%s; received %v", k, v, d.Tags)
+		}
+	}
+}
+
+func TestNormalizeCIDRs(t *testing.T) {
+	cidrs, err := normalizeCIDRs([]string{"1.2.3.4", "10.0.0.0/8", " 2001:db8::1 ", "192.168.1.7/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"1.2.3.4/32", "10.0.0.0/8", "2001:db8::1/128", "192.168.1.0/24"}
+	for i := range expected {
+		if cidrs[i] != expected[i] {
+			t.Fatalf("expected %v; received %v", expected, cidrs)
+		}
+	}
+
+	for _, invalid := range []string{"1.2.3", "10.0.0.0/33", "office"} {
+		if _, err := normalizeCIDRs([]string{invalid}); err == nil || !strings.Contains(err.Error(), invalid) {
+			t.Fatalf("expected an error naming %q; received %v", invalid, err)
+		}
+	}
+}
+
+func TestSetConfigFromFlagsHostAffinityRequiresHostTenancy(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-host-affinity"] = "host"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for host affinity without host tenancy")
+	}
+
+	flags.Data["amazonec2-tenancy"] = "host"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := d.placement(); p.Affinity != "host" || p.Tenancy != "host" {
+		t.Fatalf("expected host affinity and tenancy in the placement; received %+v", p)
+	}
+}
+
+func TestWaitForVolumeModification(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer func(interval time.Duration) { volumeModificationPollInterval = interval }(volumeModificationPollInterval)
+	volumeModificationPollInterval = time.Millisecond
+
+	modification := func(st string, progress int) fakeResponse {
+		return fakeResponse{http.StatusOK, fmt.Sprintf(`<DescribeVolumesModificationsResponse>
+  <volumeModificationSet>
+    <item>
+      <volumeId>vol-12345</volumeId>
+      <modificationState>%s</modificationState>
+      <progress>%d</progress>
+    </item>
+  </volumeModificationSet>
+</DescribeVolumesModificationsResponse>`, st, progress)}
+	}
+
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeVolumesModifications": {
+			modification("modifying", 10),
+			modification("optimizing", 60),
+			modification("completed", 100),
+		},
+	}}
+	d.transport = ec2
+
+	if err := d.WaitForVolumeModification("vol-12345", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ec2.requests("DescribeVolumesModifications")); n != 3 {
+		t.Fatalf("expected 3 polls; received %d", n)
+	}
+}
+
+func TestRunInstanceClientToken(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.ClientToken = "build-42"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"RunInstances": {{http.StatusOK, "<RunInstancesResponse><instancesSet><item><instanceId>i-12345</instanceId></item></instancesSet></RunInstancesResponse>"}},
+	}}
+	d.transport = ec2
+
+	if _, err := d.runInstance(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if token := ec2.requests("RunInstances")[0].URL.Query().Get("ClientToken"); token != "build-42" {
+		t.Fatalf("expected the given client token; received %q", token)
+	}
+}
+
+func TestInstanceLimitError(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, describeInstancesResponse("i-12345", "running")}},
+	}}
+
+	err = d.instanceLimitError(fmt.Errorf("VcpuLimitExceeded"))
+	if !strings.Contains(err.Error(), "Service Quotas") || !strings.Contains(err.Error(), "1 instances running") {
+		t.Fatalf("expected an actionable limit error; received %s", err)
+	}
+}
+
+func TestCheckDeprecation(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	image := &amz.Image{ImageId: "ami-12345", DeprecationTime: "2020-01-01T00:00:00.000Z"}
+
+	if err := d.checkDeprecation(image); err != nil {
+		t.Fatalf("expected only a warning by default; received %s", err)
+	}
+
+	d.RejectDeprecatedAMI = true
+	if err := d.checkDeprecation(image); err == nil {
+		t.Fatal("expected an error for a deprecated image")
+	}
+
+	image.DeprecationTime = time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	if err := d.checkDeprecation(image); err != nil {
+		t.Fatalf("expected no error before the deprecation time; received %s", err)
+	}
+}
+
+func TestValidateInstanceProfile(t *testing.T) {
+	for _, valid := range []string{"docker-machine", "ci_role+build@team.example", "arn:aws:iam::123456789012:instance-profile/ci", "arn:aws-us-gov:iam::123456789012:instance-profile/team/ci"} {
+		if err := validateInstanceProfile(valid); err != nil {
+			t.Fatalf("expected %q to be valid; received %s", valid, err)
+		}
+	}
+
+	for _, invalid := range []string{
+		"role-a,role-b",
+		"role a",
+		"role/a",
+		"arn:aws:iam::123456789012:role/ci",
+		"arn:aws:iam::1234:instance-profile/ci",
+		"arn:aws:iam:us-east-1:123456789012:instance-profile/ci",
+	} {
+		if err := validateInstanceProfile(invalid); err == nil {
+			t.Fatalf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestGetSubnetAndSecurityGroupOfImportedInstance(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.SubnetId = ""
+	d.SecurityGroupId = ""
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, `<DescribeInstancesResponse>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-12345</instanceId>
+          <subnetId>subnet-67890</subnetId>
+          <vpcId>vpc-67890</vpcId>
+          <networkInterfaceSet>
+            <item>
+              <networkInterfaceId>eni-12345</networkInterfaceId>
+              <groupSet>
+                <item>
+                  <groupId>sg-67890</groupId>
+                  <groupName>web</groupName>
+                </item>
+              </groupSet>
+              <attachment>
+                <deviceIndex>0</deviceIndex>
+              </attachment>
+            </item>
+          </networkInterfaceSet>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`}},
+	}}
+
+	subnetId, err := d.GetSubnetId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subnetId != "subnet-67890" {
+		t.Fatalf("expected subnet-67890; received %s", subnetId)
+	}
+
+	groupId, err := d.GetSecurityGroupId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if groupId != "sg-67890" || d.SecurityGroupName != "web" {
+		t.Fatalf("expected sg-67890 (web); received %s (%s)", groupId, d.SecurityGroupName)
+	}
+}
+
+func TestStopFallbackTerminate(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+
+	for _, fallback := range []bool{false, true} {
+		d.StopFallbackTerminate = fallback
+		ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+			"StopInstances": {{http.StatusBadRequest, errorResponse("UnsupportedOperation", "The instance 'i-12345' does not have an 'ebs' root device type and cannot be stopped.")}},
+		}}
+		d.transport = ec2
+
+		err := d.Stop()
+		terminated := len(ec2.requests("TerminateInstances")) == 1
+
+		if fallback && (err != nil || !terminated) {
+			t.Fatalf("expected the instance to be terminated; received %v", err)
+		}
+
+		if !fallback && (err == nil || terminated) {
+			t.Fatal("expected the stop error without terminating the instance")
+		}
+	}
+}
+
+func TestSharedKeyPairInUse(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.KeyName = "cluster"
+
+	instances := func(states ...string) fakeResponse {
+		items := ""
+		for i, st := range states {
+			items += fmt.Sprintf("<item><instanceId>i-%d</instanceId><instanceState><name>%s</name></instanceState></item>", i, st)
+		}
+		return fakeResponse{http.StatusOK, "<DescribeInstancesResponse><reservationSet><item><instancesSet>" +
+			items + "</instancesSet></item></reservationSet></DescribeInstancesResponse>"}
+	}
+
+	cases := []struct {
+		Response fakeResponse
+		InUse    bool
+	}{
+		{instances(), false},
+		{instances("terminated", "shutting-down"), false},
+		{instances("terminated", "stopped"), true},
+	}
+
+	for _, c := range cases {
+		d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+			"DescribeInstances": {c.Response},
+		}}
+
+		inUse, err := d.sharedKeyPairInUse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if inUse != c.InUse {
+			t.Fatalf("expected in use to be %t; received %t", c.InUse, inUse)
+		}
+	}
+}
+
+func TestValidateZonesZoneId(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.Region = "us-east-1"
+	d.ZoneId = "use1-az4"
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeAvailabilityZones": {{http.StatusOK, `<DescribeAvailabilityZonesResponse>
+  <availabilityZoneInfo>
+    <item><zoneName>us-east-1a</zoneName><zoneId>use1-az6</zoneId></item>
+    <item><zoneName>us-east-1b</zoneName><zoneId>use1-az4</zoneId></item>
+  </availabilityZoneInfo>
+</DescribeAvailabilityZonesResponse>`}},
+	}}
+
+	if err := d.validateZones(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Zone != "b" {
+		t.Fatalf("expected zone b; received %s", d.Zone)
+	}
+
+	d.ZoneId = "use1-az9"
+	if err := d.validateZones(); err == nil {
+		t.Fatal("expected an error for an unknown zone ID")
+	}
+}
+
+func TestCheckKeyPairAvailableRetriesThrottling(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer amz.SetThrottleRetries(amz.DefaultThrottleAttempts, amz.DefaultThrottleBaseDelay)
+	amz.SetThrottleRetries(amz.DefaultThrottleAttempts, time.Millisecond)
+
+	throttled := fakeResponse{http.StatusServiceUnavailable, errorResponse("RequestLimitExceeded", "Request limit exceeded.")}
+
+	cases := []struct {
+		KeyPairs  string
+		Available bool
+	}{
+		{"", true},
+		{"<item><keyName>" + machineTestName + "</keyName></item>", false},
+	}
+
+	for _, c := range cases {
+		ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+			"DescribeKeyPairs": {
+				throttled,
+				{http.StatusOK, "<DescribeKeyPairsResponse><keySet>" + c.KeyPairs + "</keySet></DescribeKeyPairsResponse>"},
+			},
+		}}
+		d.transport = ec2
+
+		err := d.checkKeyPairAvailable()
+		if c.Available && err != nil {
+			t.Fatalf("expected the key pair to be available; received %s", err)
+		}
+
+		if !c.Available && (err == nil || !strings.Contains(err.Error(), "already a keypair")) {
+			t.Fatalf("expected an existing key pair error; received %v", err)
+		}
+
+		if n := len(ec2.requests("DescribeKeyPairs")); n != 2 {
+			t.Fatalf("expected the throttled call to be retried; received %d calls", n)
+		}
+	}
+}
+
+func TestCleanupFailedCreate(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.KeyName = machineTestName
+	d.SecurityGroupId = "sg-12345"
+	d.securityGroupCreated = true
+
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{}}
+	d.transport = ec2
+
+	d.cleanupFailedCreate()
+
+	for _, action := range []string{"TerminateInstances", "DeleteKeyPair", "DeleteSecurityGroup"} {
+		if len(ec2.requests(action)) != 1 {
+			t.Fatalf("expected a %s call", action)
+		}
+	}
+
+	if len(ec2.requests("DeleteSubnet")) != 0 {
+		t.Fatal("expected the subnet the driver did not create to be kept")
+	}
+}
+
+func TestCreateSubnetOnce(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.SubnetId = ""
+	d.SubnetIds = nil
+	d.CreateSubnetCidr = "10.0.1.0/24"
+	d.SkipInstanceTypeCheck = true
+
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeKeyPairs": {{http.StatusOK, "<DescribeKeyPairsResponse><keySet></keySet></DescribeKeyPairsResponse>"}},
+		"DescribeImages": {{http.StatusOK, `<DescribeImagesResponse>
+  <imagesSet>
+    <item><imageId>ami-12345</imageId><rootDeviceType>ebs</rootDeviceType></item>
+  </imagesSet>
+</DescribeImagesResponse>`}},
+		"DescribeVpcs": {{http.StatusOK, `<DescribeVpcsResponse>
+  <vpcSet>
+    <item><vpcId>vpc-12345</vpcId><cidrBlock>10.0.0.0/16</cidrBlock></item>
+  </vpcSet>
+</DescribeVpcsResponse>`}},
+		"DescribeAvailabilityZones": {{http.StatusOK, `<DescribeAvailabilityZonesResponse>
+  <availabilityZoneInfo>
+    <item><zoneName>us-east-1e</zoneName><zoneId>use1-az3</zoneId></item>
+  </availabilityZoneInfo>
+</DescribeAvailabilityZonesResponse>`}},
+		"CreateSubnet": {{http.StatusOK, `<CreateSubnetResponse>
+  <subnet><subnetId>subnet-67890</subnetId></subnet>
+</CreateSubnetResponse>`}},
+		"CreateTags": {{http.StatusOK, "<CreateTagsResponse><return>true</return></CreateTagsResponse>"}},
+		// stops the create once the subnet exists
+		"ImportKeyPair": {{http.StatusBadRequest, errorResponse("InvalidKeyPair.Duplicate", "The keypair already exists")}},
+	}}
+	d.transport = ec2
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ec2.requests("CreateSubnet")) != 0 {
+		t.Fatal("expected no subnet to be created before Create")
+	}
+
+	if err := d.Create(); err == nil {
+		t.Fatal("expected the create to fail on the key pair")
+	}
+
+	if n := len(ec2.requests("CreateSubnet")); n != 1 {
+		t.Fatalf("expected exactly one CreateSubnet request; received %d", n)
+	}
+
+	if len(ec2.requests("DeleteSubnet")) != 1 {
+		t.Fatal("expected the subnet to be removed after the failed create")
+	}
+}
+
+func TestCreatePlacementGroupOnce(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.PlacementGroup = "hpc"
+	d.CreatePlacementGroup = true
+	d.SkipInstanceTypeCheck = true
+
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeKeyPairs": {{http.StatusOK, "<DescribeKeyPairsResponse><keySet></keySet></DescribeKeyPairsResponse>"}},
+		"DescribeImages": {{http.StatusOK, `<DescribeImagesResponse>
+  <imagesSet>
+    <item><imageId>ami-12345</imageId><rootDeviceType>ebs</rootDeviceType></item>
+  </imagesSet>
+</DescribeImagesResponse>`}},
+		"DescribeSubnets": {{http.StatusOK, `<DescribeSubnetsResponse>
+  <subnetSet>
+    <item><subnetId>subnet-12345</subnetId><vpcId>vpc-12345</vpcId><availabilityZone>us-east-1e</availabilityZone></item>
+  </subnetSet>
+</DescribeSubnetsResponse>`}},
+		"DescribeAvailabilityZones": {{http.StatusOK, `<DescribeAvailabilityZonesResponse>
+  <availabilityZoneInfo>
+    <item><zoneName>us-east-1e</zoneName><zoneId>use1-az3</zoneId></item>
+  </availabilityZoneInfo>
+</DescribeAvailabilityZonesResponse>`}},
+		"DescribePlacementGroups": {{http.StatusOK, "<DescribePlacementGroupsResponse><placementGroupSet></placementGroupSet></DescribePlacementGroupsResponse>"}},
+		"DescribeInstances":       {{http.StatusOK, "<DescribeInstancesResponse><reservationSet></reservationSet></DescribeInstancesResponse>"}},
+		// stops the create once the placement group exists
+		"ImportKeyPair": {{http.StatusBadRequest, errorResponse("InvalidKeyPair.Duplicate", "The keypair already exists")}},
+	}}
+	d.transport = ec2
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ec2.requests("CreatePlacementGroup")) != 0 {
+		t.Fatal("expected no placement group to be created before Create")
+	}
+
+	if err := d.Create(); err == nil {
+		t.Fatal("expected the create to fail on the key pair")
+	}
+
+	if n := len(ec2.requests("CreatePlacementGroup")); n != 1 {
+		t.Fatalf("expected exactly one CreatePlacementGroup request; received %d", n)
+	}
+
+	if len(ec2.requests("DeletePlacementGroup")) != 1 {
+		t.Fatal("expected the placement group to be removed after the failed create")
+	}
+}
+
+func spotRequestResponse(action, state, instanceId string) fakeResponse {
+	return fakeResponse{http.StatusOK, fmt.Sprintf(`<%sResponse>
+  <spotInstanceRequestSet>
+    <item>
+      <spotInstanceRequestId>sir-12345</spotInstanceRequestId>
+      <state>%s</state>
+      <status>
+        <code>%s</code>
+        <message>status of the request</message>
+      </status>
+      <instanceId>%s</instanceId>
+    </item>
+  </spotInstanceRequestSet>
+</%sResponse>`, action, state, state, instanceId, action)}
+}
+
+func TestRequestSpotInstance(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer func(interval time.Duration) { spotRequestPollInterval = interval }(spotRequestPollInterval)
+	spotRequestPollInterval = time.Millisecond
+
+	d.RequestSpotInstance = true
+	d.SpotPrice = "0.05"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"RequestSpotInstances": {spotRequestResponse("RequestSpotInstances", "open", "")},
+		"DescribeSpotInstanceRequests": {
+			spotRequestResponse("DescribeSpotInstanceRequests", "open", ""),
+			spotRequestResponse("DescribeSpotInstanceRequests", "active", "i-12345"),
+		},
+		"DescribeInstances": {{http.StatusOK, describeInstancesResponse("i-12345", "pending")}},
+	}}
+	d.transport = ec2
+
+	instance, err := d.requestSpotInstance(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instance.InstanceId != "i-12345" || d.SpotInstanceRequestId != "sir-12345" {
+		t.Fatalf("unexpected instance %s of spot request %s", instance.InstanceId, d.SpotInstanceRequestId)
+	}
+
+	q := ec2.requests("RequestSpotInstances")[0].URL.Query()
+	if q.Get("SpotPrice") != "0.05" || q.Get("Type") != "one-time" {
+		t.Fatalf("unexpected spot request parameters: %v", q)
+	}
+
+	// the spot API only tags the request on creation
+	if q.Get("TagSpecification.1.ResourceType") != "spot-instances-request" {
+		t.Fatalf("expected the spot request to be tagged; received %v", q)
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ec2.requests("CancelSpotInstanceRequests")) != 1 {
+		t.Fatal("expected Remove to cancel the spot request")
+	}
+}
+
+func TestRequestSpotInstanceCancelled(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.RequestSpotInstance = true
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"RequestSpotInstances": {spotRequestResponse("RequestSpotInstances", "cancelled", "")},
+	}}
+
+	_, err = d.requestSpotInstance(nil)
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("expected an error for the cancelled request; received %v", err)
+	}
+}
+
+func TestExistingKeyPairIsKept(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-keypair-name"] = "team-key"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for a key pair name without a private key path")
+	}
+
+	flags.Data["amazonec2-ssh-keypath"] = "/home/user/.ssh/team-key"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{}}
+	d.transport = ec2
+
+	if err := d.releaseKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ec2.requests("DeleteKeyPair")) != 0 {
+		t.Fatal("expected the existing key pair to be kept")
+	}
+}
+
+func TestGetSSHCommandUser(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.IPAddress = "203.0.113.10"
+	for user, expected := range map[string]string{"": "ubuntu@203.0.113.10", "ec2-user": "ec2-user@203.0.113.10"} {
+		d.SSHUser = user
+
+		cmd, err := d.GetSSHCommand("uptime")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if args := strings.Join(cmd.Args, " "); !strings.Contains(args, expected) {
+			t.Fatalf("expected %s in the SSH command; received %s", expected, args)
+		}
+	}
+}
+
+func TestConfigureSecurityGroupPermissionsCustomSshPort(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.SSHPort = 2222
+	group := securityGroup
+
+	perms := d.configureSecurityGroupPermissions(&group)
+	if len(perms) != 2 || perms[0].FromPort != 2222 {
+		t.Fatalf("expected the SSH permission on port 2222; received %v", perms)
+	}
+}
+
+func TestSetConfigFromFlagsRootVolumeType(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-root-volume-type"] = "io1"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for io1 without IOPS")
+	}
+
+	flags.Data["amazonec2-root-iops"] = 1000
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	flags.Data["amazonec2-root-volume-type"] = "standard"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for IOPS on a standard volume")
+	}
+
+	flags.Data["amazonec2-root-iops"] = 0
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetConfigFromFlagsRootThroughput(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-root-throughput"] = 250
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for throughput on a gp2 volume")
+	}
+
+	flags.Data["amazonec2-root-volume-type"] = "gp3"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if bdms := d.blockDeviceMappings(); bdms[0].Throughput != 250 || bdms[0].VolumeType != "gp3" {
+		t.Fatalf("expected a gp3 root volume with 250 MiB/s; received %+v", bdms[0])
+	}
+
+	for _, throughput := range []int{100, 1001} {
+		flags.Data["amazonec2-root-throughput"] = throughput
+		if err := d.SetConfigFromFlags(flags); err == nil {
+			t.Fatalf("expected an error for a throughput of %d MiB/s", throughput)
+		}
+	}
+}
+
+func TestSetConfigFromFlagsAdditionalVolume(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-additional-volume"] = []string{"/dev/sdb:100:gp2"}
+	flags.Data["amazonec2-docker-data-path"] = "/var/lib/docker"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := AdditionalVolume{DeviceName: "/dev/sdb", Size: 100, VolumeType: "gp2"}
+	if len(d.AdditionalVolumes) != 1 || d.AdditionalVolumes[0] != expected {
+		t.Fatalf("expected %+v; received %+v", expected, d.AdditionalVolumes)
+	}
+
+	for _, volumes := range [][]string{
+		{"/dev/sda1:100:gp2"},
+		{"/dev/sdb:100:gp2", "/dev/sdb:50:gp2"},
+		{"/dev/sdb:100"},
+		{"/dev/sdb:0:gp2"},
+	} {
+		flags.Data["amazonec2-additional-volume"] = volumes
+		if err := d.SetConfigFromFlags(flags); err == nil {
+			t.Fatalf("expected an error for %v", volumes)
+		}
+	}
+}
+
+func TestAssignElasticIP(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"AllocateAddress": {{http.StatusOK, "<AllocateAddressResponse><publicIp>198.51.100.7</publicIp><allocationId>eipalloc-12345</allocationId></AllocateAddressResponse>"}},
+		"DescribeAddresses": {
+			{http.StatusOK, "<DescribeAddressesResponse><addressesSet><item><publicIp>198.51.100.7</publicIp><allocationId>eipalloc-12345</allocationId></item></addressesSet></DescribeAddressesResponse>"},
+			{http.StatusOK, "<DescribeAddressesResponse><addressesSet><item><publicIp>198.51.100.7</publicIp><allocationId>eipalloc-12345</allocationId><associationId>eipassoc-12345</associationId><instanceId>i-12345</instanceId></item></addressesSet></DescribeAddressesResponse>"},
+		},
+		"AssociateAddress": {{http.StatusOK, "<AssociateAddressResponse><associationId>eipassoc-12345</associationId></AssociateAddressResponse>"}},
+	}}
+	d.transport = ec2
+
+	if err := d.assignElasticIP(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.IPAddress != "198.51.100.7" || !d.ElasticIPAllocated || d.ElasticIPAssociationId != "eipassoc-12345" {
+		t.Fatalf("unexpected Elastic IP state: %s %v %s", d.IPAddress, d.ElasticIPAllocated, d.ElasticIPAssociationId)
+	}
+
+	// an address still associated with the instance is not associated again
+	if err := d.assignElasticIP(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ec2.requests("AllocateAddress")) != 1 || len(ec2.requests("AssociateAddress")) != 1 {
+		t.Fatal("expected a single allocation and association")
+	}
+
+	if err := d.releaseElasticIP(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ec2.requests("DisassociateAddress")) != 1 || len(ec2.requests("ReleaseAddress")) != 1 {
+		t.Fatal("expected the allocated address to be released")
+	}
+}
+
+func TestSetConfigFromFlagsPrivateAddressModes(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-use-private-address"] = true
+	flags.Data["amazonec2-private-address-only"] = true
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for both private address modes")
+	}
+}
+
+func TestWaitForIPUsePrivateAddress(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer func(interval time.Duration) { ipAddressPollInterval = interval }(ipAddressPollInterval)
+	ipAddressPollInterval = time.Millisecond
+
+	d.InstanceId = "i-12345"
+	d.UsePrivateAddress = true
+	d.PublicIPAttempts = 3
+	response := func(public string) fakeResponse {
+		return fakeResponse{http.StatusOK, "<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-12345</instanceId><ipAddress>" + public + "</ipAddress><privateIpAddress>10.0.0.5</privateIpAddress></item></instancesSet></item></reservationSet></DescribeInstancesResponse>"}
+	}
+
+	// the private IP is known at once, the public one may still come
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {response(""), response("54.0.0.1")},
+	}}
+
+	if err := d.waitForIP(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.IPAddress != "54.0.0.1" {
+		t.Fatalf("expected the public IP assigned on the second poll; received %q", d.IPAddress)
+	}
+
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {response("")},
+	}}
+	d.transport = ec2
+
+	if err := d.waitForIP(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.IPAddress != "10.0.0.5" || len(ec2.requests("DescribeInstances")) != 3 {
+		t.Fatalf("expected the private IP after 3 polls; received %q after %d", d.IPAddress, len(ec2.requests("DescribeInstances")))
+	}
+}
+
+func TestWaitForIPPublicRequested(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer func(interval time.Duration) { ipAddressPollInterval = interval }(ipAddressPollInterval)
+	ipAddressPollInterval = time.Millisecond
+
+	d.InstanceId = "i-12345"
+	d.PublicIPAttempts = 2
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, "<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-12345</instanceId><privateIpAddress>10.0.0.5</privateIpAddress></item></instancesSet></item></reservationSet></DescribeInstancesResponse>"}},
+	}}
+
+	// the public IP was asked for, its absence is a failure
+	if err := d.waitForIP(); err == nil || !strings.Contains(err.Error(), "no public IP address") {
+		t.Fatalf("expected an error for the missing public IP; received %v", err)
+	}
+
+	// an existing interface does not ask for one
+	d.NetworkInterfaceId = "eni-12345"
+	if err := d.waitForIP(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.IPAddress != "10.0.0.5" {
+		t.Fatalf("expected the private IP; received %q", d.IPAddress)
+	}
+
+	if ip, err := d.GetIP(); err != nil || ip != "10.0.0.5" {
+		t.Fatalf("expected GetIP to return the private IP; received %q (%v)", ip, err)
+	}
+}
+
+func TestPrivateAddressOnly(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.PrivateAddressOnly = true
+	d.InstanceId = "i-12345"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"RunInstances":      {{http.StatusOK, "<RunInstancesResponse><instancesSet><item><instanceId>i-12345</instanceId></item></instancesSet></RunInstancesResponse>"}},
+		"DescribeInstances": {{http.StatusOK, "<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-12345</instanceId><privateIpAddress>10.0.0.5</privateIpAddress></item></instancesSet></item></reservationSet></DescribeInstancesResponse>"}},
+	}}
+	d.transport = ec2
+
+	if _, err := d.runInstance(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := ec2.requests("RunInstances")[0].URL.Query().Get("NetworkInterface.0.AssociatePublicIpAddress"); v != "false" {
+		t.Fatalf("expected no public IP address to be requested; received %q", v)
+	}
+
+	if err := d.waitForIP(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.updateDriver(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ip, err := d.GetIP(); err != nil || ip != "10.0.0.5" || d.IPAddress != "10.0.0.5" {
+		t.Fatalf("expected the private IP address; received %q and %q (%v)", ip, d.IPAddress, err)
+	}
+}
+
+func TestResolveSecurityGroups(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.VpcId = "vpc-12345"
+	d.SecurityGroupId = "sg-11111"
+	d.SecurityGroupNames = []string{"docker-machine", "monitoring", "corporate-ingress"}
+	groups := `<DescribeSecurityGroupsResponse>
+  <securityGroupInfo>
+    <item><groupId>sg-22222</groupId><groupName>monitoring</groupName><vpcId>vpc-12345</vpcId></item>
+    <item><groupId>sg-33333</groupId><groupName>corporate-ingress</groupName><vpcId>vpc-12345</vpcId></item>
+  </securityGroupInfo>
+</DescribeSecurityGroupsResponse>`
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSecurityGroups": {{http.StatusOK, groups}},
+	}}
+
+	if err := d.resolveSecurityGroups(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := strings.Join(d.securityGroupIds(), ","); ids != "sg-11111,sg-22222,sg-33333" {
+		t.Fatalf("unexpected security groups %s", ids)
+	}
+
+	d.SecurityGroupNames = []string{"docker-machine", "missing"}
+	if err := d.resolveSecurityGroups(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected an error naming the missing group; received %v", err)
+	}
+}
+
+func TestSetConfigFromFlagsTagPairs(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-tags"] = []string{"Team,infra,CostCenter,1234", "Environment,dev"}
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.Tags) != 3 || d.Tags["CostCenter"] != "1234" || d.Tags["Environment"] != "dev" {
+		t.Fatalf("unexpected tags %v", d.Tags)
+	}
+
+	for _, value := range []string{"Team,infra,CostCenter", ",infra"} {
+		flags.Data["amazonec2-tags"] = []string{value}
+		if err := d.SetConfigFromFlags(flags); err == nil {
+			t.Fatalf("expected an error for %q", value)
+		}
+	}
+
+	tags := []string{}
+	for i := 0; i < maxTags; i++ {
+		tags = append(tags, fmt.Sprintf("key%d=value", i))
+	}
+
+	flags.Data["amazonec2-tags"] = tags
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for more than 50 tags with the Name tag")
+	}
+}
+
+func TestSetConfigFromFlagsUserData(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	file, err := ioutil.TempFile("", "user-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString("#!/bin/sh\necho hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-user-data"] = file.Name()
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.UserData != "IyEvYmluL3NoCmVjaG8gaGVsbG8K" {
+		t.Fatalf("expected the base64 encoded file; received %q", d.UserData)
+	}
+
+	if err := ioutil.WriteFile(file.Name(), make([]byte, maxUserDataSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for user data over the limit")
+	}
+
+	flags.Data["amazonec2-user-data"] = file.Name() + ".missing"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestSetConfigFromFlagsTenancy(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	// shared tenancy is the EC2 default and is not sent
+	if p := d.placement(); p.Tenancy != "" {
+		t.Fatalf("expected no tenancy in the placement; received %q", p.Tenancy)
+	}
+
+	flags.Data["amazonec2-tenancy"] = "dedicated"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := d.placement(); p.Tenancy != "dedicated" {
+		t.Fatalf("expected dedicated tenancy in the placement; received %q", p.Tenancy)
+	}
+
+	flags.Data["amazonec2-tenancy"] = "shared"
+	err = d.SetConfigFromFlags(flags)
+	if err == nil || !strings.Contains(err.Error(), "default, dedicated or host") {
+		t.Fatalf("expected an error listing the allowed tenancies; received %v", err)
+	}
+}
+
+func TestWaitForInstanceTimeoutAndCancel(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.CreateTimeout = 1
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, describeInstancesResponse("i-12345", "pending")}},
+	}}
+
+	if err := d.waitForInstance(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout error; received %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.ctx = ctx
+
+	if err := d.waitForInstance(); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("expected a cancellation error; received %v", err)
+	}
+}
+
+func TestCreateWaitsCancelled(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	// a listener that never answers, as sshd before it is up
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.ctx = ctx
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	if err := d.waitForTCP(l.Addr().String()); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("expected the TCP wait to be cancelled; received %v", err)
+	}
+
+	if err := d.sleep("the spot instance request", time.Minute); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("expected the sleep to be cancelled; received %v", err)
+	}
+
+	start := time.Now()
+	if err := d.runCommand(exec.Command("sleep", "60")); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("expected the command to be killed; received %v", err)
+	}
+
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("expected the command to be killed at once")
+	}
+}
+
+func TestCreateWaitsShareTheDeadline(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	d.ctx = ctx
+
+	if err := d.sleep("SSH", time.Minute); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected the create deadline to end the sleep; received %v", err)
+	}
+
+	// later waits of the same create have no time left either
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, describeInstancesResponse("i-12345", "pending")}},
+	}}
+	start := time.Now()
+	if err := d.waitForInstance(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout error; received %v", err)
+	}
+
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("expected the wait to end at the create deadline")
+	}
+}
+
+func TestGetActualZone(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, "<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-12345</instanceId><placement><availabilityZone>us-east-1c</availabilityZone></placement></item></instancesSet></item></reservationSet></DescribeInstancesResponse>"}},
+	}}
+	d.transport = ec2
+
+	for i := 0; i < 2; i++ {
+		zone, err := d.GetActualZone()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if zone != "us-east-1c" {
+			t.Fatalf("expected us-east-1c; received %s", zone)
+		}
+	}
+
+	if n := len(ec2.requests("DescribeInstances")); n != 1 {
+		t.Fatalf("expected the zone to be cached; received %d calls", n)
+	}
+}
+
+func TestResolveAMIUbuntuRelease(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.AMI = ""
+	d.UbuntuRelease = "xenial"
+	d.AMIOwners = []string{defaultAMIOwner}
+	images := `<DescribeImagesResponse>
+  <imagesSet>
+    <item><imageId>ami-old</imageId><imageOwnerId>099720109477</imageOwnerId><creationDate>2019-01-01T00:00:00.000Z</creationDate></item>
+    <item><imageId>ami-new</imageId><imageOwnerId>099720109477</imageOwnerId><creationDate>2020-01-01T00:00:00.000Z</creationDate></item>
+  </imagesSet>
+</DescribeImagesResponse>`
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeImages": {{http.StatusOK, images}},
+	}}
+	d.transport = ec2
+
+	if err := d.resolveAMI(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.AMI != "ami-new" {
+		t.Fatalf("expected the newest image; received %s", d.AMI)
+	}
+
+	q := ec2.requests("DescribeImages")[0].URL.Query()
+	if name := q.Get("Filter.1.Value"); name != "ubuntu/images/hvm-ssd*/ubuntu-xenial-*-amd64-server-*" {
+		t.Fatalf("unexpected name filter %q", name)
+	}
+
+	if q.Get("Filter.3.Name") != "architecture" || q.Get("Filter.3.Value") != "x86_64" {
+		t.Fatalf("expected an architecture filter; received %v", q)
+	}
+}
+
+func TestResolveAMIDefaultImageOnlyForCanonical(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.AMI = ""
+	d.Region = "us-east-1"
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeImages": {{http.StatusOK, "<DescribeImagesResponse><imagesSet></imagesSet></DescribeImagesResponse>"}},
+	}}
+
+	d.AMIOwners = []string{defaultAMIOwner}
+	if err := d.resolveAMI(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.AMI != regionDetails["us-east-1"].AmiId {
+		t.Fatalf("expected the default image of the region; received %s", d.AMI)
+	}
+
+	d.AMI = ""
+	d.AMIOwners = []string{"123456789012"}
+	if err := d.resolveAMI(); err == nil {
+		t.Fatalf("expected no Canonical image for a custom owner; received %s", d.AMI)
+	}
+
+	if d.AMI != "" {
+		t.Fatalf("expected no image to be chosen; received %s", d.AMI)
+	}
+}
+
+func TestRunInstanceInsufficientCapacityNextSubnet(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.SubnetIds = []string{"subnet-a", "subnet-b", "subnet-c"}
+	d.SubnetId = "subnet-b"
+	d.subnetZones = map[string]string{"subnet-a": "a", "subnet-b": "b", "subnet-c": "c"}
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"RunInstances": {
+			{http.StatusInternalServerError, errorResponse("InsufficientInstanceCapacity", "We currently do not have sufficient capacity")},
+			{http.StatusOK, "<RunInstancesResponse><instancesSet><item><instanceId>i-12345</instanceId></item></instancesSet></RunInstancesResponse>"},
+		},
+	}}
+	d.transport = ec2
+
+	if _, err := d.runInstance(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := ec2.requests("RunInstances")
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 RunInstances calls; received %d", len(reqs))
+	}
+
+	if subnet := reqs[0].URL.Query().Get("NetworkInterface.0.SubnetId"); subnet != "subnet-b" {
+		t.Fatalf("expected the picked subnet to be tried first; received %s", subnet)
+	}
+
+	if d.SubnetId != "subnet-c" || d.Zone != "c" {
+		t.Fatalf("expected the instance in subnet-c in zone c; received %s in %s", d.SubnetId, d.Zone)
+	}
+
+	first, second := reqs[0].URL.Query().Get("ClientToken"), reqs[1].URL.Query().Get("ClientToken")
+	if first == second {
+		t.Fatal("expected a new client token for the next subnet")
+	}
+}
+
+func TestRunInstanceNextSubnetTokenLength(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.ClientToken = strings.Repeat("t", 64)
+	d.SubnetIds = []string{"subnet-a", "subnet-b"}
+	d.SubnetId = "subnet-a"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"RunInstances": {
+			{http.StatusInternalServerError, errorResponse("InsufficientInstanceCapacity", "We currently do not have sufficient capacity")},
+			{http.StatusOK, "<RunInstancesResponse><instancesSet><item><instanceId>i-12345</instanceId></item></instancesSet></RunInstancesResponse>"},
+		},
+	}}
+	d.transport = ec2
+
+	if _, err := d.runInstance(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := ec2.requests("RunInstances")
+	first, second := reqs[0].URL.Query().Get("ClientToken"), reqs[1].URL.Query().Get("ClientToken")
+	if first != d.ClientToken {
+		t.Fatalf("expected the given token in the first subnet; received %q", first)
+	}
+
+	if second == first || len(second) > 64 {
+		t.Fatalf("expected a distinct token of at most 64 characters; received %q", second)
+	}
+
+	// the same create derives the same token again
+	ec2.Responses["RunInstances"] = []fakeResponse{
+		{http.StatusInternalServerError, errorResponse("InsufficientInstanceCapacity", "We currently do not have sufficient capacity")},
+		{http.StatusOK, "<RunInstancesResponse><instancesSet><item><instanceId>i-12345</instanceId></item></instancesSet></RunInstancesResponse>"},
+	}
+	d.SubnetId = "subnet-a"
+	if _, err := d.runInstance(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if again := ec2.requests("RunInstances")[3].URL.Query().Get("ClientToken"); again != second {
+		t.Fatalf("expected the derived token to be stable; received %q and %q", second, again)
+	}
+}
+
+func TestValidateSubnetsRejectsUnknown(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.VpcId = ""
+	d.Region = "us-east-1"
+	d.SubnetIds = []string{"subnet-gone", "subnet-b"}
+	d.SubnetId = "subnet-gone"
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSubnets": {{http.StatusOK, `<DescribeSubnetsResponse>
+  <subnetSet>
+    <item>
+      <subnetId>subnet-b</subnetId>
+      <availabilityZone>us-east-1b</availabilityZone>
+    </item>
+  </subnetSet>
+</DescribeSubnetsResponse>`}},
+	}}
+
+	if err := d.validateSubnets(); err == nil || !strings.Contains(err.Error(), "subnet-gone") {
+		t.Fatalf("expected an error for the unknown subnet; received %v", err)
+	}
+
+	d.SubnetIds = []string{"subnet-b"}
+	if err := d.validateSubnets(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.SubnetId != "subnet-b" || d.subnetZones["subnet-b"] != "b" {
+		t.Fatalf("expected subnet-b in zone b; received %s", d.SubnetId)
+	}
+}
+
+func TestSetConfigFromFlagsCredentialProfile(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	fmt.Fprint(f, `[default]
+aws_access_key_id = AKIADEFAULT
+aws_secret_access_key = default-secret
+
+# build machines
+[build]
+aws_access_key_id = AKIABUILD
+aws_secret_access_key = build-secret
+aws_session_token = build-token
+`)
+	f.Close()
+
+	defer os.Setenv("AWS_SHARED_CREDENTIALS_FILE", os.Getenv("AWS_SHARED_CREDENTIALS_FILE"))
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", f.Name())
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-access-key"] = ""
+	flags.Data["amazonec2-secret-key"] = ""
+	flags.Data["amazonec2-credential-profile"] = "build"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.AccessKey != "AKIABUILD" || d.SecretKey != "build-secret" || d.SessionToken != "build-token" {
+		t.Fatalf("expected the keys of the build profile; received %s, %s, %s", d.AccessKey, d.SecretKey, d.SessionToken)
+	}
+
+	flags.Data["amazonec2-credential-profile"] = "missing"
+	if err := d.SetConfigFromFlags(flags); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected an error naming the missing profile; received %v", err)
+	}
+}
+
+func TestCheckInstanceTypeOffered(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.Region = "us-east-1"
+	d.Zone = "a"
+	d.SubnetIds = []string{"subnet-12345"}
+	d.InstanceType = "t2.mega"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstanceTypeOfferings": {{http.StatusOK, `<DescribeInstanceTypeOfferingsResponse>
+  <instanceTypeOfferingSet>
+    <item><instanceType>t2.micro</instanceType></item>
+  </instanceTypeOfferingSet>
+</DescribeInstanceTypeOfferingsResponse>`}},
+	}}
+	d.transport = ec2
+
+	if err := d.checkInstanceTypeOffered(); err == nil {
+		t.Fatal("expected an error for an instance type that is not offered")
+	}
+
+	d.InstanceType = "t2.micro"
+	if err := d.checkInstanceTypeOffered(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := ec2.requests("DescribeInstanceTypeOfferings")
+	if len(reqs) != 1 {
+		t.Fatalf("expected the offerings to be looked up once; received %d requests", len(reqs))
+	}
+
+	if location := reqs[0].URL.Query().Get("Filter.1.Value"); location != "us-east-1a" {
+		t.Fatalf("expected the zone to be checked; received %s", location)
+	}
+
+	d.SkipInstanceTypeCheck = true
+	d.InstanceType = "t2.mega"
+	if err := d.checkInstanceTypeOffered(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreatePlacementGroup(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.PlacementGroup = "hpc"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribePlacementGroups": {{http.StatusOK, "<DescribePlacementGroupsResponse><placementGroupSet></placementGroupSet></DescribePlacementGroupsResponse>"}},
+	}}
+	d.transport = ec2
+
+	if err := d.checkPlacementGroup(); err == nil {
+		t.Fatal("expected an error for a missing placement group")
+	}
+
+	// the check has no side effects, it also runs from PreCreateCheck
+	d.CreatePlacementGroup = true
+	if err := d.checkPlacementGroup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ec2.requests("CreatePlacementGroup")); n != 0 {
+		t.Fatalf("expected the check not to create the group; received %d requests", n)
+	}
+
+	if err := d.createPlacementGroup(); err != nil {
+		t.Fatal(err)
+	}
+
+	creates := ec2.requests("CreatePlacementGroup")
+	if len(creates) != 1 || creates[0].URL.Query().Get("Strategy") != "cluster" {
+		t.Fatalf("expected the group to be created with the cluster strategy; received %d requests", len(creates))
+	}
+
+	if !d.PlacementGroupCreated {
+		t.Fatal("expected the group to be recorded as created")
+	}
+
+	if group := d.placement().GroupName; group != "hpc" {
+		t.Fatalf("expected the instance to be placed in hpc; received %q", group)
+	}
+}
+
+func TestCreatePlacementGroupStrategy(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.PlacementGroup = "hpc"
+	d.CreatePlacementGroup = true
+	d.PlacementStrategy = "partition"
+	d.PartitionCount = 3
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribePlacementGroups": {{http.StatusOK, "<DescribePlacementGroupsResponse><placementGroupSet></placementGroupSet></DescribePlacementGroupsResponse>"}},
+	}}
+	d.transport = ec2
+
+	if err := d.checkPlacementGroup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.createPlacementGroup(); err != nil {
+		t.Fatal(err)
+	}
+
+	q := ec2.requests("CreatePlacementGroup")[0].URL.Query()
+	if q.Get("Strategy") != "partition" || q.Get("PartitionCount") != "3" {
+		t.Fatalf("expected a group with 3 partitions; received %v", q)
+	}
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribePlacementGroups": {{http.StatusOK, "<DescribePlacementGroupsResponse><placementGroupSet><item><groupName>hpc</groupName><strategy>spread</strategy></item></placementGroupSet></DescribePlacementGroupsResponse>"}},
+	}}
+
+	d.PlacementGroupCreated = false
+	if err := d.checkPlacementGroup(); err == nil {
+		t.Fatal("expected an error for an existing group with another strategy")
+	}
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribePlacementGroups": {{http.StatusOK, "<DescribePlacementGroupsResponse><placementGroupSet><item><groupName>hpc</groupName><strategy>partition</strategy><partitionCount>2</partitionCount></item></placementGroupSet></DescribePlacementGroupsResponse>"}},
+	}}
+
+	if err := d.checkPlacementGroup(); err == nil || !strings.Contains(err.Error(), "2 partitions") {
+		t.Fatalf("expected an error for an existing group with another partition count; received %v", err)
+	}
+
+	d.PartitionCount = 2
+	if err := d.checkPlacementGroup(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetConfigFromFlagsPlacementStrategy(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-placement-strategy"] = "spread"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for a strategy without a placement group")
+	}
+
+	flags.Data["amazonec2-placement-group"] = "hpc"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	flags.Data["amazonec2-partition-count"] = 3
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for a partition count with the spread strategy")
+	}
+
+	flags.Data["amazonec2-placement-strategy"] = "partition"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	flags.Data["amazonec2-partition-count"] = 8
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for 8 partitions")
+	}
+
+	flags.Data["amazonec2-partition-count"] = 0
+	flags.Data["amazonec2-placement-strategy"] = "packed"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for an unknown strategy")
+	}
+}
+
+func TestDeletePlacementGroupKeptInUse(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.PlacementGroup = "hpc"
+	d.PlacementGroupCreated = true
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {
+			{http.StatusOK, describeInstancesResponse("i-67890", "running")},
+			{http.StatusOK, describeInstancesResponse("i-67890", "terminated")},
+		},
+	}}
+	d.transport = ec2
+
+	if err := d.deletePlacementGroup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ec2.requests("DeletePlacementGroup")); n != 0 {
+		t.Fatalf("expected the group to be kept while another instance uses it; received %d deletes", n)
+	}
+
+	if err := d.deletePlacementGroup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ec2.requests("DeletePlacementGroup")); n != 1 {
+		t.Fatalf("expected the empty group to be deleted; received %d deletes", n)
+	}
+}
+
+func TestDockerPortConfigurable(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-docker-port"] = 12376
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	d.IPAddress = "203.0.113.10"
+	if url, _ := d.GetURL(); url != "tcp://203.0.113.10:12376" {
+		t.Fatalf("expected the URL on port 12376; received %s", url)
+	}
+
+	perms := d.configureSecurityGroupPermissions(&amz.SecurityGroup{})
+	found := false
+	for _, p := range perms {
+		if p.FromPort == 12376 {
+			found = true
+		}
+		if p.FromPort == testDockerPort {
+			t.Fatal("expected the default Docker port not to be opened")
+		}
+	}
+
+	if !found {
+		t.Fatalf("expected port 12376 to be opened; received %v", perms)
+	}
+
+	d.DockerPort = 0
+	if url, _ := d.GetURL(); url != "tcp://203.0.113.10:2376" {
+		t.Fatalf("expected machines without a port to use 2376; received %s", url)
+	}
+}
+
+func TestConfigureSecurityGroupPermissionsOpenPortCidrs(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-open-port-cidr"] = []string{"198.51.100.0/24", "203.0.113.7"}
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	ec2 := &fakeEC2{}
+	d.transport = ec2
+
+	perms := d.configureSecurityGroupPermissions(&amz.SecurityGroup{})
+	if err := d.getClient().AuthorizeSecurityGroup("sg-12345", perms); err != nil {
+		t.Fatal(err)
+	}
+
+	requested := map[string][]string{}
+	q := ec2.requests("AuthorizeSecurityGroupIngress")[0].URL.Query()
+	for i := 1; q.Get(fmt.Sprintf("IpPermissions.%d.FromPort", i)) != ""; i++ {
+		port := q.Get(fmt.Sprintf("IpPermissions.%d.FromPort", i))
+		requested[port] = append(requested[port], q.Get(fmt.Sprintf("IpPermissions.%d.IpRanges.1.CidrIp", i)))
+	}
+
+	for _, port := range []string{"22", "2376"} {
+		ranges := requested[port]
+		if len(ranges) != 2 || !containsString(ranges, "198.51.100.0/24") || !containsString(ranges, "203.0.113.7/32") {
+			t.Fatalf("expected port %s to be opened to both blocks; received %v", port, ranges)
+		}
+	}
+
+	if containsString(requested["22"], ipRange) {
+		t.Fatal("expected the port not to be opened to everyone")
+	}
+
+	flags.Data["amazonec2-open-port-cidr"] = []string{"office"}
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for an invalid CIDR block")
+	}
+}
+
+func TestConfigureSecurityGroupPermissionsOpenPorts(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-open-port"] = []string{"8080", "9000/tcp", "53/UDP"}
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	group := securityGroup
+	group.IpPermissions = []amz.IpPermission{
+		{IpProtocol: "tcp", FromPort: testSshPort, ToPort: testSshPort},
+		{IpProtocol: "tcp", FromPort: testDockerPort, ToPort: testDockerPort},
+		{IpProtocol: "tcp", FromPort: 9000, ToPort: 9000},
+	}
+
+	perms := d.configureSecurityGroupPermissions(&group)
+	if len(perms) != 2 {
+		t.Fatalf("expected 2 permissions; received %v", perms)
+	}
+
+	if perms[0].FromPort != 8080 || perms[0].IpProtocol != "tcp" {
+		t.Fatalf("expected 8080/tcp; received %d/%s", perms[0].FromPort, perms[0].IpProtocol)
+	}
+
+	if perms[1].FromPort != 53 || perms[1].IpProtocol != "udp" {
+		t.Fatalf("expected 53/udp; received %d/%s", perms[1].FromPort, perms[1].IpProtocol)
+	}
+
+	flags.Data["amazonec2-open-port"] = []string{"8080/sctp"}
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for an unsupported protocol")
+	}
+}
+
+func TestHibernateRequirements(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-hibernate"] = true
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error without an encrypted root volume")
+	}
+
+	flags.Data["amazonec2-encrypt-ebs-volume"] = true
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstanceTypes": {{http.StatusOK, `<DescribeInstanceTypesResponse>
+  <instanceTypeSet>
+    <item>
+      <instanceType>t1.micro</instanceType>
+      <hibernationSupported>false</hibernationSupported>
+    </item>
+  </instanceTypeSet>
+</DescribeInstanceTypesResponse>`}},
+	}}
+
+	if err := d.checkHibernation(); err == nil {
+		t.Fatal("expected an error for an instance type without hibernation support")
+	}
+}
+
+func TestStopHibernates(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.Hibernate = true
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, describeInstancesResponse("i-12345", "stopped")}},
+	}}
+	d.transport = ec2
+
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	stops := ec2.requests("StopInstances")
+	if len(stops) != 1 || stops[0].URL.Query().Get("Hibernate") != "true" {
+		t.Fatal("expected the instance to be hibernated")
+	}
+}
+
+func TestGetStateTerminated(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, describeInstancesResponse("i-12345", "terminated")}},
+	}}
+
+	st, err := d.GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st != state.None {
+		t.Fatalf("expected no state for a terminated instance; received %s", st)
+	}
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusBadRequest, errorResponse("InvalidInstanceID.NotFound", "The instance ID 'i-12345' does not exist")}},
+	}}
+
+	st, err = d.GetState()
+	if err != nil {
+		t.Fatalf("expected no error for an instance that no longer exists; received %s", err)
+	}
+
+	if st != state.None {
+		t.Fatalf("expected no state for a missing instance; received %s", st)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.VpcId = "vpc-12345"
+	d.SecurityGroupName = "docker-machine"
+	d.KeyName = "test-host"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSecurityGroups": {{http.StatusOK, `<DescribeSecurityGroupsResponse>
+  <securityGroupInfo>
+    <item>
+      <groupId>sg-12345</groupId>
+      <groupName>docker-machine</groupName>
+      <vpcId>vpc-12345</vpcId>
+    </item>
+  </securityGroupInfo>
+</DescribeSecurityGroupsResponse>`}},
+		"RunInstances": {{http.StatusPreconditionFailed, errorResponse("DryRunOperation", "Request would have succeeded, but DryRun flag is set.")}},
+	}}
+	d.transport = ec2
+
+	if err := d.dryRun(); err != nil {
+		t.Fatalf("expected the dry run to succeed; received %v", err)
+	}
+
+	q := ec2.requests("RunInstances")[0].URL.Query()
+	if q.Get("DryRun") != "true" {
+		t.Fatal("expected the launch to be a dry run")
+	}
+
+	if _, ok := q["KeyName"]; ok {
+		t.Fatal("expected no key pair that does not exist yet")
+	}
+
+	if q.Get("NetworkInterface.0.SecurityGroupId.0") != "sg-12345" {
+		t.Fatalf("expected the existing security group; received %v", q)
+	}
+
+	for _, action := range []string{"CreateKeyPair", "ImportKeyPair", "CreateSecurityGroup", "CreateTags"} {
+		if n := len(ec2.requests(action)); n != 0 {
+			t.Fatalf("expected nothing to be created; received %d %s requests", n, action)
+		}
+	}
+
+	ec2.Responses["RunInstances"] = []fakeResponse{{http.StatusBadRequest, errorResponse("InvalidAMIID.NotFound", "The image id '[ami-12345]' does not exist")}}
+	if err := d.dryRun(); err == nil {
+		t.Fatalf("expected the dry run to fail; received %v", err)
+	}
+}
+
+func TestCustomEndpoint(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-region"] = "local-1"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for an unknown region without an endpoint")
+	}
+
+	flags.Data["amazonec2-endpoint"] = "http://localhost:4566"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	ec2 := &fakeEC2{}
+	d.transport = ec2
+	if err := d.getClient().StartInstance("i-12345"); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := ec2.requests("StartInstances")
+	if len(reqs) == 0 || reqs[0].URL.Host != "localhost:4566" {
+		t.Fatalf("expected the request to go to the custom endpoint; received %v", reqs)
+	}
+
+	flags.Data["amazonec2-endpoint"] = "localhost:4566"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for an endpoint without a scheme")
+	}
+}
+
+func TestConfigureSecurityGroupCreationSkipped(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.VpcId = "vpc-12345"
+	d.SkipSecurityGroupCreation = true
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSecurityGroups": {{http.StatusOK, "<DescribeSecurityGroupsResponse><securityGroupInfo></securityGroupInfo></DescribeSecurityGroupsResponse>"}},
+	}}
+	d.transport = ec2
+
+	err = d.configureSecurityGroup("docker-machine")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected a not found error; received %v", err)
+	}
+
+	if n := len(ec2.requests("CreateSecurityGroup")); n != 0 {
+		t.Fatalf("expected no CreateSecurityGroup request; received %d", n)
+	}
+}
+
+func TestConfigureSecurityGroupTagsCreatedGroup(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.VpcId = "vpc-12345"
+	d.MachineName = "test"
+	d.Tags = map[string]string{"CostCenter": "42"}
+	group := `<DescribeSecurityGroupsResponse><securityGroupInfo><item><groupId>sg-12345</groupId><groupName>docker-machine</groupName><vpcId>vpc-12345</vpcId></item></securityGroupInfo></DescribeSecurityGroupsResponse>`
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSecurityGroups": {
+			{http.StatusOK, "<DescribeSecurityGroupsResponse><securityGroupInfo></securityGroupInfo></DescribeSecurityGroupsResponse>"},
+			{http.StatusOK, group},
+		},
+		"CreateSecurityGroup": {{http.StatusOK, "<CreateSecurityGroupResponse><groupId>sg-12345</groupId></CreateSecurityGroupResponse>"}},
+		"CreateTags":          {{http.StatusOK, "<CreateTagsResponse><return>true</return></CreateTagsResponse>"}},
+	}}
+	d.transport = ec2
+
+	if err := d.configureSecurityGroup("docker-machine"); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := ec2.requests("CreateTags")
+	if len(reqs) != 1 {
+		t.Fatalf("expected the created group to be tagged once; received %d CreateTags", len(reqs))
+	}
+
+	q := reqs[0].URL.Query()
+	tags := map[string]string{q.Get("Tag.1.Key"): q.Get("Tag.1.Value"), q.Get("Tag.2.Key"): q.Get("Tag.2.Value")}
+	if q.Get("ResourceId.1") != "sg-12345" || tags["CostCenter"] != "42" || tags["Name"] != "test" {
+		t.Fatalf("expected the machine tags on sg-12345; received %v", q)
+	}
+}
+
+func TestClientReused(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.transport = &fakeEC2{}
+
+	client := d.getClient()
+	if d.getClient() != client {
+		t.Fatal("expected the client to be reused")
+	}
+
+	d.Region = "eu-west-1"
+	regional := d.getClient()
+	if regional == client || regional.Region != "eu-west-1" {
+		t.Fatal("expected a new client after the region changed")
+	}
+
+	d.SecretKey = "rotated"
+	rotated := d.getClient()
+	if rotated == regional {
+		t.Fatal("expected a new client after the credentials changed")
+	}
+
+	d.transport = &fakeEC2{}
+	transported := d.getClient()
+	if transported == rotated || transported.Transport != d.transport {
+		t.Fatal("expected a new client after the transport changed")
+	}
+
+	d.clientRefresh = time.Now().Add(-time.Minute)
+	if d.getClient() == transported {
+		t.Fatal("expected a new client once the credentials are due to be refreshed")
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestClientWithUncomparableTransport(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	fake := &fakeEC2{}
+	d.transport = roundTripperFunc(fake.RoundTrip)
+
+	// comparing the transport must not panic
+	d.getClient()
+	if d.getClient().Transport == nil {
+		t.Fatal("expected the client to use the transport")
+	}
+}
+
+func TestDryRunDoesNotChangeSharedClient(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"RunInstances": {{http.StatusPreconditionFailed, errorResponse("DryRunOperation", "Request would have succeeded, but DryRun flag is set.")}},
+	}}
+	d.DryRun = true
+
+	d.dryRun()
+
+	if d.getClient().DryRun {
+		t.Fatal("expected the dry run to leave the shared client alone")
+	}
+}
+
+func TestConfigureSecurityGroupPermissionsAssignIpv6(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	perms := d.configureSecurityGroupPermissions(&amz.SecurityGroup{})
+	for _, p := range perms {
+		if p.IpRange != ipRange {
+			t.Fatalf("expected only %s without IPv6; received %s", ipRange, p.IpRange)
+		}
+	}
+
+	d.AssignIpv6 = true
+	perms = d.configureSecurityGroupPermissions(&amz.SecurityGroup{})
+
+	ranges := map[int][]string{}
+	for _, p := range perms {
+		ranges[p.FromPort] = append(ranges[p.FromPort], p.IpRange)
+	}
+
+	for _, port := range []int{22, 2376} {
+		if len(ranges[port]) != 2 || !containsString(ranges[port], ipRange) || !containsString(ranges[port], ipv6Range) {
+			t.Fatalf("expected port %d to be opened to %s and %s; received %v", port, ipRange, ipv6Range, ranges[port])
+		}
+	}
+}
+
+func TestGetIPv6(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, `<DescribeInstancesResponse>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-12345</instanceId>
+          <networkInterfaceSet>
+            <item>
+              <attachment><deviceIndex>1</deviceIndex></attachment>
+              <ipv6AddressesSet><item><ipv6Address>2001:db8::2</ipv6Address></item></ipv6AddressesSet>
+            </item>
+            <item>
+              <attachment><deviceIndex>0</deviceIndex></attachment>
+              <ipv6AddressesSet><item><ipv6Address>2001:db8::1</ipv6Address></item></ipv6AddressesSet>
+            </item>
+          </networkInterfaceSet>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`}},
+	}}
+
+	ip, err := d.GetIPv6()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip != "2001:db8::1" {
+		t.Fatalf("expected the address of the primary interface; received %q", ip)
+	}
+}
+
+func TestDisableSourceDestCheck(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"ModifyInstanceAttribute": {{http.StatusBadRequest, errorResponse("UnauthorizedOperation", "You are not authorized to perform this operation.")}},
+	}}
+
+	err = d.disableSourceDestCheck()
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatalf("expected the AWS error to be surfaced; received %v", err)
+	}
+}
+
+func TestResizeRootVolumeCannotShrink(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, `<DescribeInstancesResponse>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-12345</instanceId>
+          <rootDeviceName>/dev/sda1</rootDeviceName>
+          <blockDeviceMapping>
+            <item><deviceName>/dev/sda1</deviceName><ebs><volumeId>vol-12345</volumeId></ebs></item>
+          </blockDeviceMapping>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`}},
+		"DescribeVolumes": {{http.StatusOK, `<DescribeVolumesResponse>
+  <volumeSet>
+    <item><volumeId>vol-12345</volumeId><size>32</size></item>
+  </volumeSet>
+</DescribeVolumesResponse>`}},
+	}}
+	d.transport = ec2
+
+	if err := d.ResizeRootVolume(16, false); err == nil {
+		t.Fatal("expected an error when shrinking the root volume")
+	}
+
+	if err := d.ResizeRootVolume(32, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ec2.requests("ModifyVolume")); n != 0 {
+		t.Fatalf("expected the volume to be left alone; received %d ModifyVolume requests", n)
+	}
+}
+
+func TestWaitForVolumeModificationUsable(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer func(interval time.Duration) { volumeModificationPollInterval = interval }(volumeModificationPollInterval)
+	volumeModificationPollInterval = time.Millisecond
+
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeVolumesModifications": {
+			{http.StatusOK, `<DescribeVolumesModificationsResponse><volumeModificationSet><item><modificationState>modifying</modificationState></item></volumeModificationSet></DescribeVolumesModificationsResponse>`},
+			{http.StatusOK, `<DescribeVolumesModificationsResponse><volumeModificationSet><item><modificationState>optimizing</modificationState></item></volumeModificationSet></DescribeVolumesModificationsResponse>`},
+		},
+	}}
+	d.transport = ec2
+
+	if err := d.WaitForVolumeModification("vol-12345", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ec2.requests("DescribeVolumesModifications")); n != 2 {
+		t.Fatalf("expected to stop polling once optimizing; received %d polls", n)
+	}
+}
+
+func TestWaitForVolumeModificationNotListedYet(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer func(interval time.Duration) { volumeModificationPollInterval = interval }(volumeModificationPollInterval)
+	volumeModificationPollInterval = time.Millisecond
+
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeVolumesModifications": {
+			{http.StatusOK, `<DescribeVolumesModificationsResponse><volumeModificationSet></volumeModificationSet></DescribeVolumesModificationsResponse>`},
+			{http.StatusOK, `<DescribeVolumesModificationsResponse><volumeModificationSet><item><modificationState>completed</modificationState><targetSize>16</targetSize></item></volumeModificationSet></DescribeVolumesModificationsResponse>`},
+			{http.StatusOK, `<DescribeVolumesModificationsResponse><volumeModificationSet><item><modificationState>optimizing</modificationState><targetSize>32</targetSize></item></volumeModificationSet></DescribeVolumesModificationsResponse>`},
+		},
+	}}
+	d.transport = ec2
+
+	// a modification that was just requested may not be listed yet, nor
+	// replace an earlier one in the listing
+	if err := d.waitForVolumeModification("vol-12345", 32, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ec2.requests("DescribeVolumesModifications")); n != 3 {
+		t.Fatalf("expected to poll until the modification is listed; received %d polls", n)
+	}
+}
+
+func TestWaitForVolumeModificationTimeout(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	defer func(interval time.Duration) { volumeModificationPollInterval = interval }(volumeModificationPollInterval)
+	volumeModificationPollInterval = time.Millisecond
+	d.CreateTimeout = 1
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeVolumesModifications": {
+			{http.StatusOK, `<DescribeVolumesModificationsResponse><volumeModificationSet><item><modificationState>modifying</modificationState></item></volumeModificationSet></DescribeVolumesModificationsResponse>`},
+		},
+	}}
+
+	if err := d.WaitForVolumeModification("vol-12345", true); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected the wait to time out; received %v", err)
+	}
+}
+
+func TestGetInstanceInfo(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, `<DescribeInstancesResponse>
+  <reservationSet>
+    <item>
+      <reservationId>r-12345</reservationId>
+      <instancesSet>
+        <item>
+          <instanceId>i-12345</instanceId>
+          <imageId>ami-12345</imageId>
+          <instanceState><name>running</name></instanceState>
+          <instanceType>m5.large</instanceType>
+          <launchTime>2020-01-02T03:04:05.000Z</launchTime>
+          <placement><availabilityZone>us-east-1e</availabilityZone></placement>
+          <subnetId>subnet-12345</subnetId>
+          <vpcId>vpc-12345</vpcId>
+          <ipAddress>203.0.113.7</ipAddress>
+          <privateIpAddress>10.0.0.5</privateIpAddress>
+          <groupSet><item><groupId>sg-12345</groupId></item></groupSet>
+          <networkInterfaceSet>
+            <item>
+              <groupSet><item><groupId>sg-12345</groupId></item><item><groupId>sg-67890</groupId></item></groupSet>
+              <privateIpAddressesSet>
+                <item><privateIpAddress>10.0.0.5</privateIpAddress><primary>true</primary></item>
+                <item><privateIpAddress>10.0.0.6</privateIpAddress><primary>false</primary></item>
+              </privateIpAddressesSet>
+              <ipv6AddressesSet><item><ipv6Address>2001:db8::1</ipv6Address></item></ipv6AddressesSet>
+            </item>
+          </networkInterfaceSet>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`}},
+	}}
+	d.transport = ec2
+
+	info, err := d.GetInstanceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ec2.requests("DescribeInstances")); n != 1 {
+		t.Fatalf("expected a single DescribeInstances call; received %d", n)
+	}
+
+	if info.InstanceId != "i-12345" || info.InstanceType != "m5.large" || info.AMI != "ami-12345" || info.State != state.Running {
+		t.Fatalf("unexpected instance details %+v", info)
+	}
+
+	if info.Zone != "us-east-1e" || info.SubnetId != "subnet-12345" || info.VpcId != "vpc-12345" || info.Region != "us-east-1" {
+		t.Fatalf("unexpected placement %+v", info)
+	}
+
+	if info.PublicIPAddress != "203.0.113.7" || len(info.PrivateIPAddresses) != 2 || info.PrivateIPAddresses[0] != "10.0.0.5" {
+		t.Fatalf("unexpected addresses %+v", info)
+	}
+
+	if len(info.SecurityGroupIds) != 2 || len(info.IPv6Addresses) != 1 {
+		t.Fatalf("unexpected groups or IPv6 addresses %+v", info)
+	}
+
+	if !info.LaunchTime.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected launch time %s", info.LaunchTime)
+	}
+}
+
+func TestRootDeviceNameFromImage(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeImages": {{http.StatusOK, `<DescribeImagesResponse>
+  <imagesSet>
+    <item><imageId>ami-12345</imageId><rootDeviceType>ebs</rootDeviceType><rootDeviceName>/dev/xvda</rootDeviceName></item>
+  </imagesSet>
+</DescribeImagesResponse>`}},
+	}}
+
+	if bdms := d.blockDeviceMappings(); bdms[0].DeviceName != "/dev/sda1" {
+		t.Fatalf("expected /dev/sda1 before the image is resolved; received %s", bdms[0].DeviceName)
+	}
+
+	if err := d.resolveAMI(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bdms := d.blockDeviceMappings(); bdms[0].DeviceName != "/dev/xvda" || bdms[0].VolumeSize != d.RootSize {
+		t.Fatalf("expected the root volume on the device of the image; received %+v", bdms[0])
+	}
+
+	d.RootDeviceName = "/dev/sda1"
+	if err := d.resolveAMI(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bdms := d.blockDeviceMappings(); bdms[0].DeviceName != "/dev/sda1" {
+		t.Fatalf("expected --amazonec2-root-device-name to win over the image; received %s", bdms[0].DeviceName)
+	}
+}
+
+func TestStopWaitsForStopped(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {
+			{http.StatusOK, describeInstancesResponse("i-12345", "stopping")},
+			{http.StatusOK, describeInstancesResponse("i-12345", "stopped")},
+		},
+	}}
+	d.transport = ec2
+
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ec2.requests("DescribeInstances")); n != 2 {
+		t.Fatalf("expected Stop to poll until the instance stopped; received %d polls", n)
+	}
+
+	ec2 = &fakeEC2{}
+	d.transport = ec2
+
+	if err := d.StopNoWait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ec2.requests("StopInstances")) != 1 || len(ec2.requests("DescribeInstances")) != 0 {
+		t.Fatal("expected StopNoWait to return right after the stop request")
+	}
+}
+
+func TestSetConfigFromFlagsNetworkInterface(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-network-interface-id"] = "eni-12345"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for an interface combined with a subnet")
+	}
+
+	flags.Data["amazonec2-subnet-id"] = ""
+	flags.Data["amazonec2-vpc-id"] = ""
+	flags.Data["amazonec2-security-group"] = machineSecurityGroupName
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	flags.Data["amazonec2-security-group"] = "custom"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for an interface combined with a security group")
+	}
+
+	flags.Data["amazonec2-security-group"] = machineSecurityGroupName
+	flags.Data["amazonec2-network-interface-id"] = "12345"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for a malformed interface ID")
+	}
+}
+
+func TestLoadNetworkInterface(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.NetworkInterfaceId = "eni-12345"
+	d.VpcId = ""
+	eni := func(status string) fakeResponse {
+		return fakeResponse{http.StatusOK, `<DescribeNetworkInterfacesResponse>
+  <networkInterfaceSet>
+    <item>
+      <networkInterfaceId>eni-12345</networkInterfaceId>
+      <subnetId>subnet-eni</subnetId>
+      <vpcId>vpc-eni</vpcId>
+      <availabilityZone>us-east-1c</availabilityZone>
+      <status>` + status + `</status>
+      <groupSet><item><groupId>sg-eni</groupId></item></groupSet>
+    </item>
+  </networkInterfaceSet>
+</DescribeNetworkInterfacesResponse>`}
+	}
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeNetworkInterfaces": {eni("in-use")},
+	}}
+
+	if err := d.loadNetworkInterface(); err == nil {
+		t.Fatal("expected an error for an interface that is in use")
+	}
+
+	d.transport = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeNetworkInterfaces": {eni("available")},
+	}}
+
+	if err := d.loadNetworkInterface(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.SubnetId != "subnet-eni" || d.VpcId != "vpc-eni" || d.Zone != "c" {
+		t.Fatalf("expected the network of the interface; received %s %s %s", d.VpcId, d.SubnetId, d.Zone)
+	}
+
+	if len(d.SecurityGroupIds) != 1 || d.SecurityGroupIds[0] != "sg-eni" || d.SecurityGroupId != "" {
+		t.Fatalf("expected the groups of the interface without a managed group; received %v %q", d.SecurityGroupIds, d.SecurityGroupId)
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	for _, valid := range []string{"web-01", "web-01.prod.internal", "a"} {
+		if err := validateHostname(valid); err != nil {
+			t.Fatalf("expected %q to be valid; received %s", valid, err)
+		}
+	}
+
+	for _, invalid := range []string{"", "-web", "web-", "web_01", "web..internal", "web.internal.", strings.Repeat("a", 64)} {
+		if err := validateHostname(invalid); err == nil {
+			t.Fatalf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestSetConfigFromFlagsHostname(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := getDefaultTestDriverFlags()
+	flags.Data["amazonec2-hostname"] = "web-01.prod.internal"
+	if err := d.SetConfigFromFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	flags.Data["amazonec2-skip-hostname"] = true
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for a hostname that is skipped")
+	}
+
+	flags.Data["amazonec2-skip-hostname"] = false
+	flags.Data["amazonec2-hostname"] = "web 01"
+	if err := d.SetConfigFromFlags(flags); err == nil {
+		t.Fatal("expected an error for an illegal hostname")
+	}
+}
+
+func TestRebootAndWait(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sshd drops the next connections without a greeting while rebooting
+	var rebooting int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&rebooting, -1) < 0 {
+				conn.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	d.InstanceId = "i-12345"
+	d.IPAddress = "127.0.0.1"
+	d.SSHPort = listener.Addr().(*net.TCPAddr).Port
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, describeInstancesResponse("i-12345", "running")}},
+	}}
+	d.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Query().Get("Action") == "RebootInstances" {
+			atomic.StoreInt32(&rebooting, 1)
+		}
+		return ec2.RoundTrip(req)
+	})
+
+	if err := d.RebootAndWait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ec2.requests("RebootInstances")) != 1 {
+		t.Fatal("expected the instance to be rebooted")
+	}
+	if atomic.LoadInt32(&rebooting) >= 0 {
+		t.Fatal("expected to wait for sshd to go down")
+	}
+
+	// sshd never goes down, the reboot did not happen
+	atomic.StoreInt32(&rebooting, -1<<30)
+	d.transport = ec2
+	d.CreateTimeout = 1
+
+	err = d.RebootAndWait()
+	if err == nil || !strings.Contains(err.Error(), "the instance to go down") {
+		t.Fatalf("expected a timeout waiting for the reboot; received %v", err)
+	}
+
+	// the instance never answers on SSH again
+	listener.Close()
+
+	err = d.RebootAndWait()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout; received %v", err)
+	}
+}
+
+func TestFindSecurityGroupUsesSavedId(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	group := func(id, name string) string {
+		return `<DescribeSecurityGroupsResponse>
+  <securityGroupInfo>
+    <item><groupId>` + id + `</groupId><groupName>` + name + `</groupName></item>
+  </securityGroupInfo>
+</DescribeSecurityGroupsResponse>`
+	}
+
+	d.SecurityGroupId = "sg-12345"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSecurityGroups": {{http.StatusOK, group("sg-12345", "docker-machine")}},
+	}}
+	d.transport = ec2
+
+	found, err := d.findSecurityGroup("docker-machine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := ec2.requests("DescribeSecurityGroups")
+	if found == nil || found.GroupId != "sg-12345" || len(reqs) != 1 || reqs[0].URL.Query().Get("Filter.1.Value") != "sg-12345" {
+		t.Fatalf("expected a single lookup of the saved group; received %v after %d requests", found, len(reqs))
+	}
+
+	// the saved group was deleted and recreated under a new ID
+	ec2 = &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeSecurityGroups": {
+			{http.StatusOK, "<DescribeSecurityGroupsResponse><securityGroupInfo></securityGroupInfo></DescribeSecurityGroupsResponse>"},
+			{http.StatusOK, group("sg-67890", "docker-machine")},
+		},
+	}}
+	d.transport = ec2
+
+	found, err = d.findSecurityGroup("docker-machine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs = ec2.requests("DescribeSecurityGroups")
+	if found == nil || found.GroupId != "sg-67890" || len(reqs) != 2 || reqs[1].URL.Query().Get("Filter.1.Name") != "" {
+		t.Fatalf("expected the stale ID to fall back to the listing; received %v after %d requests", found, len(reqs))
+	}
+}
+
+func TestTagVolumes(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances": {{http.StatusOK, `<DescribeInstancesResponse>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-12345</instanceId>
+          <blockDeviceMapping>
+            <item><deviceName>/dev/sda1</deviceName><ebs><volumeId>vol-root</volumeId></ebs></item>
+            <item><deviceName>/dev/sdb</deviceName><ebs><volumeId>vol-data</volumeId></ebs></item>
+          </blockDeviceMapping>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`}},
+		"CreateTags": {{http.StatusOK, "<CreateTagsResponse><return>true</return></CreateTagsResponse>"}},
+	}}
+	d.transport = ec2
+
+	if err := d.tagVolumes(map[string]string{"CostCenter": "42"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := []string{}
+	for _, req := range ec2.requests("CreateTags") {
+		q := req.URL.Query()
+		if q.Get("Tag.1.Key") != "CostCenter" || q.Get("Tag.1.Value") != "42" {
+			t.Fatalf("unexpected tags %v", q)
+		}
+		tagged = append(tagged, q.Get("ResourceId.1"))
+	}
+
+	if len(tagged) != 2 || !containsString(tagged, "vol-root") || !containsString(tagged, "vol-data") {
+		t.Fatalf("expected both volumes to be tagged; received %v", tagged)
+	}
+}
+
+func TestRecreateLooksUpSavedSecurityGroup(t *testing.T) {
+	d, err := getTestDriver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	d.InstanceId = "i-12345"
+	d.SecurityGroupId = "sg-12345"
+	d.SecurityGroupName = "docker-machine"
+	ec2 := &fakeEC2{Responses: map[string][]fakeResponse{
+		"DescribeInstances":      {{http.StatusOK, describeInstancesResponse("i-12345", "terminated")}},
+		"DescribeSecurityGroups": {{http.StatusOK, "<DescribeSecurityGroupsResponse><securityGroupInfo><item><groupId>sg-12345</groupId><groupName>docker-machine</groupName></item></securityGroupInfo></DescribeSecurityGroupsResponse>"}},
+		// stops the recreate once the group is resolved
+		"RunInstances": {{http.StatusBadRequest, errorResponse("InvalidParameterValue", "stop here")}},
+	}}
+	d.transport = ec2
+
+	if err := d.Recreate(); err == nil || !strings.Contains(err.Error(), "stop here") {
+		t.Fatalf("expected the launch to fail; received %v", err)
+	}
+
+	reqs := ec2.requests("DescribeSecurityGroups")
+	if len(reqs) != 1 || reqs[0].URL.Query().Get("Filter.1.Value") != "sg-12345" {
+		t.Fatalf("expected a single lookup of the saved group; received %d requests", len(reqs))
+	}
+
+	if group := ec2.requests("RunInstances")[0].URL.Query().Get("NetworkInterface.0.SecurityGroupId.0"); group != "sg-12345" {
+		t.Fatalf("expected the instance in the saved group; received %q", group)
+	}
+}
@@ -0,0 +1,27 @@
+package amz
+
+type Address struct {
+	PublicIp      string `xml:"publicIp"`
+	AllocationId  string `xml:"allocationId"`
+	AssociationId string `xml:"associationId"`
+	Domain        string `xml:"domain"`
+	InstanceId    string `xml:"instanceId"`
+}
+
+type AllocateAddressResponse struct {
+	RequestId    string `xml:"requestId"`
+	PublicIp     string `xml:"publicIp"`
+	Domain       string `xml:"domain"`
+	AllocationId string `xml:"allocationId"`
+}
+
+type AssociateAddressResponse struct {
+	RequestId     string `xml:"requestId"`
+	Return        bool   `xml:"return"`
+	AssociationId string `xml:"associationId"`
+}
+
+type DescribeAddressesResponse struct {
+	RequestId    string    `xml:"requestId"`
+	AddressesSet []Address `xml:"addressesSet>item"`
+}
@@ -1,9 +1,29 @@
 package amz
 
+import "time"
+
 type Auth struct {
 	AccessKey, SecretKey, SessionToken string
 }
 
+// GetAuth returns the given credentials. Without an access and secret key,
+// the temporary credentials of the instance role are read from the instance
+// metadata service when running on EC2; off EC2 the empty credentials are
+// returned.
 func GetAuth(accessKey, secretKey, sessionToken string) Auth {
-	return Auth{accessKey, secretKey, sessionToken}
+	auth, _ := GetAuthWithRefresh(accessKey, secretKey, sessionToken)
+	return auth
+}
+
+// GetAuthWithRefresh is GetAuth that also returns when the credentials of
+// the instance role have to be read again. It is zero for credentials that
+// do not expire.
+func GetAuthWithRefresh(accessKey, secretKey, sessionToken string) (Auth, time.Time) {
+	if accessKey == "" && secretKey == "" {
+		if auth, refresh, err := instanceRoleCredentials.get(); err == nil {
+			return auth, refresh
+		}
+	}
+
+	return Auth{accessKey, secretKey, sessionToken}, time.Time{}
 }
@@ -6,4 +6,18 @@ type BlockDeviceMapping struct {
 	VolumeSize          int64
 	DeleteOnTermination bool
 	VolumeType          string
+	Iops                int64
+	Throughput          int64
+	Encrypted           bool
+	KmsKeyId            string
+}
+
+type InstanceBlockDeviceMapping struct {
+	DeviceName string `xml:"deviceName"`
+	Ebs        struct {
+		VolumeId            string `xml:"volumeId"`
+		Status              string `xml:"status"`
+		AttachTime          string `xml:"attachTime"`
+		DeleteOnTermination bool   `xml:"deleteOnTermination"`
+	} `xml:"ebs"`
 }
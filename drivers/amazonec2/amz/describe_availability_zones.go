@@ -0,0 +1,13 @@
+package amz
+
+type DescribeAvailabilityZonesResponse struct {
+	RequestId         string             `xml:"requestId"`
+	AvailabilityZones []AvailabilityZone `xml:"availabilityZoneInfo>item"`
+}
+
+type AvailabilityZone struct {
+	ZoneName   string `xml:"zoneName"`
+	ZoneId     string `xml:"zoneId"`
+	ZoneState  string `xml:"zoneState"`
+	RegionName string `xml:"regionName"`
+}
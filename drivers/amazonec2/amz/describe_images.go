@@ -0,0 +1,21 @@
+package amz
+
+type DescribeImagesResponse struct {
+	RequestId string  `xml:"requestId"`
+	ImagesSet []Image `xml:"imagesSet>item"`
+}
+
+type Image struct {
+	ImageId            string `xml:"imageId"`
+	ImageLocation      string `xml:"imageLocation"`
+	ImageState         string `xml:"imageState"`
+	ImageOwnerId       string `xml:"imageOwnerId"`
+	CreationDate       string `xml:"creationDate"`
+	Name               string `xml:"name"`
+	Description        string `xml:"description"`
+	Architecture       string `xml:"architecture"`
+	RootDeviceType     string `xml:"rootDeviceType"`
+	RootDeviceName     string `xml:"rootDeviceName"`
+	VirtualizationType string `xml:"virtualizationType"`
+	DeprecationTime    string `xml:"deprecationTime"`
+}
@@ -0,0 +1,13 @@
+package amz
+
+type DescribeInstanceTypeOfferingsResponse struct {
+	RequestId             string                 `xml:"requestId"`
+	InstanceTypeOfferings []InstanceTypeOffering `xml:"instanceTypeOfferingSet>item"`
+	NextToken             string                 `xml:"nextToken"`
+}
+
+type InstanceTypeOffering struct {
+	InstanceType string `xml:"instanceType"`
+	LocationType string `xml:"locationType"`
+	Location     string `xml:"location"`
+}
@@ -0,0 +1,31 @@
+package amz
+
+type DescribeInstanceTypesResponse struct {
+	RequestId       string             `xml:"requestId"`
+	InstanceTypeSet []InstanceTypeInfo `xml:"instanceTypeSet>item"`
+}
+
+type InstanceTypeInfo struct {
+	InstanceType             string `xml:"instanceType"`
+	InstanceStorageSupported bool   `xml:"instanceStorageSupported"`
+	HibernationSupported     bool   `xml:"hibernationSupported"`
+	InstanceStorageInfo      struct {
+		TotalSizeInGB int64  `xml:"totalSizeInGB"`
+		NvmeSupport   string `xml:"nvmeSupport"`
+		Disks         []struct {
+			SizeInGB int64  `xml:"sizeInGB"`
+			Count    int    `xml:"count"`
+			Type     string `xml:"type"`
+		} `xml:"disks>item"`
+	} `xml:"instanceStorageInfo"`
+}
+
+// InstanceStoreDisks returns the number of instance store volumes the
+// instance type comes with.
+func (i InstanceTypeInfo) InstanceStoreDisks() int {
+	count := 0
+	for _, disk := range i.InstanceStorageInfo.Disks {
+		count += disk.Count
+	}
+	return count
+}
@@ -3,6 +3,7 @@ package amz
 type DescribeInstancesResponse struct {
 	RequestId      string `xml:"requestId"`
 	ReservationSet []struct {
-		InstancesSet []EC2Instance `xml:"instancesSet>item"`
+		ReservationId string        `xml:"reservationId"`
+		InstancesSet  []EC2Instance `xml:"instancesSet>item"`
 	} `xml:"reservationSet>item"`
 }
@@ -0,0 +1,25 @@
+package amz
+
+type DescribeNetworkInterfacesResponse struct {
+	RequestId           string             `xml:"requestId"`
+	NetworkInterfaceSet []NetworkInterface `xml:"networkInterfaceSet>item"`
+}
+
+type NetworkInterface struct {
+	NetworkInterfaceId string `xml:"networkInterfaceId"`
+	SubnetId           string `xml:"subnetId"`
+	VpcId              string `xml:"vpcId"`
+	AvailabilityZone   string `xml:"availabilityZone"`
+	Description        string `xml:"description"`
+	Status             string `xml:"status"`
+	PrivateIpAddress   string `xml:"privateIpAddress"`
+	GroupSet           []struct {
+		GroupId   string `xml:"groupId"`
+		GroupName string `xml:"groupName"`
+	} `xml:"groupSet>item"`
+	Attachment struct {
+		AttachmentId string `xml:"attachmentId"`
+		InstanceId   string `xml:"instanceId"`
+		Status       string `xml:"status"`
+	} `xml:"attachment"`
+}
@@ -0,0 +1,18 @@
+package amz
+
+type DescribeVolumesResponse struct {
+	RequestId string   `xml:"requestId"`
+	VolumeSet []Volume `xml:"volumeSet>item"`
+}
+
+type Volume struct {
+	VolumeId         string `xml:"volumeId"`
+	Size             int64  `xml:"size"`
+	SnapshotId       string `xml:"snapshotId"`
+	AvailabilityZone string `xml:"availabilityZone"`
+	Status           string `xml:"status"`
+	CreateTime       string `xml:"createTime"`
+	VolumeType       string `xml:"volumeType"`
+	Iops             int64  `xml:"iops"`
+	Encrypted        bool   `xml:"encrypted"`
+}
@@ -0,0 +1,15 @@
+package amz
+
+type DescribeVolumesModificationsResponse struct {
+	RequestId           string               `xml:"requestId"`
+	VolumeModifications []VolumeModification `xml:"volumeModificationSet>item"`
+}
+
+type VolumeModification struct {
+	VolumeId          string `xml:"volumeId"`
+	ModificationState string `xml:"modificationState"`
+	StatusMessage     string `xml:"statusMessage"`
+	Progress          int    `xml:"progress"`
+	TargetSize        int64  `xml:"targetSize"`
+	TargetVolumeType  string `xml:"targetVolumeType"`
+}
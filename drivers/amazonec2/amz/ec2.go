@@ -7,16 +7,24 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
-
-	awsauth "github.com/smartystreets/go-aws-auth"
+	"strings"
+	"time"
 )
 
 type (
 	EC2 struct {
-		Endpoint string
-		Auth     Auth
-		Region   string
+		Endpoint  string
+		Auth      Auth
+		Region    string
+		Partition string
+		// Transport is used for all API requests when set, which lets
+		// tests stub EC2 responses. http.DefaultTransport is used if nil.
+		Transport http.RoundTripper
+		// DryRun makes RunInstance only check the launch, EC2 answers
+		// with a DryRunOperation error when it would have succeeded.
+		DryRun bool
 	}
 
 	Instance struct {
@@ -24,6 +32,9 @@ type (
 	}
 
 	EC2Instance struct {
+		// ReservationId is reported next to the instance set in the
+		// response and copied here by RunInstance and GetInstance.
+		ReservationId string `xml:"-"`
 		InstanceId    string `xml:"instanceId"`
 		ImageId       string `xml:"imageId"`
 		InstanceState struct {
@@ -54,18 +65,18 @@ type (
 		GroupSet         []struct {
 			GroupId   string `xml:"groupId"`
 			GroupName string `xml:"groupName"`
-		} `xml:"groupSet"`
+		} `xml:"groupSet>item"`
 		StateReason struct {
 			Code    string `xml:"code"`
 			Message string `xml:"message"`
 		} `xml:"stateReason"`
-		Architecture        string `xml:"architecture"`
-		RootDeviceType      string `xml:"rootDeviceType"`
-		RootDeviceName      string `xml:"rootDeviceName"`
-		BlockDeviceMapping  string `xml:"blockDeviceMapping"`
-		VirtualizationType  string `xml:"virtualizationType"`
-		ClientToken         string `xml:"clientToken"`
-		Hypervisor          string `xml:"hypervisor"`
+		Architecture        string                       `xml:"architecture"`
+		RootDeviceType      string                       `xml:"rootDeviceType"`
+		RootDeviceName      string                       `xml:"rootDeviceName"`
+		BlockDeviceMapping  []InstanceBlockDeviceMapping `xml:"blockDeviceMapping>item"`
+		VirtualizationType  string                       `xml:"virtualizationType"`
+		ClientToken         string                       `xml:"clientToken"`
+		Hypervisor          string                       `xml:"hypervisor"`
 		NetworkInterfaceSet []struct {
 			NetworkInterfaceId string `xml:"networkInterfaceId"`
 			SubnetId           string `xml:"subnetId"`
@@ -93,8 +104,12 @@ type (
 				PrivateDnsName   string `xml:"privateDnsName"`
 				Primary          bool   `xml:"primary"`
 			} `xml:"privateIpAddressesSet>item"`
+			Ipv6AddressesSet []struct {
+				Ipv6Address string `xml:"ipv6Address"`
+			} `xml:"ipv6AddressesSet>item"`
 		} `xml:"networkInterfaceSet>item"`
-		EbsOptimized bool `xml:"ebsOptimized"`
+		EbsOptimized bool  `xml:"ebsOptimized"`
+		TagSet       []Tag `xml:"tagSet>item"`
 	}
 
 	RunInstancesResponse struct {
@@ -110,15 +125,24 @@ func newAwsApiResponseError(r http.Response) error {
 	if err := getDecodedResponse(r, &errorResponse); err != nil {
 		return fmt.Errorf("Error decoding error response: %s", err)
 	}
-	msg := ""
+	apiErr := &ApiError{StatusCode: r.StatusCode}
 	for _, e := range errorResponse.Errors {
-		msg += fmt.Sprintf("%s\n", e.Message)
+		if apiErr.Code == "" {
+			apiErr.Code = e.Code
+		}
+		apiErr.Message += fmt.Sprintf("%s\n", e.Message)
 	}
-	return fmt.Errorf("Non-200 API response: code=%d message=%s", r.StatusCode, msg)
+	return apiErr
 }
 
 func newAwsApiCallError(err error) error {
-	return fmt.Errorf("Problem with AWS API call: %s", err)
+	return newApiCallError("Problem with AWS API call", err)
+}
+
+// newApiCallError wraps err with context while keeping its error code
+// available to ErrorCode.
+func newApiCallError(context string, err error) error {
+	return &apiCallError{context, err}
 }
 
 func getDecodedResponse(r http.Response, into interface{}) error {
@@ -129,72 +153,148 @@ func getDecodedResponse(r http.Response, into interface{}) error {
 	return nil
 }
 
-func NewEC2(auth Auth, region string) *EC2 {
-	endpoint := fmt.Sprintf("https://ec2.%s.amazonaws.com", region)
+// NewEC2 returns a client for the region. The partition is derived from the
+// region when empty.
+func NewEC2(auth Auth, region string, partition string) *EC2 {
+	if partition == "" {
+		partition = PartitionForRegion(region)
+	}
+
 	return &EC2{
-		Endpoint: endpoint,
-		Auth:     auth,
-		Region:   region,
+		Endpoint:  endpointFor(region, partition),
+		Auth:      auth,
+		Region:    region,
+		Partition: partition,
 	}
 }
 
 func (e *EC2) awsApiCall(v url.Values) (*http.Response, error) {
-	v.Set("Version", "2014-06-15")
-	client := &http.Client{}
-	finalEndpoint := fmt.Sprintf("%s?%s", e.Endpoint, v.Encode())
-	req, err := http.NewRequest("GET", finalEndpoint, nil)
-	if err != nil {
-		return &http.Response{}, fmt.Errorf("error creating request from client")
+	// newer actions pin the API version that introduced them
+	if v.Get("Version") == "" {
+		v.Set("Version", "2014-06-15")
 	}
-	req.Header.Add("Content-type", "application/json")
+	client := &http.Client{Transport: e.Transport}
+	finalEndpoint := fmt.Sprintf("%s?%s", e.Endpoint, v.Encode())
+	attempts, baseDelay := throttling.settings()
 
-	awsauth.Sign4(req, awsauth.Credentials{
-		AccessKeyID:     e.Auth.AccessKey,
-		SecretAccessKey: e.Auth.SecretKey,
-		SecurityToken:   e.Auth.SessionToken,
-	})
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("client encountered error while doing the request: %s", err.Error())
-		return resp, fmt.Errorf("client encountered error while doing the request: %s", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return resp, newAwsApiResponseError(*resp)
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", finalEndpoint, nil)
+		if err != nil {
+			return &http.Response{}, fmt.Errorf("error creating request from client")
+		}
+		req.Header.Add("Content-type", "application/json")
+
+		// every attempt is signed anew, the signature covers the time
+		signV4(req, e.Auth, e.Region, "ec2", time.Now())
+		release := requestLimits().acquire()
+		resp, err := client.Do(req)
+		release()
+		if err != nil {
+			fmt.Printf("client encountered error while doing the request: %s", err.Error())
+			return resp, fmt.Errorf("client encountered error while doing the request: %s", err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		apiErr := newAwsApiResponseError(*resp)
+		if !IsThrottlingError(apiErr) || attempt+1 >= attempts {
+			return resp, apiErr
+		}
+
+		time.Sleep(throttleBackoff(baseDelay, attempt))
 	}
-	return resp, nil
 }
 
-func (e *EC2) RunInstance(amiId string, instanceType string, zone string, minCount int, maxCount int, securityGroup string, keyName string, subnetId string, bdm *BlockDeviceMapping, role string) (EC2Instance, error) {
+func (e *EC2) RunInstance(opts RunInstanceOptions) (EC2Instance, error) {
 	instance := Instance{}
 	v := url.Values{}
 	v.Set("Action", "RunInstances")
-	v.Set("ImageId", amiId)
-	v.Set("Placement.AvailabilityZone", e.Region+zone)
-	v.Set("MinCount", strconv.Itoa(minCount))
-	v.Set("MaxCount", strconv.Itoa(maxCount))
-	v.Set("KeyName", keyName)
-	v.Set("InstanceType", instanceType)
-	v.Set("NetworkInterface.0.DeviceIndex", "0")
-	v.Set("NetworkInterface.0.SecurityGroupId.0", securityGroup)
-	v.Set("NetworkInterface.0.SubnetId", subnetId)
-	v.Set("NetworkInterface.0.AssociatePublicIpAddress", "1")
+	v.Set("Version", "2016-11-15")
 
-	if len(role) > 0 {
-		v.Set("IamInstanceProfile.Name", role)
+	// the client token makes retries of the same launch idempotent
+	if opts.ClientToken != "" {
+		v.Set("ClientToken", opts.ClientToken)
 	}
 
-	if bdm != nil {
-		v.Set("BlockDeviceMapping.0.DeviceName", bdm.DeviceName)
-		v.Set("BlockDeviceMapping.0.VirtualName", bdm.VirtualName)
-		v.Set("BlockDeviceMapping.0.Ebs.VolumeSize", strconv.FormatInt(bdm.VolumeSize, 10))
-		v.Set("BlockDeviceMapping.0.Ebs.VolumeType", bdm.VolumeType)
-		deleteOnTerm := 0
-		if bdm.DeleteOnTermination {
-			deleteOnTerm = 1
+	v.Set("ImageId", opts.AmiId)
+	v.Set("Placement.AvailabilityZone", e.Region+opts.Placement.Zone)
+
+	if opts.Placement.Tenancy != "" {
+		v.Set("Placement.Tenancy", opts.Placement.Tenancy)
+	}
+
+	if opts.Placement.HostResourceGroupArn != "" {
+		v.Set("Placement.HostResourceGroupArn", opts.Placement.HostResourceGroupArn)
+	}
+
+	if opts.Placement.HostId != "" {
+		v.Set("Placement.HostId", opts.Placement.HostId)
+	}
+
+	if opts.Placement.Affinity != "" {
+		v.Set("Placement.Affinity", opts.Placement.Affinity)
+	}
+
+	if opts.Placement.GroupName != "" {
+		v.Set("Placement.GroupName", opts.Placement.GroupName)
+	}
+
+	v.Set("MinCount", strconv.Itoa(opts.MinCount))
+	v.Set("MaxCount", strconv.Itoa(opts.MaxCount))
+	if opts.KeyName != "" {
+		v.Set("KeyName", opts.KeyName)
+	}
+
+	if e.DryRun {
+		v.Set("DryRun", "true")
+	}
+	v.Set("InstanceType", opts.InstanceType)
+	v.Set("NetworkInterface.0.DeviceIndex", "0")
+
+	// an existing interface brings its own subnet, security groups and
+	// addresses
+	if opts.NetworkInterfaceId != "" {
+		v.Set("NetworkInterface.0.NetworkInterfaceId", opts.NetworkInterfaceId)
+	} else {
+		for i, group := range opts.SecurityGroups {
+			v.Set(fmt.Sprintf("NetworkInterface.0.SecurityGroupId.%d", i), group)
+		}
+		v.Set("NetworkInterface.0.SubnetId", opts.SubnetId)
+		v.Set("NetworkInterface.0.AssociatePublicIpAddress", strconv.FormatBool(opts.AssociatePublicIp))
+
+		if opts.AssignIpv6 {
+			v.Set("NetworkInterface.0.Ipv6AddressCount", "1")
 		}
-		v.Set("BlockDeviceMapping.0.Ebs.DeleteOnTermination", strconv.Itoa(deleteOnTerm))
 	}
 
+	if len(opts.IamInstanceProfile) > 0 {
+		v.Set(instanceProfileParameter("IamInstanceProfile.", opts.IamInstanceProfile), opts.IamInstanceProfile)
+	}
+
+	// detailed monitoring reports metrics every minute instead of five
+	if opts.Monitoring {
+		v.Set("Monitoring.Enabled", "true")
+	}
+
+	// user data is passed base64 encoded
+	if opts.UserData != "" {
+		v.Set("UserData", opts.UserData)
+	}
+
+	setBlockDeviceMappings(v, "", opts.BlockDeviceMappings)
+
+	if opts.EbsOptimized {
+		v.Set("EbsOptimized", "true")
+	}
+
+	// hibernation can only be enabled at launch
+	if opts.Hibernate {
+		v.Set("HibernationOptions.Configured", "true")
+	}
+
+	setTagSpecifications(v, opts.Tags, "instance", "volume")
+
 	resp, err := e.awsApiCall(v)
 
 	if err != nil {
@@ -213,9 +313,149 @@ func (e *EC2) RunInstance(amiId string, instanceType string, zone string, minCou
 	}
 
 	instance.info = unmarshalledResponse.Instances[0]
+	instance.info.ReservationId = unmarshalledResponse.ReservationId
 	return instance.info, nil
 }
 
+// RequestSpotInstances requests a single spot instance with the launch
+// specification of opts. The request is persistent when the interruption
+// behavior is stop or hibernate, as EC2 requires, and one-time otherwise.
+// An empty spot price bids up to the on-demand price.
+func (e *EC2) RequestSpotInstances(opts RunInstanceOptions, spotPrice string, interruptionBehavior string) (*SpotInstanceRequest, error) {
+	v := url.Values{}
+	v.Set("Action", "RequestSpotInstances")
+	v.Set("Version", "2016-11-15")
+	v.Set("InstanceCount", "1")
+
+	if opts.ClientToken != "" {
+		v.Set("ClientToken", opts.ClientToken)
+	}
+
+	if spotPrice != "" {
+		v.Set("SpotPrice", spotPrice)
+	}
+
+	if interruptionBehavior != "" {
+		v.Set("InstanceInterruptionBehavior", interruptionBehavior)
+	}
+
+	if interruptionBehavior == "stop" || interruptionBehavior == "hibernate" {
+		v.Set("Type", "persistent")
+	} else {
+		v.Set("Type", "one-time")
+	}
+
+	v.Set("LaunchSpecification.ImageId", opts.AmiId)
+	v.Set("LaunchSpecification.InstanceType", opts.InstanceType)
+	v.Set("LaunchSpecification.KeyName", opts.KeyName)
+	v.Set("LaunchSpecification.Placement.AvailabilityZone", e.Region+opts.Placement.Zone)
+
+	if opts.Placement.Tenancy != "" {
+		v.Set("LaunchSpecification.Placement.Tenancy", opts.Placement.Tenancy)
+	}
+
+	if opts.Placement.GroupName != "" {
+		v.Set("LaunchSpecification.Placement.GroupName", opts.Placement.GroupName)
+	}
+
+	v.Set("LaunchSpecification.NetworkInterface.0.DeviceIndex", "0")
+	for i, group := range opts.SecurityGroups {
+		v.Set(fmt.Sprintf("LaunchSpecification.NetworkInterface.0.SecurityGroupId.%d", i), group)
+	}
+	v.Set("LaunchSpecification.NetworkInterface.0.SubnetId", opts.SubnetId)
+	v.Set("LaunchSpecification.NetworkInterface.0.AssociatePublicIpAddress", strconv.FormatBool(opts.AssociatePublicIp))
+
+	if len(opts.IamInstanceProfile) > 0 {
+		v.Set(instanceProfileParameter("LaunchSpecification.IamInstanceProfile.", opts.IamInstanceProfile), opts.IamInstanceProfile)
+	}
+
+	if opts.Monitoring {
+		v.Set("LaunchSpecification.Monitoring.Enabled", "true")
+	}
+
+	if opts.UserData != "" {
+		v.Set("LaunchSpecification.UserData", opts.UserData)
+	}
+
+	setBlockDeviceMappings(v, "LaunchSpecification.", opts.BlockDeviceMappings)
+
+	if opts.EbsOptimized {
+		v.Set("LaunchSpecification.EbsOptimized", "true")
+	}
+
+	// the launch specification of a spot request takes no tags, only the
+	// request itself can be tagged on creation
+	setTagSpecifications(v, opts.Tags, "spot-instances-request")
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return nil, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := RequestSpotInstancesResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	if len(unmarshalledResponse.SpotInstanceRequestSet) == 0 {
+		return nil, fmt.Errorf("no spot instance request returned")
+	}
+
+	return &unmarshalledResponse.SpotInstanceRequestSet[0], nil
+}
+
+// GetSpotInstanceRequest returns the spot instance request, or nil if it
+// does not exist.
+func (e *EC2) GetSpotInstanceRequest(requestId string) (*SpotInstanceRequest, error) {
+	v := url.Values{}
+	v.Set("Action", "DescribeSpotInstanceRequests")
+	v.Set("Version", "2016-11-15")
+	v.Set("SpotInstanceRequestId.1", requestId)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return nil, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeSpotInstanceRequestsResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	if len(unmarshalledResponse.SpotInstanceRequestSet) == 0 {
+		return nil, nil
+	}
+
+	return &unmarshalledResponse.SpotInstanceRequestSet[0], nil
+}
+
+func (e *EC2) CancelSpotInstanceRequest(requestId string) error {
+	v := url.Values{}
+	v.Set("Action", "CancelSpotInstanceRequests")
+	v.Set("Version", "2016-11-15")
+	v.Set("SpotInstanceRequestId.1", requestId)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
 func (e *EC2) DeleteKeyPair(name string) error {
 	v := url.Values{}
 	v.Set("Action", "DeleteKeyPair")
@@ -262,7 +502,7 @@ func (e *EC2) ImportKeyPair(name, publicKey string) error {
 
 	resp, err := e.awsApiCall(v)
 	if err != nil {
-		return fmt.Errorf("Error trying API call to create keypair: %s", err)
+		return newApiCallError("Error trying API call to create keypair", err)
 	}
 
 	defer resp.Body.Close()
@@ -307,6 +547,29 @@ func (e *EC2) CreateTags(id string, tags map[string]string) error {
 	return nil
 }
 
+func (e *EC2) DeleteTags(id string, keys []string) error {
+	v := url.Values{}
+	v.Set("Action", "DeleteTags")
+	v.Set("ResourceId.1", id)
+
+	for i, k := range keys {
+		v.Set(fmt.Sprintf("Tag.%d.Key", i+1), k)
+	}
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return newApiCallError("Error making API call to delete tags", err)
+	}
+
+	deleteTagsResponse := &DeleteTagsResponse{}
+
+	if err := getDecodedResponse(*resp, &deleteTagsResponse); err != nil {
+		return fmt.Errorf("Error decoding delete tags response: %s", err)
+	}
+
+	return nil
+}
+
 func (e *EC2) CreateSecurityGroup(name string, description string, vpcId string) (*SecurityGroup, error) {
 	v := url.Values{}
 	v.Set("Action", "CreateSecurityGroup")
@@ -346,21 +609,125 @@ func (e *EC2) CreateSecurityGroup(name string, description string, vpcId string)
 func (e *EC2) AuthorizeSecurityGroup(groupId string, permissions []IpPermission) error {
 	v := url.Values{}
 	v.Set("Action", "AuthorizeSecurityGroupIngress")
+	// IPv6 ranges need a newer version than the default
+	v.Set("Version", "2016-11-15")
+	v.Set("GroupId", groupId)
+	setIpPermissions(v, permissions)
+
+	resp, err := e.awsApiCall(v)
+	defer resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Error making API call to authorize security group ingress: %s", err)
+	}
+	return nil
+}
+
+func (e *EC2) RevokeSecurityGroup(groupId string, permissions []IpPermission) error {
+	v := url.Values{}
+	v.Set("Action", "RevokeSecurityGroupIngress")
+	v.Set("Version", "2016-11-15")
 	v.Set("GroupId", groupId)
+	setIpPermissions(v, permissions)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return fmt.Errorf("Error making API call to revoke security group ingress: %s", err)
+	}
+	defer resp.Body.Close()
+	return nil
+}
 
+func setIpPermissions(v url.Values, permissions []IpPermission) {
 	for index, perm := range permissions {
 		n := index + 1 // amazon starts counting from 1 not 0
 		v.Set(fmt.Sprintf("IpPermissions.%d.IpProtocol", n), perm.IpProtocol)
 		v.Set(fmt.Sprintf("IpPermissions.%d.FromPort", n), strconv.Itoa(perm.FromPort))
 		v.Set(fmt.Sprintf("IpPermissions.%d.ToPort", n), strconv.Itoa(perm.ToPort))
-		v.Set(fmt.Sprintf("IpPermissions.%d.IpRanges.1.CidrIp", n), perm.IpRange)
+
+		ipv4, ipv6 := 0, 0
+		for _, cidr := range perm.Ranges() {
+			if strings.Contains(cidr, ":") {
+				ipv6++
+				v.Set(fmt.Sprintf("IpPermissions.%d.Ipv6Ranges.%d.CidrIpv6", n, ipv6), cidr)
+			} else {
+				ipv4++
+				v.Set(fmt.Sprintf("IpPermissions.%d.IpRanges.%d.CidrIp", n, ipv4), cidr)
+			}
+		}
+
+		for i, groupId := range perm.GroupIds {
+			v.Set(fmt.Sprintf("IpPermissions.%d.Groups.%d.GroupId", n, i+1), groupId)
+		}
 	}
-	resp, err := e.awsApiCall(v)
-	defer resp.Body.Close()
-	if err != nil {
-		return fmt.Errorf("Error making API call to authorize security group ingress: %s", err)
+}
+
+// instanceProfileParameter returns the parameter an instance profile is
+// passed in, Arn for an ARN and Name otherwise.
+func instanceProfileParameter(prefix string, profile string) string {
+	if strings.HasPrefix(profile, "arn:") {
+		return prefix + "Arn"
+	}
+
+	return prefix + "Name"
+}
+
+// setTagSpecifications tags the resources of the given types on creation.
+func setTagSpecifications(v url.Values, tags map[string]string, resourceTypes ...string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	keys := []string{}
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, resourceType := range resourceTypes {
+		p := fmt.Sprintf("TagSpecification.%d.", i+1)
+		v.Set(p+"ResourceType", resourceType)
+		for j, k := range keys {
+			v.Set(fmt.Sprintf("%sTag.%d.Key", p, j+1), k)
+			v.Set(fmt.Sprintf("%sTag.%d.Value", p, j+1), tags[k])
+		}
+	}
+}
+
+// setBlockDeviceMappings sets the block device mapping parameters, with
+// prefix prepended for nested launch specifications.
+func setBlockDeviceMappings(v url.Values, prefix string, bdms []BlockDeviceMapping) {
+	for i, bdm := range bdms {
+		p := fmt.Sprintf("%sBlockDeviceMapping.%d.", prefix, i)
+		v.Set(p+"DeviceName", bdm.DeviceName)
+
+		// instance store volumes are only referenced by their virtual name
+		if bdm.VirtualName != "" {
+			v.Set(p+"VirtualName", bdm.VirtualName)
+			continue
+		}
+
+		v.Set(p+"Ebs.VolumeSize", strconv.FormatInt(bdm.VolumeSize, 10))
+		v.Set(p+"Ebs.VolumeType", bdm.VolumeType)
+		if bdm.Iops > 0 {
+			v.Set(p+"Ebs.Iops", strconv.FormatInt(bdm.Iops, 10))
+		}
+		if bdm.Throughput > 0 {
+			v.Set(p+"Ebs.Throughput", strconv.FormatInt(bdm.Throughput, 10))
+		}
+		deleteOnTerm := 0
+		if bdm.DeleteOnTermination {
+			deleteOnTerm = 1
+		}
+		v.Set(p+"Ebs.DeleteOnTermination", strconv.Itoa(deleteOnTerm))
+
+		// without a key id EC2 uses the default EBS key of the account
+		if bdm.Encrypted {
+			v.Set(p+"Ebs.Encrypted", "true")
+			if bdm.KmsKeyId != "" {
+				v.Set(p+"Ebs.KmsKeyId", bdm.KmsKeyId)
+			}
+		}
 	}
-	return nil
 }
 
 func (e *EC2) DeleteSecurityGroup(groupId string) error {
@@ -369,9 +736,8 @@ func (e *EC2) DeleteSecurityGroup(groupId string) error {
 	v.Set("GroupId", groupId)
 
 	resp, err := e.awsApiCall(v)
-	defer resp.Body.Close()
 	if err != nil {
-		return fmt.Errorf("Error making API call to delete security group: %s", err)
+		return newApiCallError("Error making API call to delete security group", err)
 	}
 
 	deleteSecurityGroupResponse := DeleteSecurityGroupResponse{}
@@ -385,9 +751,14 @@ func (e *EC2) DeleteSecurityGroup(groupId string) error {
 
 func (e *EC2) GetSecurityGroups() ([]SecurityGroup, error) {
 	sgs := []SecurityGroup{}
-	resp, err := e.performStandardAction("DescribeSecurityGroups")
+	v := url.Values{}
+	v.Set("Action", "DescribeSecurityGroups")
+	// the default version does not report IPv6 ranges
+	v.Set("Version", "2016-11-15")
+
+	resp, err := e.awsApiCall(v)
 	if err != nil {
-		return sgs, err
+		return sgs, newAwsApiCallError(err)
 	}
 	defer resp.Body.Close()
 	contents, err := ioutil.ReadAll(resp.Body)
@@ -405,17 +776,37 @@ func (e *EC2) GetSecurityGroups() ([]SecurityGroup, error) {
 	return sgs, nil
 }
 
+// GetSecurityGroupById returns the security group with the ID, or nil if it
+// does not exist. Only that group is described, not all of the account.
 func (e *EC2) GetSecurityGroupById(id string) (*SecurityGroup, error) {
-	groups, err := e.GetSecurityGroups()
+	v := url.Values{}
+	v.Set("Action", "DescribeSecurityGroups")
+	v.Set("Version", "2016-11-15")
+	v.Set("Filter.1.Name", "group-id")
+	v.Set("Filter.1.Value", id)
+
+	resp, err := e.awsApiCall(v)
 	if err != nil {
-		return nil, err
+		return nil, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeSecurityGroupsResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
 	}
 
-	for _, g := range groups {
+	for _, g := range unmarshalledResponse.SecurityGroupInfo {
 		if g.GroupId == id {
 			return &g, nil
 		}
 	}
+
 	return nil, nil
 }
 
@@ -448,66 +839,610 @@ func (e *EC2) GetSubnets(filters []Filter) ([]Subnet, error) {
 	return subnets, nil
 }
 
-func (e *EC2) GetKeyPairs() ([]KeyPair, error) {
-	keyPairs := []KeyPair{}
-	resp, err := e.performStandardAction("DescribeKeyPairs")
+func (e *EC2) GetVpc(vpcId string) (*Vpc, error) {
+	v := url.Values{}
+	v.Set("Action", "DescribeVpcs")
+	v.Set("VpcId.1", vpcId)
+
+	resp, err := e.awsApiCall(v)
 	if err != nil {
-		return keyPairs, err
+		return nil, newAwsApiCallError(err)
 	}
 	defer resp.Body.Close()
+
 	contents, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return keyPairs, fmt.Errorf("Error reading AWS response body: %s", err)
+		return nil, fmt.Errorf("Error reading AWS response body: %s", err)
 	}
 
-	unmarshalledResponse := DescribeKeyPairsResponse{}
+	unmarshalledResponse := DescribeVpcsResponse{}
 	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
-		return keyPairs, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+		return nil, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
 	}
 
-	keyPairs = unmarshalledResponse.KeySet
+	for _, vpc := range unmarshalledResponse.VpcSet {
+		if vpc.VpcId == vpcId {
+			return &vpc, nil
+		}
+	}
 
-	return keyPairs, nil
+	return nil, nil
 }
 
-func (e *EC2) GetKeyPair(name string) (*KeyPair, error) {
-	keyPairs, err := e.GetKeyPairs()
+func (e *EC2) CreateSubnet(vpcId string, cidrBlock string, availabilityZone string) (*Subnet, error) {
+	v := url.Values{}
+	v.Set("Action", "CreateSubnet")
+	v.Set("VpcId", vpcId)
+	v.Set("CidrBlock", cidrBlock)
+	v.Set("AvailabilityZone", availabilityZone)
+
+	resp, err := e.awsApiCall(v)
 	if err != nil {
-		return nil, err
+		return nil, newApiCallError("Error making API call to create subnet", err)
 	}
 
-	for _, key := range keyPairs {
-		if key.KeyName == name {
-			return &key, nil
-		}
+	createSubnetResponse := CreateSubnetResponse{}
+
+	if err := getDecodedResponse(*resp, &createSubnetResponse); err != nil {
+		return nil, fmt.Errorf("Error decoding create subnet response: %s", err)
 	}
-	return nil, nil
+
+	return &createSubnetResponse.Subnet, nil
 }
 
-func (e *EC2) GetInstance(instanceId string) (EC2Instance, error) {
-	ec2Instance := EC2Instance{}
-	resp, err := e.performInstanceAction(instanceId, "DescribeInstances", nil)
+func (e *EC2) DeleteSubnet(subnetId string) error {
+	v := url.Values{}
+	v.Set("Action", "DeleteSubnet")
+	v.Set("SubnetId", subnetId)
+
+	resp, err := e.awsApiCall(v)
 	if err != nil {
-		return ec2Instance, err
+		return newApiCallError("Error making API call to delete subnet", err)
 	}
-	defer resp.Body.Close()
-	contents, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return ec2Instance, fmt.Errorf("Error reading AWS response body: %s", err)
+
+	deleteSubnetResponse := DeleteSubnetResponse{}
+
+	if err := getDecodedResponse(*resp, &deleteSubnetResponse); err != nil {
+		return fmt.Errorf("Error decoding delete subnet response: %s", err)
 	}
 
-	unmarshalledResponse := DescribeInstancesResponse{}
-	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+	return nil
+}
+
+// GetPlacementGroup returns the placement group with the name, or nil if it
+// does not exist.
+func (e *EC2) GetPlacementGroup(name string) (*PlacementGroup, error) {
+	v := url.Values{}
+	v.Set("Action", "DescribePlacementGroups")
+	v.Set("Version", "2016-11-15")
+	v.Set("Filter.1.Name", "group-name")
+	v.Set("Filter.1.Value", name)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return nil, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribePlacementGroupsResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	for _, group := range unmarshalledResponse.PlacementGroups {
+		if group.GroupName == name {
+			return &group, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// CreatePlacementGroup creates a placement group with the cluster, spread
+// or partition strategy. The partition count only applies to the partition
+// strategy, EC2 picks its default when it is 0.
+func (e *EC2) CreatePlacementGroup(name string, strategy string, partitionCount int) error {
+	v := url.Values{}
+	v.Set("Action", "CreatePlacementGroup")
+	v.Set("Version", "2016-11-15")
+	v.Set("GroupName", name)
+	v.Set("Strategy", strategy)
+
+	if partitionCount > 0 {
+		v.Set("PartitionCount", strconv.Itoa(partitionCount))
+	}
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return newApiCallError("Error making API call to create placement group", err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+func (e *EC2) DeletePlacementGroup(name string) error {
+	v := url.Values{}
+	v.Set("Action", "DeletePlacementGroup")
+	v.Set("GroupName", name)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return newApiCallError("Error making API call to delete placement group", err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// AllocateAddress allocates an Elastic IP address for use in a VPC.
+func (e *EC2) AllocateAddress() (*Address, error) {
+	v := url.Values{}
+	v.Set("Action", "AllocateAddress")
+	v.Set("Domain", "vpc")
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return nil, newApiCallError("Error making API call to allocate address", err)
+	}
+
+	allocateAddressResponse := AllocateAddressResponse{}
+
+	if err := getDecodedResponse(*resp, &allocateAddressResponse); err != nil {
+		return nil, fmt.Errorf("Error decoding allocate address response: %s", err)
+	}
+
+	return &Address{
+		PublicIp:     allocateAddressResponse.PublicIp,
+		AllocationId: allocateAddressResponse.AllocationId,
+		Domain:       allocateAddressResponse.Domain,
+	}, nil
+}
+
+// AssociateAddress associates the Elastic IP address with the instance and
+// returns the association ID.
+func (e *EC2) AssociateAddress(allocationId string, instanceId string) (string, error) {
+	v := url.Values{}
+	v.Set("Action", "AssociateAddress")
+	v.Set("AllocationId", allocationId)
+	v.Set("InstanceId", instanceId)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return "", newApiCallError("Error making API call to associate address", err)
+	}
+
+	associateAddressResponse := AssociateAddressResponse{}
+
+	if err := getDecodedResponse(*resp, &associateAddressResponse); err != nil {
+		return "", fmt.Errorf("Error decoding associate address response: %s", err)
+	}
+
+	return associateAddressResponse.AssociationId, nil
+}
+
+func (e *EC2) DisassociateAddress(associationId string) error {
+	v := url.Values{}
+	v.Set("Action", "DisassociateAddress")
+	v.Set("AssociationId", associationId)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return newApiCallError("Error making API call to disassociate address", err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+func (e *EC2) ReleaseAddress(allocationId string) error {
+	v := url.Values{}
+	v.Set("Action", "ReleaseAddress")
+	v.Set("AllocationId", allocationId)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return newApiCallError("Error making API call to release address", err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// GetAddress returns the Elastic IP address with the allocation ID, or nil
+// if it does not exist.
+func (e *EC2) GetAddress(allocationId string) (*Address, error) {
+	v := url.Values{}
+	v.Set("Action", "DescribeAddresses")
+	v.Set("AllocationId.1", allocationId)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return nil, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeAddressesResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	for _, address := range unmarshalledResponse.AddressesSet {
+		if address.AllocationId == allocationId {
+			return &address, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (e *EC2) GetAvailabilityZones() ([]AvailabilityZone, error) {
+	zones := []AvailabilityZone{}
+	v := url.Values{}
+	v.Set("Action", "DescribeAvailabilityZones")
+	v.Set("Version", "2016-11-15")
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return zones, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return zones, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeAvailabilityZonesResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return zones, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	zones = unmarshalledResponse.AvailabilityZones
+
+	return zones, nil
+}
+
+func (e *EC2) GetImages(owners []string, filters []Filter) ([]Image, error) {
+	images := []Image{}
+	v := url.Values{}
+	v.Set("Action", "DescribeImages")
+	v.Set("Version", "2016-11-15")
+
+	for idx, owner := range owners {
+		n := idx + 1 // amazon starts counting from 1 not 0
+		v.Set(fmt.Sprintf("Owner.%d", n), owner)
+	}
+
+	for idx, filter := range filters {
+		n := idx + 1 // amazon starts counting from 1 not 0
+		v.Set(fmt.Sprintf("Filter.%d.Name", n), filter.Name)
+		v.Set(fmt.Sprintf("Filter.%d.Value", n), filter.Value)
+	}
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return images, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return images, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeImagesResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return images, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	images = unmarshalledResponse.ImagesSet
+
+	return images, nil
+}
+
+func (e *EC2) GetVolumes(volumeIds []string) ([]Volume, error) {
+	volumes := []Volume{}
+	v := url.Values{}
+	v.Set("Action", "DescribeVolumes")
+
+	for idx, id := range volumeIds {
+		n := idx + 1 // amazon starts counting from 1 not 0
+		v.Set(fmt.Sprintf("VolumeId.%d", n), id)
+	}
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return volumes, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return volumes, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeVolumesResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return volumes, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	volumes = unmarshalledResponse.VolumeSet
+
+	return volumes, nil
+}
+
+// ModifyVolume grows the volume to size GB. The new size can be used once
+// the modification reaches the optimizing state.
+func (e *EC2) ModifyVolume(volumeId string, size int64) error {
+	v := url.Values{}
+	v.Set("Action", "ModifyVolume")
+	v.Set("Version", "2016-11-15")
+	v.Set("VolumeId", volumeId)
+	v.Set("Size", strconv.FormatInt(size, 10))
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// GetVolumeModification returns the latest modification of the volume, or
+// nil if it was never modified.
+func (e *EC2) GetVolumeModification(volumeId string) (*VolumeModification, error) {
+	v := url.Values{}
+	v.Set("Action", "DescribeVolumesModifications")
+	v.Set("Version", "2016-11-15")
+	v.Set("VolumeId.1", volumeId)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return nil, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeVolumesModificationsResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	if len(unmarshalledResponse.VolumeModifications) == 0 {
+		return nil, nil
+	}
+
+	return &unmarshalledResponse.VolumeModifications[0], nil
+}
+
+func (e *EC2) GetInstanceType(instanceType string) (*InstanceTypeInfo, error) {
+	v := url.Values{}
+	v.Set("Action", "DescribeInstanceTypes")
+	v.Set("Version", "2016-11-15")
+	v.Set("InstanceType.1", instanceType)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return nil, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeInstanceTypesResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	for _, info := range unmarshalledResponse.InstanceTypeSet {
+		if info.InstanceType == instanceType {
+			return &info, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// GetInstanceTypeOfferings returns the instance types offered in a location,
+// a region or availability zone depending on the location type.
+func (e *EC2) GetInstanceTypeOfferings(locationType, location string) ([]string, error) {
+	instanceTypes := []string{}
+	nextToken := ""
+
+	for {
+		v := url.Values{}
+		v.Set("Action", "DescribeInstanceTypeOfferings")
+		v.Set("Version", "2016-11-15")
+		v.Set("LocationType", locationType)
+		v.Set("Filter.1.Name", "location")
+		v.Set("Filter.1.Value", location)
+		if nextToken != "" {
+			v.Set("NextToken", nextToken)
+		}
+
+		resp, err := e.awsApiCall(v)
+		if err != nil {
+			return nil, newAwsApiCallError(err)
+		}
+
+		contents, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading AWS response body: %s", err)
+		}
+
+		unmarshalledResponse := DescribeInstanceTypeOfferingsResponse{}
+		if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+			return nil, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+		}
+
+		for _, offering := range unmarshalledResponse.InstanceTypeOfferings {
+			instanceTypes = append(instanceTypes, offering.InstanceType)
+		}
+
+		nextToken = unmarshalledResponse.NextToken
+		if nextToken == "" {
+			return instanceTypes, nil
+		}
+	}
+}
+
+func (e *EC2) GetNetworkInterfaces(filters []Filter) ([]NetworkInterface, error) {
+	interfaces := []NetworkInterface{}
+	v := url.Values{}
+	v.Set("Action", "DescribeNetworkInterfaces")
+
+	for idx, filter := range filters {
+		n := idx + 1 // amazon starts counting from 1 not 0
+		v.Set(fmt.Sprintf("Filter.%d.Name", n), filter.Name)
+		v.Set(fmt.Sprintf("Filter.%d.Value", n), filter.Value)
+	}
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return interfaces, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return interfaces, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeNetworkInterfacesResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return interfaces, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	interfaces = unmarshalledResponse.NetworkInterfaceSet
+
+	return interfaces, nil
+}
+
+func (e *EC2) GetKeyPairs() ([]KeyPair, error) {
+	keyPairs := []KeyPair{}
+	resp, err := e.performStandardAction("DescribeKeyPairs")
+	if err != nil {
+		return keyPairs, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return keyPairs, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeKeyPairsResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return keyPairs, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	keyPairs = unmarshalledResponse.KeySet
+
+	return keyPairs, nil
+}
+
+func (e *EC2) GetKeyPair(name string) (*KeyPair, error) {
+	keyPairs, err := e.GetKeyPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keyPairs {
+		if key.KeyName == name {
+			return &key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (e *EC2) GetInstance(instanceId string) (EC2Instance, error) {
+	ec2Instance := EC2Instance{}
+	// the default version does not report IPv6 addresses
+	vars := map[string]string{
+		"Version": "2016-11-15",
+	}
+	resp, err := e.performInstanceAction(instanceId, "DescribeInstances", &vars)
+	if err != nil {
+		return ec2Instance, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ec2Instance, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeInstancesResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
 		return ec2Instance, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
 	}
 
 	if len(unmarshalledResponse.ReservationSet) > 0 {
 		reservationSet := unmarshalledResponse.ReservationSet[0]
 		ec2Instance = reservationSet.InstancesSet[0]
+		ec2Instance.ReservationId = reservationSet.ReservationId
 	}
 	return ec2Instance, nil
 }
 
+// GetInstances returns the instances matching the filters across all
+// reservations.
+func (e *EC2) GetInstances(filters []Filter) ([]EC2Instance, error) {
+	instances := []EC2Instance{}
+	v := url.Values{}
+	v.Set("Action", "DescribeInstances")
+	v.Set("Version", "2016-11-15")
+
+	for idx, filter := range filters {
+		n := idx + 1 // amazon starts counting from 1 not 0
+		v.Set(fmt.Sprintf("Filter.%d.Name", n), filter.Name)
+		v.Set(fmt.Sprintf("Filter.%d.Value", n), filter.Value)
+	}
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return instances, newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return instances, fmt.Errorf("Error reading AWS response body: %s", err)
+	}
+
+	unmarshalledResponse := DescribeInstancesResponse{}
+	if err = xml.Unmarshal(contents, &unmarshalledResponse); err != nil {
+		return instances, fmt.Errorf("Error unmarshalling AWS response XML: %s", err)
+	}
+
+	for _, reservation := range unmarshalledResponse.ReservationSet {
+		for _, instance := range reservation.InstancesSet {
+			instance.ReservationId = reservation.ReservationId
+			instances = append(instances, instance)
+		}
+	}
+
+	return instances, nil
+}
+
 func (e *EC2) StartInstance(instanceId string) error {
 	if _, err := e.performInstanceAction(instanceId, "StartInstances", nil); err != nil {
 		return err
@@ -534,6 +1469,60 @@ func (e *EC2) StopInstance(instanceId string, force bool) error {
 	return nil
 }
 
+// HibernateInstance stops an instance launched with hibernation enabled,
+// saving its memory to the root volume.
+func (e *EC2) HibernateInstance(instanceId string) error {
+	vars := map[string]string{
+		"Version":   "2016-11-15",
+		"Hibernate": "true",
+	}
+
+	if _, err := e.performInstanceAction(instanceId, "StopInstances", &vars); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ModifyInstanceAttribute sets a single attribute of an instance, e.g.
+// SourceDestCheck to false.
+func (e *EC2) ModifyInstanceAttribute(instanceId string, attribute string, value string) error {
+	v := url.Values{}
+	v.Set("Action", "ModifyInstanceAttribute")
+	v.Set("InstanceId", instanceId)
+	v.Set(attribute+".Value", value)
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+func (e *EC2) ModifyInstanceMetadataOptions(instanceId string, httpTokens string, hopLimit int) error {
+	v := url.Values{}
+	v.Set("Action", "ModifyInstanceMetadataOptions")
+	v.Set("Version", "2016-11-15")
+	v.Set("InstanceId", instanceId)
+
+	if httpTokens != "" {
+		v.Set("HttpTokens", httpTokens)
+	}
+
+	if hopLimit > 0 {
+		v.Set("HttpPutResponseHopLimit", strconv.Itoa(hopLimit))
+	}
+
+	resp, err := e.awsApiCall(v)
+	if err != nil {
+		return newAwsApiCallError(err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
 func (e *EC2) TerminateInstance(instanceId string) error {
 	if _, err := e.performInstanceAction(instanceId, "TerminateInstances", nil); err != nil {
 		return err
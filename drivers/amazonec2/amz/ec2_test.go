@@ -1 +1,655 @@
 package amz
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	describeKeyPairsResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<DescribeKeyPairsResponse xmlns="http://ec2.amazonaws.com/doc/2014-06-15/">
+  <requestId>59dbff89-35bd-4eac-99ed-be587EXAMPLE</requestId>
+  <keySet>
+    <item>
+      <keyName>test-host</keyName>
+      <keyFingerprint>1f:51:ae:28:bf:89:e9:d8:1f:25:5d:37:2d:7d:b8:ca:9f:f5:f1:6f</keyFingerprint>
+    </item>
+  </keySet>
+</DescribeKeyPairsResponse>`
+
+	describeInstancesPageResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2014-06-15/">
+  <requestId>fdcdcab1-ae5c-489e-9c33-4637c5dda355</requestId>
+  <reservationSet>
+    <item>
+      <reservationId>r-1a2b3c4d</reservationId>
+      <instancesSet>
+        <item>
+          <instanceId>i-1a2b3c4d</instanceId>
+          <instanceState>
+            <code>16</code>
+            <name>running</name>
+          </instanceState>
+          <ipAddress>203.0.113.10</ipAddress>
+          <privateIpAddress>10.0.0.12</privateIpAddress>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+  <nextToken>eyJ2IjoiMiIsImMiOiJFWEFNUExFIn0=</nextToken>
+</DescribeInstancesResponse>`
+
+	requestLimitExceededResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+  <Errors>
+    <Error>
+      <Code>RequestLimitExceeded</Code>
+      <Message>Request limit exceeded.</Message>
+    </Error>
+  </Errors>
+  <RequestID>ea966190-f9aa-478e-9ede-example</RequestID>
+</Response>`
+
+	invalidInstanceIdResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+  <Errors>
+    <Error>
+      <Code>InvalidInstanceID.NotFound</Code>
+      <Message>The instance ID 'i-1a2b3c4d' does not exist</Message>
+    </Error>
+  </Errors>
+  <RequestID>ea966190-f9aa-478e-9ede-example</RequestID>
+</Response>`
+)
+
+type fakeResponse struct {
+	StatusCode int
+	Body       string
+}
+
+// fakeTransport replays canned responses in order and records the requests
+// it receives.
+type fakeTransport struct {
+	Responses []fakeResponse
+	Requests  []*http.Request
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.Requests = append(t.Requests, req)
+
+	r := t.Responses[0]
+	if len(t.Responses) > 1 {
+		t.Responses = t.Responses[1:]
+	}
+
+	return &http.Response{
+		StatusCode: r.StatusCode,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(r.Body)),
+		Request:    req,
+	}, nil
+}
+
+func newTestEC2(responses ...fakeResponse) (*EC2, *fakeTransport) {
+	transport := &fakeTransport{Responses: responses}
+	e := NewEC2(GetAuth("access", "secret", ""), "us-east-1", "")
+	e.Transport = transport
+	return e, transport
+}
+
+func TestGetKeyPairWithTransport(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, describeKeyPairsResponse})
+
+	key, err := e.GetKeyPair("test-host")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key == nil || key.KeyName != "test-host" {
+		t.Fatalf("expected key pair test-host; received %v", key)
+	}
+
+	if len(transport.Requests) != 1 {
+		t.Fatalf("expected 1 request; received %d", len(transport.Requests))
+	}
+
+	if action := transport.Requests[0].URL.Query().Get("Action"); action != "DescribeKeyPairs" {
+		t.Fatalf("expected DescribeKeyPairs action; received %s", action)
+	}
+}
+
+func TestGetInstanceWithNextToken(t *testing.T) {
+	e, _ := newTestEC2(fakeResponse{http.StatusOK, describeInstancesPageResponse})
+
+	inst, err := e.GetInstance("i-1a2b3c4d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inst.InstanceId != "i-1a2b3c4d" || inst.IpAddress != "203.0.113.10" {
+		t.Fatalf("unexpected instance decoded: %+v", inst)
+	}
+}
+
+func TestErrorResponseWithTransport(t *testing.T) {
+	e, _ := newTestEC2(fakeResponse{http.StatusBadRequest, invalidInstanceIdResponse})
+
+	if _, err := e.GetInstance("i-1a2b3c4d"); err == nil {
+		t.Fatal("expected an error for an error response")
+	}
+}
+
+func TestRequestLimitExceededWithTransport(t *testing.T) {
+	defer SetThrottleRetries(DefaultThrottleAttempts, DefaultThrottleBaseDelay)
+	SetThrottleRetries(2, time.Millisecond)
+
+	e, transport := newTestEC2(fakeResponse{http.StatusServiceUnavailable, requestLimitExceededResponse})
+
+	_, err := e.GetKeyPairs()
+	if err == nil {
+		t.Fatal("expected an error for a throttled request")
+	}
+
+	if !strings.Contains(err.Error(), "Request limit exceeded") {
+		t.Fatalf("expected the throttling message in the error; received %s", err)
+	}
+
+	if len(transport.Requests) != 2 {
+		t.Fatalf("expected the request to be tried twice; received %d requests", len(transport.Requests))
+	}
+}
+
+const runInstancesResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<RunInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2014-06-15/">
+  <requestId>7a62c49f-347e-4fc4-9331-6e8eEXAMPLE</requestId>
+  <reservationId>r-1a2b3c4d</reservationId>
+  <ownerId>123456789012</ownerId>
+  <instancesSet>
+    <item>
+      <instanceId>i-1a2b3c4d</instanceId>
+      <instanceState>
+        <code>0</code>
+        <name>pending</name>
+      </instanceState>
+    </item>
+  </instancesSet>
+</RunInstancesResponse>`
+
+func TestRunInstanceInstanceStoreMapping(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	bdms := []BlockDeviceMapping{
+		{
+			DeviceName:          "/dev/sda1",
+			VolumeSize:          16,
+			DeleteOnTermination: true,
+			VolumeType:          "gp2",
+		},
+		{
+			DeviceName:  "/dev/sdb",
+			VirtualName: "ephemeral0",
+		},
+	}
+
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m3.medium", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true, BlockDeviceMappings: bdms}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("BlockDeviceMapping.0.Ebs.VolumeSize") != "16" {
+		t.Fatalf("expected a 16GB root volume; received %q", q.Get("BlockDeviceMapping.0.Ebs.VolumeSize"))
+	}
+
+	if q.Get("BlockDeviceMapping.1.VirtualName") != "ephemeral0" {
+		t.Fatalf("expected ephemeral0 mapping; received %q", q.Get("BlockDeviceMapping.1.VirtualName"))
+	}
+
+	if _, ok := q["BlockDeviceMapping.1.Ebs.VolumeSize"]; ok {
+		t.Fatal("expected no EBS parameters on the instance store mapping")
+	}
+}
+
+func TestRunInstanceReservationId(t *testing.T) {
+	e, _ := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	instance, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m3.medium", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instance.ReservationId != "r-1a2b3c4d" {
+		t.Fatalf("expected reservation r-1a2b3c4d; received %q", instance.ReservationId)
+	}
+}
+
+func TestRunInstanceEncryptedVolume(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	bdms := []BlockDeviceMapping{
+		{
+			DeviceName: "/dev/sda1",
+			VolumeSize: 16,
+			VolumeType: "gp2",
+			Encrypted:  true,
+			KmsKeyId:   "alias/machines",
+		},
+		{
+			DeviceName: "/dev/sdf",
+			VolumeSize: 8,
+			VolumeType: "gp2",
+			Encrypted:  true,
+		},
+	}
+
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m3.medium", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true, BlockDeviceMappings: bdms}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("BlockDeviceMapping.0.Ebs.Encrypted") != "true" || q.Get("BlockDeviceMapping.0.Ebs.KmsKeyId") != "alias/machines" {
+		t.Fatalf("expected an encrypted root volume with the given key; received %v", q)
+	}
+
+	if q.Get("BlockDeviceMapping.1.Ebs.Encrypted") != "true" {
+		t.Fatal("expected the second volume to be encrypted")
+	}
+
+	if _, ok := q["BlockDeviceMapping.1.Ebs.KmsKeyId"]; ok {
+		t.Fatal("expected no key id so that the account default key is used")
+	}
+}
+
+func TestRunInstanceTenancy(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse}, fakeResponse{http.StatusOK, runInstancesResponse})
+
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m3.medium", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := transport.Requests[0].URL.Query()["Placement.Tenancy"]; ok {
+		t.Fatal("expected no tenancy parameter for the default tenancy")
+	}
+
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m3.medium", Placement: Placement{Zone: "a", Tenancy: "dedicated"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if tenancy := transport.Requests[1].URL.Query().Get("Placement.Tenancy"); tenancy != "dedicated" {
+		t.Fatalf("expected dedicated tenancy; received %q", tenancy)
+	}
+}
+
+func TestRunInstanceHostResourceGroup(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	arn := "arn:aws:resource-groups:us-east-1:123456789012:group/hosts"
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m5.large", Placement: Placement{Zone: "a", Tenancy: "host", HostResourceGroupArn: arn}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("Placement.Tenancy") != "host" || q.Get("Placement.HostResourceGroupArn") != arn {
+		t.Fatalf("expected host tenancy in the resource group; received %v", q)
+	}
+
+	// the 2014-06-15 default predates host tenancy
+	if version := q.Get("Version"); version != "2016-11-15" {
+		t.Fatalf("expected API version 2016-11-15; received %q", version)
+	}
+}
+
+func TestRunInstanceHostAffinity(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m5.large", Placement: Placement{Zone: "a", Tenancy: "host", HostId: "h-0123456789abcdef0", Affinity: "host"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("Placement.HostId") != "h-0123456789abcdef0" || q.Get("Placement.Affinity") != "host" {
+		t.Fatalf("expected the instance to be pinned to the host; received %v", q)
+	}
+
+	if version := q.Get("Version"); version != "2016-11-15" {
+		t.Fatalf("expected API version 2016-11-15; received %q", version)
+	}
+}
+
+func TestRunInstanceEbsOptimized(t *testing.T) {
+	for _, optimized := range []bool{false, true} {
+		e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+		if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m3.medium", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true, EbsOptimized: optimized}); err != nil {
+			t.Fatal(err)
+		}
+
+		value, ok := transport.Requests[0].URL.Query()["EbsOptimized"]
+		if ok != optimized || (optimized && value[0] != "true") {
+			t.Fatalf("expected EbsOptimized only when requested; received %v with %t", value, optimized)
+		}
+	}
+}
+
+func TestGetInstanceTypeOfferingsPaginated(t *testing.T) {
+	e, transport := newTestEC2(
+		fakeResponse{http.StatusOK, `<DescribeInstanceTypeOfferingsResponse>
+  <instanceTypeOfferingSet>
+    <item><instanceType>t2.micro</instanceType></item>
+  </instanceTypeOfferingSet>
+  <nextToken>page-2</nextToken>
+</DescribeInstanceTypeOfferingsResponse>`},
+		fakeResponse{http.StatusOK, `<DescribeInstanceTypeOfferingsResponse>
+  <instanceTypeOfferingSet>
+    <item><instanceType>m5.large</instanceType></item>
+  </instanceTypeOfferingSet>
+</DescribeInstanceTypeOfferingsResponse>`},
+	)
+
+	offered, err := e.GetInstanceTypeOfferings("availability-zone", "us-east-1a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(offered) != 2 || offered[0] != "t2.micro" || offered[1] != "m5.large" {
+		t.Fatalf("expected the instance types of both pages; received %v", offered)
+	}
+
+	q := transport.Requests[1].URL.Query()
+	if q.Get("NextToken") != "page-2" || q.Get("LocationType") != "availability-zone" || q.Get("Filter.1.Value") != "us-east-1a" {
+		t.Fatalf("unexpected second request %v", q)
+	}
+}
+
+func TestRunInstanceHibernationConfigured(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m5.large", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true, Hibernate: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if configured := transport.Requests[0].URL.Query().Get("HibernationOptions.Configured"); configured != "true" {
+		t.Fatalf("expected hibernation to be configured; received %q", configured)
+	}
+
+	if version := transport.Requests[0].URL.Query().Get("Version"); version != "2016-11-15" {
+		t.Fatalf("expected API version 2016-11-15; received %q", version)
+	}
+}
+
+func TestHibernateInstance(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, "<StopInstancesResponse></StopInstancesResponse>"})
+
+	if err := e.HibernateInstance("i-12345"); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("Action") != "StopInstances" || q.Get("Hibernate") != "true" {
+		t.Fatalf("expected a hibernating stop; received %v", q)
+	}
+
+	// the 2014-06-15 default predates hibernation
+	if version := q.Get("Version"); version != "2016-11-15" {
+		t.Fatalf("expected API version 2016-11-15; received %q", version)
+	}
+}
+
+func TestRunInstanceTagSpecifications(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	tags := map[string]string{"Name": "test", "CostCenter": "42"}
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m5.large", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SubnetId: "subnet-12345", Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	for i, resourceType := range []string{"instance", "volume"} {
+		p := fmt.Sprintf("TagSpecification.%d.", i+1)
+		if q.Get(p+"ResourceType") != resourceType {
+			t.Fatalf("expected tags for %s at %s; received %v", resourceType, p, q)
+		}
+		if q.Get(p+"Tag.1.Key") != "CostCenter" || q.Get(p+"Tag.1.Value") != "42" || q.Get(p+"Tag.2.Key") != "Name" || q.Get(p+"Tag.2.Value") != "test" {
+			t.Fatalf("expected the tags of the %s sorted by key; received %v", resourceType, q)
+		}
+	}
+}
+
+func TestRunInstanceWithoutTags(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m5.large", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SubnetId: "subnet-12345"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := transport.Requests[0].URL.Query()["TagSpecification.1.ResourceType"]; ok {
+		t.Fatal("expected no tag specification without tags")
+	}
+}
+
+func TestGetPlacementGroup(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, `<DescribePlacementGroupsResponse>
+  <placementGroupSet>
+    <item>
+      <groupName>hpc</groupName>
+      <strategy>partition</strategy>
+      <partitionCount>3</partitionCount>
+      <state>available</state>
+    </item>
+  </placementGroupSet>
+</DescribePlacementGroupsResponse>`})
+
+	group, err := e.GetPlacementGroup("hpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if group == nil || group.Strategy != "partition" || group.PartitionCount != 3 {
+		t.Fatalf("expected a partition group with 3 partitions; received %v", group)
+	}
+
+	// spread and partition groups are reported from 2016-11-15 on
+	if version := transport.Requests[0].URL.Query().Get("Version"); version != "2016-11-15" {
+		t.Fatalf("expected API version 2016-11-15; received %q", version)
+	}
+}
+
+func TestGetAvailabilityZonesZoneId(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, `<DescribeAvailabilityZonesResponse>
+  <availabilityZoneInfo>
+    <item>
+      <zoneName>us-east-1a</zoneName>
+      <zoneId>use1-az6</zoneId>
+      <zoneState>available</zoneState>
+      <regionName>us-east-1</regionName>
+    </item>
+  </availabilityZoneInfo>
+</DescribeAvailabilityZonesResponse>`})
+
+	zones, err := e.GetAvailabilityZones()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(zones) != 1 || zones[0].ZoneId != "use1-az6" {
+		t.Fatalf("expected zone ID use1-az6; received %v", zones)
+	}
+
+	// zoneId is only returned from 2016-11-15 on
+	if version := transport.Requests[0].URL.Query().Get("Version"); version != "2016-11-15" {
+		t.Fatalf("expected API version 2016-11-15; received %q", version)
+	}
+}
+
+func TestRunInstanceAssignIpv6(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	for _, assign := range []bool{false, true} {
+		if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m5.large", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true, AssignIpv6: assign}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count := transport.Requests[0].URL.Query().Get("NetworkInterface.0.Ipv6AddressCount"); count != "" {
+		t.Fatalf("expected no IPv6 address to be requested; received %q", count)
+	}
+
+	if count := transport.Requests[1].URL.Query().Get("NetworkInterface.0.Ipv6AddressCount"); count != "1" {
+		t.Fatalf("expected one IPv6 address to be requested; received %q", count)
+	}
+}
+
+func TestIpv6ActionsVersion(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	perms := []IpPermission{{IpProtocol: "tcp", FromPort: 22, ToPort: 22, IpRanges: []string{"0.0.0.0/0", "::/0"}}}
+	calls := []func() error{
+		func() error {
+			_, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m5.large", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true, AssignIpv6: true})
+			return err
+		},
+		func() error { return e.AuthorizeSecurityGroup("sg-12345", perms) },
+		func() error { return e.RevokeSecurityGroup("sg-12345", perms) },
+		func() error { _, err := e.GetSecurityGroups(); return err },
+		func() error { _, err := e.GetSecurityGroupById("sg-12345"); return err },
+		func() error { _, err := e.GetInstance("i-12345"); return err },
+		func() error { _, err := e.GetInstances(nil); return err },
+	}
+
+	for _, call := range calls {
+		if err := call(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the 2014-06-15 default predates IPv6
+	for _, req := range transport.Requests {
+		q := req.URL.Query()
+		if version := q.Get("Version"); version != "2016-11-15" {
+			t.Fatalf("expected %s at API version 2016-11-15; received %q", q.Get("Action"), version)
+		}
+	}
+}
+
+func TestModifyInstanceAttribute(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, ""})
+
+	if err := e.ModifyInstanceAttribute("i-12345", "SourceDestCheck", "false"); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("Action") != "ModifyInstanceAttribute" || q.Get("InstanceId") != "i-12345" || q.Get("SourceDestCheck.Value") != "false" {
+		t.Fatalf("unexpected request %v", q)
+	}
+}
+
+func TestRunInstanceVolumeThroughput(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	bdms := []BlockDeviceMapping{
+		{
+			DeviceName: "/dev/sda1",
+			VolumeSize: 16,
+			VolumeType: "gp3",
+			Iops:       4000,
+			Throughput: 250,
+		},
+		{
+			DeviceName: "/dev/sdf",
+			VolumeSize: 8,
+			VolumeType: "gp2",
+		},
+	}
+
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m5.large", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true, BlockDeviceMappings: bdms}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("BlockDeviceMapping.0.Ebs.Throughput") != "250" || q.Get("BlockDeviceMapping.0.Ebs.Iops") != "4000" {
+		t.Fatalf("expected the throughput and IOPS of the gp3 volume; received %v", q)
+	}
+
+	if _, ok := q["BlockDeviceMapping.1.Ebs.Throughput"]; ok {
+		t.Fatal("expected no throughput on the gp2 volume")
+	}
+
+	// Ebs.Throughput is unknown to the 2014-06-15 API
+	if q.Get("Version") != "2016-11-15" {
+		t.Fatalf("expected the throughput to be sent at version 2016-11-15; received %q", q.Get("Version"))
+	}
+}
+
+func TestModifyVolume(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, ""})
+
+	if err := e.ModifyVolume("vol-12345", 64); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("Action") != "ModifyVolume" || q.Get("VolumeId") != "vol-12345" || q.Get("Size") != "64" {
+		t.Fatalf("unexpected request %v", q)
+	}
+}
+
+func TestRunInstanceInstanceProfile(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	for _, profile := range []string{"docker-machine", "arn:aws:iam::123456789012:instance-profile/docker-machine"} {
+		if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m3.medium", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true, IamInstanceProfile: profile}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("IamInstanceProfile.Name") != "docker-machine" || q.Get("IamInstanceProfile.Arn") != "" {
+		t.Fatalf("expected the profile to be passed by name; received %v", q)
+	}
+
+	q = transport.Requests[1].URL.Query()
+	if q.Get("IamInstanceProfile.Arn") != "arn:aws:iam::123456789012:instance-profile/docker-machine" || q.Get("IamInstanceProfile.Name") != "" {
+		t.Fatalf("expected the profile to be passed by ARN; received %v", q)
+	}
+}
+
+func TestRunInstanceMonitoring(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	for _, monitoring := range []bool{false, true} {
+		if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m3.medium", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", AssociatePublicIp: true, Monitoring: monitoring}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := transport.Requests[0].URL.Query()["Monitoring.Enabled"]; ok {
+		t.Fatal("expected basic monitoring by default")
+	}
+
+	if enabled := transport.Requests[1].URL.Query().Get("Monitoring.Enabled"); enabled != "true" {
+		t.Fatalf("expected detailed monitoring to be enabled; received %q", enabled)
+	}
+}
+
+func TestRunInstanceNetworkInterface(t *testing.T) {
+	e, transport := newTestEC2(fakeResponse{http.StatusOK, runInstancesResponse})
+
+	if _, err := e.RunInstance(RunInstanceOptions{AmiId: "ami-12345", InstanceType: "m3.medium", Placement: Placement{Zone: "a"}, MinCount: 1, MaxCount: 1, SecurityGroups: []string{"sg-12345"}, KeyName: "key", SubnetId: "subnet-12345", NetworkInterfaceId: "eni-12345", AssociatePublicIp: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := transport.Requests[0].URL.Query()
+	if q.Get("NetworkInterface.0.NetworkInterfaceId") != "eni-12345" || q.Get("NetworkInterface.0.DeviceIndex") != "0" {
+		t.Fatalf("expected the interface to be attached as the primary one; received %v", q)
+	}
+
+	for _, key := range []string{"NetworkInterface.0.SubnetId", "NetworkInterface.0.SecurityGroupId.0", "NetworkInterface.0.AssociatePublicIpAddress"} {
+		if _, ok := q[key]; ok {
+			t.Fatalf("expected no %s with an existing interface", key)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package amz
 
+import "fmt"
+
 type ErrorResponse struct {
 	Errors []struct {
 		Code    string
@@ -7,3 +9,43 @@ type ErrorResponse struct {
 	} `xml:"Errors>Error"`
 	RequestID string
 }
+
+// ApiError is returned for non-200 API responses and carries the EC2 error
+// code so callers can react to specific failures.
+type ApiError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("Non-200 API response: code=%d message=%s", e.StatusCode, e.Message)
+}
+
+type apiCallError struct {
+	context string
+	err     error
+}
+
+func (e *apiCallError) Error() string {
+	return fmt.Sprintf("%s: %s", e.context, e.err)
+}
+
+// ErrorCode returns the EC2 error code of err, or an empty string if err
+// is not an API error.
+func ErrorCode(err error) string {
+	switch e := err.(type) {
+	case *ApiError:
+		return e.Code
+	case *apiCallError:
+		return ErrorCode(e.err)
+	}
+	return ""
+}
+
+// IsThrottlingError reports whether err is EC2 rejecting the request because
+// of the request rate.
+func IsThrottlingError(err error) bool {
+	code := ErrorCode(err)
+	return code == ErrorRequestLimitExceeded || code == ErrorThrottling
+}
@@ -1,5 +1,19 @@
 package amz
 
 const (
-	ErrorDuplicateGroup = "InvalidGroup.Duplicate"
+	ErrorDuplicateGroup       = "InvalidGroup.Duplicate"
+	ErrorInstanceNotFound     = "InvalidInstanceID.NotFound"
+	ErrorDependencyViolation  = "DependencyViolation"
+	ErrorInternalError        = "InternalError"
+	ErrorUnavailable          = "Unavailable"
+	ErrorInstanceLimit        = "InstanceLimitExceeded"
+	ErrorVcpuLimit            = "VcpuLimitExceeded"
+	ErrorUnsupportedOperation = "UnsupportedOperation"
+	ErrorDuplicateKeyPair     = "InvalidKeyPair.Duplicate"
+	ErrorRequestLimitExceeded = "RequestLimitExceeded"
+	ErrorThrottling           = "Throttling"
+	ErrorAssociationNotFound  = "InvalidAssociationID.NotFound"
+	ErrorInsufficientCapacity = "InsufficientInstanceCapacity"
+	ErrorPlacementGroupInUse  = "InvalidPlacementGroup.InUse"
+	ErrorDryRunOperation      = "DryRunOperation"
 )
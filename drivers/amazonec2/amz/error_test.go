@@ -1 +1,15 @@
 package amz
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	e, _ := newTestEC2(fakeResponse{http.StatusBadRequest, invalidInstanceIdResponse})
+
+	_, err := e.GetInstance("i-1a2b3c4d")
+	if code := ErrorCode(err); code != ErrorInstanceNotFound {
+		t.Fatalf("expected %s; received %q", ErrorInstanceNotFound, code)
+	}
+}
@@ -0,0 +1,137 @@
+package amz
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metadataTokenTTL = "21600"
+
+	// credentials are refreshed this long before they expire so that a
+	// request signed with them does not fail on the way
+	credentialsExpiryWindow = 5 * time.Minute
+)
+
+var (
+	// metadataEndpoint is the instance metadata service. Off EC2 nothing
+	// answers there, the short timeout keeps that from stalling the driver.
+	metadataEndpoint = "http://169.254.169.254"
+	metadataClient   = &http.Client{Timeout: 2 * time.Second}
+)
+
+type roleCredentials struct {
+	Code            string
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// roleCredentialsCache keeps the credentials of the instance role until
+// shortly before they expire.
+type roleCredentialsCache struct {
+	mu      sync.Mutex
+	auth    Auth
+	expires time.Time
+}
+
+var instanceRoleCredentials = &roleCredentialsCache{}
+
+// get returns the credentials and the time from which they are refreshed.
+func (c *roleCredentialsCache) get() (Auth, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	refresh := c.expires.Add(-credentialsExpiryWindow)
+	if c.auth.AccessKey != "" && time.Now().Before(refresh) {
+		return c.auth, refresh, nil
+	}
+
+	creds, err := getRoleCredentials()
+	if err != nil {
+		return Auth{}, time.Time{}, err
+	}
+
+	c.auth = Auth{creds.AccessKeyId, creds.SecretAccessKey, creds.Token}
+	c.expires = creds.Expiration
+
+	return c.auth, c.expires.Add(-credentialsExpiryWindow), nil
+}
+
+// getRoleCredentials reads the credentials of the instance role with
+// IMDSv2, which requires a session token for every metadata request.
+func getRoleCredentials() (roleCredentials, error) {
+	var creds roleCredentials
+
+	req, err := http.NewRequest("PUT", metadataEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return creds, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", metadataTokenTTL)
+
+	token, err := metadataRequest(req)
+	if err != nil {
+		return creds, err
+	}
+
+	roles, err := metadataGet("/latest/meta-data/iam/security-credentials/", token)
+	if err != nil {
+		return creds, err
+	}
+
+	// an instance has at most one role, listed on the first line
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return creds, fmt.Errorf("no instance role found in the instance metadata")
+	}
+
+	body, err := metadataGet("/latest/meta-data/iam/security-credentials/"+role, token)
+	if err != nil {
+		return creds, err
+	}
+
+	if err := json.Unmarshal([]byte(body), &creds); err != nil {
+		return creds, fmt.Errorf("unable to decode the credentials of the instance role %s: %s", role, err)
+	}
+
+	if creds.Code != "Success" || creds.AccessKeyId == "" {
+		return creds, fmt.Errorf("no credentials for the instance role %s: %s", role, creds.Code)
+	}
+
+	return creds, nil
+}
+
+func metadataGet(path, token string) (string, error) {
+	req, err := http.NewRequest("GET", metadataEndpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+
+	return metadataRequest(req)
+}
+
+func metadataRequest(req *http.Request) (string, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata request %s returned %s", req.URL.Path, resp.Status)
+	}
+
+	return string(body), nil
+}
@@ -0,0 +1,72 @@
+package amz
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetAuthInstanceRole(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "session-token")
+			return
+		}
+
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "machine-role")
+		case "/latest/meta-data/iam/security-credentials/machine-role":
+			fmt.Fprintf(w, `{"Code": "Success", "AccessKeyId": "ASIAEXAMPLE", "SecretAccessKey": "secret", "Token": "token", "Expiration": %q}`, expiration)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	defer func(endpoint string) { metadataEndpoint = endpoint }(metadataEndpoint)
+	metadataEndpoint = server.URL
+	instanceRoleCredentials = &roleCredentialsCache{}
+
+	auth := GetAuth("", "", "")
+	if auth.AccessKey != "ASIAEXAMPLE" || auth.SecretKey != "secret" || auth.SessionToken != "token" {
+		t.Fatalf("expected the instance role credentials; received %+v", auth)
+	}
+
+	if auth := GetAuth("access", "secret", ""); auth.AccessKey != "access" {
+		t.Fatalf("expected the given credentials to take precedence; received %+v", auth)
+	}
+
+	if _, refresh := GetAuthWithRefresh("", "", ""); refresh.IsZero() || !refresh.Before(time.Now().Add(time.Hour)) {
+		t.Fatalf("expected the role credentials to be refreshed before they expire; received %s", refresh)
+	}
+
+	if _, refresh := GetAuthWithRefresh("access", "secret", ""); !refresh.IsZero() {
+		t.Fatalf("expected static credentials not to be refreshed; received %s", refresh)
+	}
+}
+
+func TestGetAuthWithoutMetadata(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	defer func(endpoint string) { metadataEndpoint = endpoint }(metadataEndpoint)
+	metadataEndpoint = server.URL
+	instanceRoleCredentials = &roleCredentialsCache{}
+
+	if auth := GetAuth("", "", ""); auth.AccessKey != "" {
+		t.Fatalf("expected empty credentials; received %+v", auth)
+	}
+}
@@ -4,5 +4,20 @@ type IpPermission struct {
 	IpProtocol string `xml:"ipProtocol"`
 	FromPort   int    `xml:"fromPort"`
 	ToPort     int    `xml:"toPort"`
-	IpRange    string `xml:"ipRanges"`
+	// IpRange is the single CIDR to request; described permissions
+	// report all of their ranges in IpRanges and Ipv6Ranges instead.
+	IpRange    string   `xml:"-"`
+	IpRanges   []string `xml:"ipRanges>item>cidrIp"`
+	Ipv6Ranges []string `xml:"ipv6Ranges>item>cidrIpv6"`
+	GroupIds   []string `xml:"groups>item>groupId"`
+}
+
+// Ranges returns every IPv4 and IPv6 CIDR covered by the permission.
+func (p IpPermission) Ranges() []string {
+	ranges := []string{}
+	if p.IpRange != "" {
+		ranges = append(ranges, p.IpRange)
+	}
+	ranges = append(ranges, p.IpRanges...)
+	return append(ranges, p.Ipv6Ranges...)
 }
@@ -0,0 +1,103 @@
+package amz
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// requestLimiter caps the number of in-flight API requests and the rate at
+// which new ones are started. It is shared by every EC2 client in the
+// process so that many drivers together stay below the account limits.
+type requestLimiter struct {
+	mu       sync.Mutex
+	slots    chan struct{}
+	interval time.Duration
+	next     time.Time
+}
+
+var (
+	limiter     = &requestLimiter{}
+	limiterOnce sync.Once
+)
+
+// SetRequestLimits limits all EC2 clients in the process to maxConcurrent
+// in-flight requests and perSecond new requests per second. Zero disables
+// the respective limit.
+//
+// Only the first call takes effect, replacing the limits while requests are
+// in flight would lose track of them. Clients that send requests before any
+// call use the AWS_MAX_CONCURRENT_REQUESTS and AWS_REQUESTS_PER_SECOND
+// environment variables.
+func SetRequestLimits(maxConcurrent int, perSecond int) {
+	limiterOnce.Do(func() {
+		limiter.configure(maxConcurrent, perSecond)
+	})
+}
+
+// requestLimits returns the process-wide limiter, configured from the
+// environment if SetRequestLimits has not been called.
+func requestLimits() *requestLimiter {
+	limiterOnce.Do(func() {
+		limiter.configure(
+			envInt("AWS_MAX_CONCURRENT_REQUESTS"),
+			envInt("AWS_REQUESTS_PER_SECOND"),
+		)
+	})
+	return limiter
+}
+
+func (l *requestLimiter) configure(maxConcurrent int, perSecond int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.slots = nil
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+
+	l.interval = 0
+	if perSecond > 0 {
+		l.interval = time.Second / time.Duration(perSecond)
+	}
+}
+
+// envInt returns the integer value of the environment variable, or 0 when
+// it is unset or not a number.
+func envInt(name string) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// acquire blocks until a request may be sent and returns the function that
+// must be called once it has completed.
+func (l *requestLimiter) acquire() func() {
+	l.mu.Lock()
+	slots := l.slots
+	wait := time.Duration(0)
+	if l.interval > 0 {
+		now := time.Now()
+		if l.next.After(now) {
+			wait = l.next.Sub(now)
+		} else {
+			l.next = now
+		}
+		l.next = l.next.Add(l.interval)
+	}
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+
+	if slots == nil {
+		return func() {}
+	}
+
+	slots <- struct{}{}
+	return func() {
+		<-slots
+	}
+}
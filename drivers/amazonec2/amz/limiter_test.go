@@ -0,0 +1,96 @@
+package amz
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiterConcurrency(t *testing.T) {
+	l := &requestLimiter{slots: make(chan struct{}, 2)}
+
+	var mu sync.Mutex
+	current, max := 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := l.acquire()
+			defer release()
+
+			mu.Lock()
+			current++
+			if current > max {
+				max = current
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			current--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if max > 2 {
+		t.Fatalf("expected at most 2 concurrent requests; received %d", max)
+	}
+}
+
+func TestRequestLimiterRate(t *testing.T) {
+	l := &requestLimiter{interval: 10 * time.Millisecond}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		l.acquire()()
+	}
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("expected requests to be spaced out; 5 requests took %s", elapsed)
+	}
+}
+
+func TestSetRequestLimitsOnlyFirstCall(t *testing.T) {
+	defer func() {
+		limiter = &requestLimiter{}
+		limiterOnce = sync.Once{}
+	}()
+	limiter = &requestLimiter{}
+	limiterOnce = sync.Once{}
+
+	SetRequestLimits(2, 0)
+	release := requestLimits().acquire()
+	defer release()
+
+	// a later driver without limits must not reset the shared limiter
+	SetRequestLimits(0, 0)
+
+	if cap(limiter.slots) != 2 {
+		t.Fatalf("expected the first limit of 2 to be kept; received %d", cap(limiter.slots))
+	}
+
+	if len(limiter.slots) != 1 {
+		t.Fatalf("expected the in-flight request to be counted; received %d", len(limiter.slots))
+	}
+}
+
+func TestRequestLimitsFromEnvironment(t *testing.T) {
+	defer func() {
+		limiter = &requestLimiter{}
+		limiterOnce = sync.Once{}
+	}()
+	limiter = &requestLimiter{}
+	limiterOnce = sync.Once{}
+
+	defer os.Setenv("AWS_MAX_CONCURRENT_REQUESTS", os.Getenv("AWS_MAX_CONCURRENT_REQUESTS"))
+	os.Setenv("AWS_MAX_CONCURRENT_REQUESTS", "3")
+
+	if l := requestLimits(); cap(l.slots) != 3 {
+		t.Fatalf("expected a limit of 3 from the environment; received %d", cap(l.slots))
+	}
+}
@@ -0,0 +1,41 @@
+package amz
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	PartitionAWS      = "aws"
+	PartitionAWSChina = "aws-cn"
+	PartitionAWSGov   = "aws-us-gov"
+)
+
+var partitionDomains = map[string]string{
+	PartitionAWS:      "amazonaws.com",
+	PartitionAWSChina: "amazonaws.com.cn",
+	PartitionAWSGov:   "amazonaws.com",
+}
+
+// PartitionForRegion guesses the partition of a region from its prefix.
+func PartitionForRegion(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return PartitionAWSChina
+	case strings.HasPrefix(region, "us-gov-"):
+		return PartitionAWSGov
+	}
+	return PartitionAWS
+}
+
+// ValidatePartition returns an error for unknown partitions.
+func ValidatePartition(partition string) error {
+	if _, ok := partitionDomains[partition]; !ok {
+		return fmt.Errorf("invalid partition %q: must be one of %s, %s or %s", partition, PartitionAWS, PartitionAWSChina, PartitionAWSGov)
+	}
+	return nil
+}
+
+func endpointFor(region, partition string) string {
+	return fmt.Sprintf("https://ec2.%s.%s", region, partitionDomains[partition])
+}
@@ -0,0 +1,29 @@
+package amz
+
+import "testing"
+
+func TestPartitionForRegion(t *testing.T) {
+	cases := map[string]string{
+		"us-east-1":     PartitionAWS,
+		"cn-north-1":    PartitionAWSChina,
+		"us-gov-west-1": PartitionAWSGov,
+	}
+
+	for region, expected := range cases {
+		if p := PartitionForRegion(region); p != expected {
+			t.Fatalf("expected partition %s for %s; received %s", expected, region, p)
+		}
+	}
+}
+
+func TestNewEC2Partition(t *testing.T) {
+	e := NewEC2(GetAuth("access", "secret", ""), "cn-north-1", PartitionAWSChina)
+	if e.Endpoint != "https://ec2.cn-north-1.amazonaws.com.cn" {
+		t.Fatalf("unexpected endpoint %s", e.Endpoint)
+	}
+
+	e = NewEC2(GetAuth("access", "secret", ""), "us-east-1", "")
+	if e.Endpoint != "https://ec2.us-east-1.amazonaws.com" {
+		t.Fatalf("unexpected endpoint %s", e.Endpoint)
+	}
+}
@@ -0,0 +1,12 @@
+package amz
+
+// Placement describes where RunInstance launches the instance. Zone is the
+// zone letter, it is prefixed with the region of the client.
+type Placement struct {
+	Zone                 string
+	Tenancy              string
+	HostResourceGroupArn string
+	HostId               string
+	Affinity             string
+	GroupName            string
+}
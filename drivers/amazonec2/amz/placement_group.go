@@ -0,0 +1,13 @@
+package amz
+
+type PlacementGroup struct {
+	GroupName      string `xml:"groupName"`
+	Strategy       string `xml:"strategy"`
+	PartitionCount int    `xml:"partitionCount"`
+	State          string `xml:"state"`
+}
+
+type DescribePlacementGroupsResponse struct {
+	RequestId       string           `xml:"requestId"`
+	PlacementGroups []PlacementGroup `xml:"placementGroupSet>item"`
+}
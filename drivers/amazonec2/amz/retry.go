@@ -0,0 +1,65 @@
+package amz
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultThrottleAttempts  = 5
+	DefaultThrottleBaseDelay = 500 * time.Millisecond
+
+	maxThrottleDelay = 20 * time.Second
+)
+
+// throttleRetry holds how requests EC2 rejects because of the request rate
+// are retried. It is shared by every EC2 client in the process.
+type throttleRetry struct {
+	mu        sync.Mutex
+	attempts  int
+	baseDelay time.Duration
+}
+
+var throttling = &throttleRetry{
+	attempts:  DefaultThrottleAttempts,
+	baseDelay: DefaultThrottleBaseDelay,
+}
+
+// SetThrottleRetries makes all EC2 clients in the process try a throttled
+// request up to attempts times, backing off exponentially from baseDelay.
+func SetThrottleRetries(attempts int, baseDelay time.Duration) {
+	throttling.mu.Lock()
+	defer throttling.mu.Unlock()
+
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	throttling.attempts = attempts
+	throttling.baseDelay = baseDelay
+}
+
+func (t *throttleRetry) settings() (int, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.attempts, t.baseDelay
+}
+
+// throttleBackoff returns the delay before the retry following attempt,
+// which starts at 0. The delay doubles with every attempt and is jittered
+// so that clients throttled together do not retry in lockstep.
+func throttleBackoff(baseDelay time.Duration, attempt int) time.Duration {
+	delay := baseDelay << uint(attempt)
+	if delay > maxThrottleDelay || delay <= 0 {
+		delay = maxThrottleDelay
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
@@ -0,0 +1,56 @@
+package amz
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+const throttlingResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+  <Errors>
+    <Error>
+      <Code>Throttling</Code>
+      <Message>Rate exceeded</Message>
+    </Error>
+  </Errors>
+  <RequestID>ea966190-f9aa-478e-9ede-example</RequestID>
+</Response>`
+
+func TestThrottledRequestRetried(t *testing.T) {
+	defer SetThrottleRetries(DefaultThrottleAttempts, DefaultThrottleBaseDelay)
+	SetThrottleRetries(DefaultThrottleAttempts, time.Millisecond)
+
+	e, transport := newTestEC2(
+		fakeResponse{http.StatusBadRequest, throttlingResponse},
+		fakeResponse{http.StatusBadRequest, throttlingResponse},
+		fakeResponse{http.StatusOK, describeInstancesPageResponse},
+	)
+
+	inst, err := e.GetInstance("i-1a2b3c4d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inst.InstanceId != "i-1a2b3c4d" {
+		t.Fatalf("unexpected instance decoded: %+v", inst)
+	}
+
+	if len(transport.Requests) != 3 {
+		t.Fatalf("expected 3 requests; received %d", len(transport.Requests))
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := throttleBackoff(time.Second, attempt)
+		max := time.Second << uint(attempt)
+		if max > maxThrottleDelay {
+			max = maxThrottleDelay
+		}
+
+		if delay < max/2 || delay > max {
+			t.Fatalf("expected a delay between %s and %s for attempt %d; received %s", max/2, max, attempt, delay)
+		}
+	}
+}
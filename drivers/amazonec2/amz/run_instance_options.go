@@ -0,0 +1,33 @@
+package amz
+
+// RunInstanceOptions describes the instances RunInstance launches.
+// RequestSpotInstances uses the same launch specification, without the
+// counts, an existing network interface, IPv6 and hibernation.
+type RunInstanceOptions struct {
+	AmiId        string
+	InstanceType string
+	Placement    Placement
+	MinCount     int
+	MaxCount     int
+	// SecurityGroups, SubnetId, AssociatePublicIp and AssignIpv6 are
+	// ignored with a NetworkInterfaceId, the interface brings its own.
+	SecurityGroups      []string
+	KeyName             string
+	SubnetId            string
+	NetworkInterfaceId  string
+	AssociatePublicIp   bool
+	AssignIpv6          bool
+	BlockDeviceMappings []BlockDeviceMapping
+	EbsOptimized        bool
+	Hibernate           bool
+	Monitoring          bool
+	// IamInstanceProfile is the name or the ARN of the instance profile.
+	IamInstanceProfile string
+	// UserData is passed base64 encoded.
+	UserData string
+	// ClientToken makes retries of the same launch idempotent.
+	ClientToken string
+	// Tags are applied to the instance and its volumes at launch. A spot
+	// request only tags the request itself.
+	Tags map[string]string
+}
@@ -0,0 +1,93 @@
+package amz
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const timeFormatV4 = "20060102T150405Z"
+
+// signV4 signs the request with AWS Signature Version 4 for the given region
+// and service. Unlike deriving them from the host name this also works for
+// endpoints outside the standard partition, e.g. amazonaws.com.cn.
+func signV4(req *http.Request, auth Auth, region, service string, now time.Time) {
+	if auth.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", auth.SessionToken)
+	}
+
+	if req.Header.Get("X-Amz-Date") == "" {
+		req.Header.Set("X-Amz-Date", now.UTC().Format(timeFormatV4))
+	}
+
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+
+	payloadHash := hashSHA256([]byte{})
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("Host", req.URL.Host)
+
+	keys := []string{}
+	for key := range req.Header {
+		if key == "Content-Type" || key == "Host" || strings.HasPrefix(key, "X-Amz-") {
+			keys = append(keys, strings.ToLower(key))
+		}
+	}
+	sort.Strings(keys)
+
+	headers := ""
+	for _, key := range keys {
+		headers += key + ":" + strings.TrimSpace(req.Header.Get(key)) + "\n"
+	}
+	signedHeaders := strings.Join(keys, ";")
+
+	// Go encodes a space as '+' but Amazon requires '%20'
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.Path,
+		query,
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	timestamp := req.Header.Get("X-Amz-Date")
+	date := timestamp[:8]
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		timestamp,
+		scope,
+		hashSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+auth.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+auth.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, content string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+func hashSHA256(content []byte) string {
+	h := sha256.New()
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,37 @@
+package amz
+
+type SpotInstanceRequest struct {
+	SpotInstanceRequestId string `xml:"spotInstanceRequestId"`
+	SpotPrice             string `xml:"spotPrice"`
+	Type                  string `xml:"type"`
+	State                 string `xml:"state"`
+	Fault                 struct {
+		Code    string `xml:"code"`
+		Message string `xml:"message"`
+	} `xml:"fault"`
+	Status struct {
+		Code       string `xml:"code"`
+		UpdateTime string `xml:"updateTime"`
+		Message    string `xml:"message"`
+	} `xml:"status"`
+	InstanceId                   string `xml:"instanceId"`
+	InstanceInterruptionBehavior string `xml:"instanceInterruptionBehavior"`
+}
+
+type RequestSpotInstancesResponse struct {
+	RequestId              string                `xml:"requestId"`
+	SpotInstanceRequestSet []SpotInstanceRequest `xml:"spotInstanceRequestSet>item"`
+}
+
+type DescribeSpotInstanceRequestsResponse struct {
+	RequestId              string                `xml:"requestId"`
+	SpotInstanceRequestSet []SpotInstanceRequest `xml:"spotInstanceRequestSet>item"`
+}
+
+type CancelSpotInstanceRequestsResponse struct {
+	RequestId              string `xml:"requestId"`
+	SpotInstanceRequestSet []struct {
+		SpotInstanceRequestId string `xml:"spotInstanceRequestId"`
+		State                 string `xml:"state"`
+	} `xml:"spotInstanceRequestSet>item"`
+}
@@ -0,0 +1,11 @@
+package amz
+
+type CreateSubnetResponse struct {
+	RequestId string `xml:"requestId"`
+	Subnet    Subnet `xml:"subnet"`
+}
+
+type DeleteSubnetResponse struct {
+	RequestId string `xml:"requestId"`
+	Return    bool   `xml:"return"`
+}
@@ -4,3 +4,13 @@ type CreateTagsResponse struct {
 	RequestId string `xml:"requestId"`
 	Return    bool   `xml:"return"`
 }
+
+type DeleteTagsResponse struct {
+	RequestId string `xml:"requestId"`
+	Return    bool   `xml:"return"`
+}
+
+type Tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
@@ -0,0 +1,78 @@
+package amazonec2
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type fakeResponse struct {
+	StatusCode int
+	Body       string
+}
+
+// fakeEC2 replays canned responses per API action. The last response of an
+// action is repeated once the others have been used.
+type fakeEC2 struct {
+	Responses map[string][]fakeResponse
+	Requests  []*http.Request
+}
+
+func (f *fakeEC2) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.Requests = append(f.Requests, req)
+
+	action := req.URL.Query().Get("Action")
+	r := fakeResponse{http.StatusOK, ""}
+	if responses := f.Responses[action]; len(responses) > 0 {
+		r = responses[0]
+		if len(responses) > 1 {
+			f.Responses[action] = responses[1:]
+		}
+	}
+
+	return &http.Response{
+		StatusCode: r.StatusCode,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(r.Body)),
+		Request:    req,
+	}, nil
+}
+
+// requests returns the requests made for the given action.
+func (f *fakeEC2) requests(action string) []*http.Request {
+	reqs := []*http.Request{}
+	for _, req := range f.Requests {
+		if req.URL.Query().Get("Action") == action {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+func describeInstancesResponse(instanceId, state string) string {
+	return `<DescribeInstancesResponse>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>` + instanceId + `</instanceId>
+          <instanceState>
+            <name>` + state + `</name>
+          </instanceState>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`
+}
+
+func errorResponse(code, message string) string {
+	return `<Response>
+  <Errors>
+    <Error>
+      <Code>` + code + `</Code>
+      <Message>` + message + `</Message>
+    </Error>
+  </Errors>
+</Response>`
+}
@@ -0,0 +1,47 @@
+package amazonec2
+
+import (
+	"time"
+)
+
+// ProgressEventType identifies a step of the machine creation.
+type ProgressEventType string
+
+const (
+	KeyPairCreated     ProgressEventType = "KeyPairCreated"
+	SecurityGroupReady ProgressEventType = "SecurityGroupReady"
+	InstanceLaunched   ProgressEventType = "InstanceLaunched"
+	IPAssigned         ProgressEventType = "IPAssigned"
+	SSHReady           ProgressEventType = "SSHReady"
+)
+
+// ProgressEvent reports that a step of the machine creation completed.
+// Detail is the resource the step produced, e.g. the instance ID for
+// InstanceLaunched or the address for IPAssigned.
+type ProgressEvent struct {
+	Type        ProgressEventType
+	MachineName string
+	Detail      string
+	Time        time.Time
+}
+
+// SetProgressHandler registers a function that Create calls as each step
+// completes, for callers that show the progress of a create. The handler is
+// called synchronously and should return quickly. Without a handler the
+// progress is only logged.
+func (d *Driver) SetProgressHandler(handler func(ProgressEvent)) {
+	d.progressHandler = handler
+}
+
+func (d *Driver) emitProgress(eventType ProgressEventType, detail string) {
+	if d.progressHandler == nil {
+		return
+	}
+
+	d.progressHandler(ProgressEvent{
+		Type:        eventType,
+		MachineName: d.MachineName,
+		Detail:      detail,
+		Time:        time.Now(),
+	})
+}
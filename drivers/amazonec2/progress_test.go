@@ -0,0 +1,34 @@
+package amazonec2
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEmitProgress(t *testing.T) {
+	d := &Driver{MachineName: "test-host"}
+
+	// without a handler the events are dropped
+	d.emitProgress(KeyPairCreated, "test-host")
+
+	events := []ProgressEvent{}
+	d.SetProgressHandler(func(e ProgressEvent) {
+		events = append(events, e)
+	})
+
+	d.emitProgress(InstanceLaunched, "i-12345")
+	d.emitProgress(IPAssigned, "203.0.113.10")
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events; received %d", len(events))
+	}
+
+	if events[0].Type != InstanceLaunched || events[0].Detail != "i-12345" || events[0].MachineName != "test-host" {
+		t.Fatalf("unexpected event %+v", events[0])
+	}
+
+	// the handler is not part of the saved machine
+	if _, err := json.Marshal(d); err != nil {
+		t.Fatal(err)
+	}
+}
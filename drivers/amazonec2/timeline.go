@@ -0,0 +1,55 @@
+package amazonec2
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type phaseTiming struct {
+	Phase    string  `json:"phase"`
+	Duration float64 `json:"seconds"`
+}
+
+// timeline records how long each phase of a create takes.
+type timeline struct {
+	start  time.Time
+	last   time.Time
+	phases []phaseTiming
+}
+
+func newTimeline() *timeline {
+	now := time.Now()
+	return &timeline{start: now, last: now}
+}
+
+// mark records the time spent since the previous mark as the given phase.
+func (t *timeline) mark(phase string) {
+	now := time.Now()
+	elapsed := now.Sub(t.last)
+	t.last = now
+
+	t.phases = append(t.phases, phaseTiming{
+		Phase:    phase,
+		Duration: elapsed.Seconds(),
+	})
+
+	log.Debugf("%s took %s", phase, elapsed)
+}
+
+// summary returns the recorded phases and the total as JSON.
+func (t *timeline) summary() string {
+	b, err := json.Marshal(struct {
+		Phases []phaseTiming `json:"phases"`
+		Total  float64       `json:"total_seconds"`
+	}{
+		Phases: t.phases,
+		Total:  t.last.Sub(t.start).Seconds(),
+	})
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
+}
@@ -0,0 +1,28 @@
+package amazonec2
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTimelineSummary(t *testing.T) {
+	tl := newTimeline()
+	tl.mark("keypair")
+	tl.mark("security group")
+
+	var summary struct {
+		Phases []phaseTiming `json:"phases"`
+	}
+
+	if err := json.Unmarshal([]byte(tl.summary()), &summary); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summary.Phases) != 2 {
+		t.Fatalf("expected 2 phases; received %d", len(summary.Phases))
+	}
+
+	if summary.Phases[1].Phase != "security group" {
+		t.Fatalf("expected the security group phase; received %s", summary.Phases[1].Phase)
+	}
+}
@@ -1,7 +1,20 @@
 package amazonec2
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/drivers/amazonec2/amz"
 )
 
 var (
@@ -10,6 +23,17 @@ var (
 	errMachineFailure = errors.New("Machine failed to start")
 	errNoIP           = errors.New("No IP Address associated with the instance")
 	errComplete       = errors.New("Complete")
+
+	// IAM allows commas in names, but a comma here almost always means a
+	// list of profiles was passed, so it is rejected as well
+	instanceProfileNamePattern = regexp.MustCompile(`^[\w+=.@-]{1,128}$`)
+
+	// arn:<partition>:iam::<account>:instance-profile/<path/><name>
+	instanceProfileArnPattern = regexp.MustCompile(`^arn:aws(-[a-z]+)*:iam::\d{12}:instance-profile/([\w+=,.@-]+/)*[\w+=.@-]{1,128}$`)
+
+	ubuntuReleasePattern = regexp.MustCompile(`^[a-z]+$`)
+
+	hostnameLabelPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
 )
 
 type region struct {
@@ -49,3 +73,409 @@ func validateAwsRegion(region string) (string, error) {
 
 	return "", errInvalidRegion
 }
+
+// newestTrustedImage returns the most recently created image whose owner is
+// in the owners allow-list, or nil if there is none.
+func newestTrustedImage(images []amz.Image, owners []string) *amz.Image {
+	var newest *amz.Image
+
+	for i := range images {
+		image := &images[i]
+		if !containsString(owners, image.ImageOwnerId) {
+			continue
+		}
+
+		// creation dates are ISO 8601 so they sort lexically
+		if newest == nil || image.CreationDate > newest.CreationDate {
+			newest = image
+		}
+	}
+
+	return newest
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	list := []string{}
+
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// pickSubnet deterministically selects one of the subnets based on the
+// machine name so that machines of a cluster spread across all of them.
+func pickSubnet(machineName string, subnets []string) string {
+	if len(subnets) == 0 {
+		return ""
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(machineName))
+
+	return subnets[h.Sum32()%uint32(len(subnets))]
+}
+
+// samePermission reports whether two ingress rules cover the same protocol,
+// ports and CIDR ranges.
+// splitPermissions returns the permissions with one CIDR block each, the way
+// docker-machine requests them. EC2 describes all blocks of a port, IPv4 and
+// IPv6, in a single permission. Permissions for security groups are kept
+// as they are.
+func splitPermissions(perms []amz.IpPermission) []amz.IpPermission {
+	split := []amz.IpPermission{}
+	for _, p := range perms {
+		if len(p.GroupIds) != 0 || len(p.Ranges()) == 0 {
+			split = append(split, p)
+			continue
+		}
+
+		for _, cidr := range p.Ranges() {
+			split = append(split, amz.IpPermission{
+				IpProtocol: p.IpProtocol,
+				FromPort:   p.FromPort,
+				ToPort:     p.ToPort,
+				IpRange:    cidr,
+			})
+		}
+	}
+
+	return split
+}
+
+func samePermission(a, b amz.IpPermission) bool {
+	if a.IpProtocol != b.IpProtocol || a.FromPort != b.FromPort || a.ToPort != b.ToPort {
+		return false
+	}
+
+	if len(a.GroupIds) != 0 || len(b.GroupIds) != 0 {
+		return false
+	}
+
+	ra, rb := a.Ranges(), b.Ranges()
+	if len(ra) != len(rb) {
+		return false
+	}
+
+	for _, r := range ra {
+		if !containsString(rb, r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// installDockerCommand returns the shell command installing Docker with the
+// given method, pinned to version when it is not empty.
+func installDockerCommand(method, version string) string {
+	if method == "package" {
+		apt, yum := "docker.io", "docker"
+		if version != "" {
+			apt += "=" + version + "*"
+			yum += "-" + version
+		}
+
+		return fmt.Sprintf(
+			"if command -v apt-get >/dev/null 2>&1; then sudo apt-get update && sudo apt-get install -y %s; else sudo yum install -y %s; fi",
+			apt,
+			yum,
+		)
+	}
+
+	if version != "" {
+		return fmt.Sprintf("curl -sSL %s | sudo VERSION=%s sh -", dockerInstallScriptURL, version)
+	}
+
+	return fmt.Sprintf("curl -sSL %s | sudo sh -", dockerInstallScriptURL)
+}
+
+// upgradeDockerCommand upgrades Docker with the package manager of the
+// instance, apt-get on Debian and Ubuntu or yum on Amazon Linux, CentOS and
+// RHEL.
+const upgradeDockerCommand = "if command -v apt-get >/dev/null 2>&1; then sudo apt-get update && sudo apt-get install --upgrade lxc-docker; else sudo yum update -y docker; fi"
+
+// growRootFilesystemCommand grows the root partition, if the root filesystem
+// is on one, and then the filesystem to the size of the disk. growpart fails
+// when there is nothing to grow, which is not an error here.
+const growRootFilesystemCommand = "root=$(findmnt -n -o SOURCE /); " +
+	"part=/sys/class/block/$(basename $root)/partition; " +
+	"if [ -e $part ]; then sudo growpart /dev/$(lsblk -no PKNAME $root) $(cat $part) || true; fi; " +
+	"if [ \"$(findmnt -n -o FSTYPE /)\" = xfs ]; then sudo xfs_growfs /; else sudo resize2fs $root; fi"
+
+// newClientToken returns a random token identifying one instance launch.
+func newClientToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// cidrContains reports whether the inner CIDR block lies within the outer one.
+func cidrContains(outer, inner string) (bool, error) {
+	_, outerNet, err := net.ParseCIDR(outer)
+	if err != nil {
+		return false, err
+	}
+
+	_, innerNet, err := net.ParseCIDR(inner)
+	if err != nil {
+		return false, err
+	}
+
+	outerSize, _ := outerNet.Mask.Size()
+	innerSize, _ := innerNet.Mask.Size()
+
+	return outerNet.Contains(innerNet.IP) && innerSize >= outerSize, nil
+}
+
+// parseTags parses a comma-separated list of key=value tags. A list without
+// any "=" is read as alternating keys and values, k1,v1,k2,v2.
+func parseTags(value string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	if !strings.Contains(value, "=") {
+		parts := strings.Split(value, ",")
+		if strings.TrimSpace(value) == "" {
+			return tags, nil
+		}
+
+		if len(parts)%2 != 0 {
+			return nil, fmt.Errorf("tags %q are not of the form key,value pairs", value)
+		}
+
+		for i := 0; i < len(parts); i += 2 {
+			key := strings.TrimSpace(parts[i])
+			if key == "" {
+				return nil, fmt.Errorf("tags %q contain an empty key", value)
+			}
+
+			tags[key] = strings.TrimSpace(parts[i+1])
+		}
+
+		return tags, nil
+	}
+
+	for _, tag := range splitList(value) {
+		parts := strings.SplitN(tag, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("tag %q is not of the form key=value", tag)
+		}
+
+		tags[key] = strings.TrimSpace(parts[1])
+	}
+
+	return tags, nil
+}
+
+// normalizeCIDRs validates ingress CIDR blocks. Bare addresses are turned
+// into single host blocks, /32 for IPv4 and /128 for IPv6.
+func normalizeCIDRs(values []string) ([]string, error) {
+	cidrs := []string{}
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR block %q", value)
+			}
+
+			if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR block %q", value)
+		}
+
+		cidrs = append(cidrs, ipNet.String())
+	}
+
+	return cidrs, nil
+}
+
+// validateInstanceProfile checks that value names a single IAM instance
+// profile. An instance can only have one profile.
+func validateInstanceProfile(value string) error {
+	if strings.ContainsAny(value, ", \t") {
+		return fmt.Errorf("invalid --amazonec2-iam-instance-profile %q: an instance takes a single profile name or ARN", value)
+	}
+
+	if strings.HasPrefix(value, "arn:") {
+		if !instanceProfileArnPattern.MatchString(value) {
+			return fmt.Errorf("invalid --amazonec2-iam-instance-profile %q: expected an ARN of the form arn:aws:iam::123456789012:instance-profile/name", value)
+		}
+		return nil
+	}
+
+	if !instanceProfileNamePattern.MatchString(value) {
+		return fmt.Errorf("invalid --amazonec2-iam-instance-profile %q: names consist of up to 128 letters, digits and +=.@_- characters", value)
+	}
+
+	return nil
+}
+
+// parseAdditionalVolume parses a device:sizeGB:type volume specification,
+// e.g. /dev/sdb:100:gp2.
+func parseAdditionalVolume(value string) (AdditionalVolume, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return AdditionalVolume{}, fmt.Errorf("invalid --amazonec2-additional-volume %q, expected device:sizeGB:type", value)
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size <= 0 {
+		return AdditionalVolume{}, fmt.Errorf("invalid --amazonec2-additional-volume %q, the size must be a positive number of GB", value)
+	}
+
+	if !strings.HasPrefix(parts[0], "/dev/") {
+		return AdditionalVolume{}, fmt.Errorf("invalid --amazonec2-additional-volume %q, the device must be a /dev/ name", value)
+	}
+
+	switch parts[2] {
+	case "standard", "gp2", "gp3", "st1", "sc1":
+	default:
+		return AdditionalVolume{}, fmt.Errorf("invalid --amazonec2-additional-volume %q, expected the type standard, gp2, gp3, st1 or sc1", value)
+	}
+
+	return AdditionalVolume{
+		DeviceName: parts[0],
+		Size:       size,
+		VolumeType: parts[2],
+	}, nil
+}
+
+// instanceStoreDevice returns the device the instance store volume i is
+// mapped to, starting at /dev/sdb.
+func instanceStoreDevice(i int) string {
+	return fmt.Sprintf("/dev/sd%c", 'b'+i)
+}
+
+// parseCredentialsProfile returns the keys of a profile section of an AWS
+// shared credentials file, and whether the profile was found.
+func parseCredentialsProfile(data, profile string) (map[string]string, bool) {
+	values := map[string]string{}
+	found, inProfile := false, false
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			found = found || inProfile
+			continue
+		}
+
+		if !inProfile {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	return values, found
+}
+
+// parseOpenPort parses a port/protocol value, the protocol defaults to tcp.
+func parseOpenPort(value string) (int, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(value), "/", 2)
+
+	port, err := strconv.Atoi(parts[0])
+	if err != nil || port < 1 || port > 65535 {
+		return 0, "", fmt.Errorf("the port must be a number between 1 and 65535")
+	}
+
+	protocol := "tcp"
+	if len(parts) == 2 {
+		protocol = strings.ToLower(parts[1])
+	}
+
+	if protocol != "tcp" && protocol != "udp" {
+		return 0, "", fmt.Errorf("the protocol must be tcp or udp")
+	}
+
+	return port, protocol, nil
+}
+
+// validateHostname checks that value is a legal hostname, dot-separated
+// labels of letters, digits and inner hyphens, see RFC 1123.
+func validateHostname(value string) error {
+	if len(value) > 253 {
+		return fmt.Errorf("a hostname has at most 253 characters")
+	}
+
+	for _, label := range strings.Split(value, ".") {
+		if !hostnameLabelPattern.MatchString(label) {
+			return fmt.Errorf("each label of a hostname has 1 to 63 letters, digits or inner hyphens")
+		}
+	}
+
+	return nil
+}
+
+// sshAnswers reports whether a server at addr sends a greeting, which sshd
+// only does once it accepts connections.
+func sshAnswers(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+
+	return err == nil
+}
+
+// sameTransport reports whether both are the same transport. Transports are
+// compared by identity, comparing the interface values panics for
+// transports of types that are not comparable. Transports that are not
+// pointers are never the same.
+func sameTransport(a, b http.RoundTripper) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Type() != vb.Type() {
+		return false
+	}
+
+	switch va.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Chan, reflect.UnsafePointer:
+		return va.Pointer() == vb.Pointer()
+	}
+
+	return false
+}
@@ -72,6 +72,27 @@ type Driver interface {
 	GetSSHCommand(args ...string) (*exec.Cmd, error)
 }
 
+// EndpointVerifier is implemented by drivers that can check that the Docker
+// daemon is reachable with TLS on the URL they advertise.
+type EndpointVerifier interface {
+	// VerifyDockerEndpoint is called once TLS has been configured
+	VerifyDockerEndpoint() error
+}
+
+// DryRunner is implemented by drivers that can check a create without
+// creating anything.
+type DryRunner interface {
+	// IsDryRun reports whether Create only checks that the host could be
+	// created. There is no host to provision or save afterwards.
+	IsDryRun() bool
+}
+
+// IsDryRun reports whether the driver is configured for a dry run.
+func IsDryRun(d Driver) bool {
+	dr, ok := d.(DryRunner)
+	return ok && dr.IsDryRun()
+}
+
 // RegisteredDriver is used to register a driver with the Register function.
 // It has two attributes:
 // - New: a function that returns a new driver given a path to store host
@@ -143,4 +164,5 @@ type DriverOptions interface {
 	String(key string) string
 	Int(key string) int
 	Bool(key string) bool
+	StringSlice(key string) []string
 }
@@ -114,12 +114,18 @@ func (h *Host) ConfigureSwarm(discovery string, master bool, host string, addr s
 	}
 
 	if addr == "" {
-		ip, err := d.GetIP()
+		dockerUrl, err := d.GetURL()
 		if err != nil {
 			return err
 		}
-		// TODO: remove hardcoded port
-		addr = fmt.Sprintf("%s:2376", ip)
+		u, err := url.Parse(dockerUrl)
+		if err != nil {
+			return err
+		}
+		addr = u.Host
+		if !strings.Contains(addr, ":") {
+			addr = fmt.Sprintf("%s:2376", addr)
+		}
 	}
 
 	basePath := d.GetDockerConfigDir()
@@ -387,6 +393,11 @@ func (h *Host) Create(name string) error {
 		return err
 	}
 
+	// a dry run created nothing to provision
+	if drivers.IsDryRun(h.Driver) {
+		return nil
+	}
+
 	// install docker
 	if err := h.Provision(); err != nil {
 		return err
@@ -11,6 +11,12 @@ import (
 )
 
 func GetSSHCommand(host string, port int, user string, sshKey string, args ...string) *exec.Cmd {
+	return GetSSHCommandWithOptions(host, port, user, sshKey, nil, args...)
+}
+
+// GetSSHCommandWithOptions is GetSSHCommand with extra ssh options, which
+// are passed before the destination.
+func GetSSHCommandWithOptions(host string, port int, user string, sshKey string, options []string, args ...string) *exec.Cmd {
 
 	defaultSSHArgs := []string{
 		"-o", "IdentitiesOnly=yes",
@@ -19,10 +25,11 @@ func GetSSHCommand(host string, port int, user string, sshKey string, args ...st
 		"-o", "LogLevel=quiet", // suppress "Warning: Permanently added '[localhost]:2022' (ECDSA) to the list of known hosts."
 		"-p", fmt.Sprintf("%d", port),
 		"-i", sshKey,
-		fmt.Sprintf("%s@%s", user, host),
 	}
 
-	sshArgs := append(defaultSSHArgs, args...)
+	sshArgs := append(defaultSSHArgs, options...)
+	sshArgs = append(sshArgs, fmt.Sprintf("%s@%s", user, host))
+	sshArgs = append(sshArgs, args...)
 	cmd := exec.Command("ssh", sshArgs...)
 	cmd.Stderr = os.Stderr
 
@@ -35,6 +42,16 @@ func GetSSHCommand(host string, port int, user string, sshKey string, args ...st
 	return cmd
 }
 
+// MultiplexOptions returns the ssh options that make consecutive commands
+// share one connection through the control socket at controlPath.
+func MultiplexOptions(controlPath string) []string {
+	return []string{
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + controlPath,
+		"-o", "ControlPersist=60s",
+	}
+}
+
 func GenerateSSHKey(path string) error {
 	if _, err := exec.LookPath("ssh-keygen"); err != nil {
 		return fmt.Errorf("ssh-keygen not found in the path, please install ssh-keygen")
@@ -45,7 +62,8 @@ func GenerateSSHKey(path string) error {
 			return err
 		}
 
-		cmd := exec.Command("ssh-keygen", "-t", "rsa", "-N", "", "-f", path)
+		// write a classic PEM key, which tools like PuTTYgen can convert
+		cmd := exec.Command("ssh-keygen", "-t", "rsa", "-m", "PEM", "-N", "", "-f", path)
 
 		if os.Getenv("DEBUG") != "" {
 			cmd.Stdout = os.Stdout
@@ -52,6 +52,11 @@ func (s *Store) Create(name string, driverName string, flags drivers.DriverOptio
 		return nil, err
 	}
 
+	// a dry run only checks the create, nothing is saved
+	if drivers.IsDryRun(host.Driver) {
+		return host, host.Create(name)
+	}
+
 	if err := os.MkdirAll(hostPath, 0700); err != nil {
 		return nil, err
 	}
@@ -68,6 +73,12 @@ func (s *Store) Create(name string, driverName string, flags drivers.DriverOptio
 		return host, err
 	}
 
+	if verifier, ok := host.Driver.(drivers.EndpointVerifier); ok {
+		if err := verifier.VerifyDockerEndpoint(); err != nil {
+			return host, err
+		}
+	}
+
 	if flags.Bool("swarm") {
 		log.Info("Configuring Swarm...")
 
@@ -32,6 +32,10 @@ func (d DriverOptionsMock) Bool(key string) bool {
 	return d.Data[key].(bool)
 }
 
+func (d DriverOptionsMock) StringSlice(key string) []string {
+	return d.Data[key].([]string)
+}
+
 func clearHosts() error {
 	return os.RemoveAll(TestStoreDir)
 }